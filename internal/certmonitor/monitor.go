@@ -0,0 +1,40 @@
+package certmonitor
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go-service/internal/provisioner"
+)
+
+// Monitor runs Service.RenewCertificates on an interval so tenant
+// certificates are replaced before they expire.
+type Monitor struct {
+	service  *provisioner.Service
+	interval time.Duration
+}
+
+func New(service *provisioner.Service, interval time.Duration) *Monitor {
+	return &Monitor{service: service, interval: interval}
+}
+
+// Start runs the monitor until ctx is done. A non-positive interval disables
+// it.
+func (m *Monitor) Start(ctx context.Context) {
+	if m.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.service.RenewCertificates(ctx); err != nil {
+				slog.ErrorContext(ctx, "certificate renewal failed", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateReusesAuthority(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadOrCreate(dir)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	second, err := LoadOrCreate(dir)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !bytes.Equal(first.BundlePEM(), second.BundlePEM()) {
+		t.Fatal("second load created a new CA")
+	}
+}
+
+func TestIssueVerifiesAgainstBundle(t *testing.T) {
+	ca, err := LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := ca.Issue("acme", []string{"tenant-db-acme", "127.0.0.1"}, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	block, _ := pem.Decode(issued.CertPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.BundlePEM())
+	for _, host := range []string{"tenant-db-acme", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Fatalf("verify %s: %v", host, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "tenant-db-other", Roots: roots}); err == nil {
+		t.Fatal("certificate verified for a host it was not issued for")
+	}
+	if issued.NotAfter.Sub(time.Now()) > 24*time.Hour {
+		t.Fatalf("not after = %s, want within a day", issued.NotAfter)
+	}
+}
@@ -2,40 +2,220 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"go-service/internal/docker"
 )
 
+// defaultTenantDBExtensions are contrib extensions shipped with the official
+// Postgres images that need no shared_preload_libraries.
+const defaultTenantDBExtensions = "pgcrypto,uuid-ossp,pg_trgm,citext,hstore,unaccent,btree_gin,btree_gist,ltree,fuzzystrmatch,tablefunc,intarray"
+
 type Config struct {
-	Port                 string
-	DockerBin            string
-	DockerCommandTimeout time.Duration
-	HTTPReadTimeout      time.Duration
-	HTTPWriteTimeout     time.Duration
-	HTTPIdleTimeout      time.Duration
-	HTTPBodyLimitBytes   int
-	RateLimitMax         int
-	RateLimitWindow      time.Duration
-	TenantDBImage        string
-	TenantDBNetwork      string
-	TenantDBHost         string
-	TenantDBUser         string
-	TenantDBNamePrefix   string
-	DefaultMemoryMB      *int64
-	DefaultCPUCores      *float64
+	Port                   string
+	DockerBin              string
+	DockerCommandTimeout   time.Duration
+	HTTPReadTimeout        time.Duration
+	HTTPWriteTimeout       time.Duration
+	HTTPIdleTimeout        time.Duration
+	HTTPBodyLimitBytes     int
+	RateLimitMax           int
+	RateLimitWindow        time.Duration
+	TenantDBImage          string
+	TenantDBNetwork        string
+	TenantDBHost           string
+	TenantDBUser           string
+	TenantDBNamePrefix     string
+	DefaultMemoryMB        *int64
+	DefaultCPUCores        *float64
+	MinMemoryMB            *int64
+	MaxMemoryMB            *int64
+	MinCPUCores            *float64
+	MaxCPUCores            *float64
+	MaxPidsLimit           *int64
+	MemoryBudgetMB         *int64
+	CPUBudgetCores         *float64
+	IdempotencyTTL         time.Duration
+	TenantLockBackend      string
+	TenantLockDir          string
+	DockerMaxConcurrent    int
+	DockerMaxQueued        int
+	DockerQueueRetry       time.Duration
+	LogFormat              string
+	LogLevel               string
+	TenantDBReadyTimeout   time.Duration
+	TracingExporter        string
+	TracingFile            string
+	TracingSampleRatio     float64
+	ReadinessCacheTTL      time.Duration
+	TenantMaxContainers    int
+	ShutdownDrainTimeout   time.Duration
+	RegistryPath           string
+	ReconcileInterval      time.Duration
+	ReconcilePolicy        string
+	ReconcileOrphanGrace   time.Duration
+	TenantDBRestartPolicy  string
+	CrashLoopRestarts      int
+	CrashLoopWindow        time.Duration
+	PlansFile              string
+	StorageQuotaMode       string
+	TenantStorageQuotaMB   *int64
+	VolumeDriver           string
+	VolumeSizeOpt          string
+	StorageMonitorEvery    time.Duration
+	StorageQuotaPolicy     string
+	TenantStopTimeout      time.Duration
+	IdleCheckInterval      time.Duration
+	IdleSuspendAfter       time.Duration
+	IdleCPUPercent         float64
+	PortRangeStart         *int
+	PortRangeEnd           *int
+	TenantDBPublish        string
+	TenantDBBindAddress    string
+	PGProxyAddr            string
+	PGProxyTLSCertFile     string
+	PGProxyTLSKeyFile      string
+	TenantTLSDir           string
+	TenantCertValidity     time.Duration
+	TenantCertRenewBefore  time.Duration
+	CertCheckInterval      time.Duration
+	TenantNetworkIsolation string
+	TenantNetworkAttach    []string
+	TenantDBExtensions     []string
+	MigrationBundles       map[string]string
+	MigrationDefault       string
+	TenantDBPullPolicy     string
 }
 
 func Load() (Config, error) {
 	cfg := Config{
-		Port:               getEnv("PORT", "3000"),
-		DockerBin:          getEnv("DOCKER_BIN", "docker"),
-		TenantDBImage:      getEnv("TENANT_DB_IMAGE", "postgres:16-alpine"),
-		TenantDBNetwork:    getEnv("TENANT_DB_NETWORK", "auth-tenants"),
-		TenantDBHost:       getEnv("TENANT_DB_HOST", "127.0.0.1"),
-		TenantDBUser:       getEnv("TENANT_DB_USER", "tenant_user"),
-		TenantDBNamePrefix: getEnv("TENANT_DB_NAME_PREFIX", "tenant_"),
+		Port:                   getEnv("PORT", "3000"),
+		DockerBin:              getEnv("DOCKER_BIN", "docker"),
+		TenantDBImage:          getEnv("TENANT_DB_IMAGE", "postgres:16-alpine"),
+		TenantDBNetwork:        getEnv("TENANT_DB_NETWORK", "auth-tenants"),
+		TenantDBHost:           getEnv("TENANT_DB_HOST", "127.0.0.1"),
+		TenantDBUser:           getEnv("TENANT_DB_USER", "tenant_user"),
+		TenantDBNamePrefix:     getEnv("TENANT_DB_NAME_PREFIX", "tenant_"),
+		TenantLockBackend:      strings.ToLower(getEnv("TENANT_LOCK_BACKEND", "memory")),
+		TenantLockDir:          getEnv("TENANT_LOCK_DIR", ""),
+		LogFormat:              strings.ToLower(getEnv("LOG_FORMAT", "json")),
+		LogLevel:               strings.ToLower(getEnv("LOG_LEVEL", "info")),
+		TracingExporter:        strings.ToLower(getEnv("TRACING_EXPORTER", "none")),
+		TracingFile:            getEnv("TRACING_FILE", "traces.jsonl"),
+		RegistryPath:           getEnv("REGISTRY_PATH", ""),
+		ReconcilePolicy:        strings.ToLower(getEnv("RECONCILE_POLICY", "report")),
+		TenantDBRestartPolicy:  getEnv("TENANT_DB_RESTART_POLICY", "unless-stopped"),
+		PlansFile:              getEnv("PLANS_FILE", ""),
+		StorageQuotaMode:       strings.ToLower(getEnv("TENANT_STORAGE_QUOTA_MODE", "none")),
+		VolumeDriver:           getEnv("TENANT_VOLUME_DRIVER", "local"),
+		VolumeSizeOpt:          getEnv("TENANT_VOLUME_SIZE_OPT", "size"),
+		StorageQuotaPolicy:     strings.ToLower(getEnv("STORAGE_QUOTA_POLICY", "warn")),
+		TenantDBPublish:        strings.ToLower(getEnv("TENANT_DB_PUBLISH", "host")),
+		TenantDBBindAddress:    getEnv("TENANT_DB_BIND_ADDRESS", ""),
+		PGProxyAddr:            getEnv("PGPROXY_LISTEN_ADDR", ""),
+		PGProxyTLSCertFile:     getEnv("PGPROXY_TLS_CERT_FILE", ""),
+		PGProxyTLSKeyFile:      getEnv("PGPROXY_TLS_KEY_FILE", ""),
+		TenantTLSDir:           getEnv("TENANT_TLS_DIR", ""),
+		TenantNetworkIsolation: strings.ToLower(getEnv("TENANT_NETWORK_ISOLATION", "shared")),
+		TenantNetworkAttach:    splitList(getEnv("TENANT_NETWORK_ATTACH", "")),
+		TenantDBExtensions:     splitList(getEnv("TENANT_DB_EXTENSIONS", defaultTenantDBExtensions)),
+		MigrationDefault:       getEnv("MIGRATION_DEFAULT_BUNDLE", ""),
+		TenantDBPullPolicy:     strings.ToLower(getEnv("TENANT_DB_PULL_POLICY", "missing")),
+	}
+
+	if !docker.ValidRestartPolicy(cfg.TenantDBRestartPolicy) {
+		return cfg, fmt.Errorf("TENANT_DB_RESTART_POLICY must be no, always, unless-stopped or on-failure[:N]")
+	}
+
+	switch cfg.StorageQuotaMode {
+	case "none", "storage-opt", "volume":
+	default:
+		return cfg, fmt.Errorf("TENANT_STORAGE_QUOTA_MODE must be none, storage-opt or volume")
+	}
+
+	switch cfg.TenantDBPublish {
+	case "host", "network":
+	default:
+		return cfg, fmt.Errorf("TENANT_DB_PUBLISH must be host or network")
+	}
+	if cfg.TenantDBBindAddress != "" && net.ParseIP(cfg.TenantDBBindAddress) == nil {
+		return cfg, fmt.Errorf("TENANT_DB_BIND_ADDRESS must be an IP address")
+	}
+
+	if (cfg.PGProxyTLSCertFile == "") != (cfg.PGProxyTLSKeyFile == "") {
+		return cfg, fmt.Errorf("PGPROXY_TLS_CERT_FILE and PGPROXY_TLS_KEY_FILE must be set together")
+	}
+
+	switch cfg.TenantNetworkIsolation {
+	case "shared", "dedicated":
+	default:
+		return cfg, fmt.Errorf("TENANT_NETWORK_ISOLATION must be shared or dedicated")
+	}
+
+	switch cfg.TenantDBPullPolicy {
+	case "missing", "always":
+	default:
+		return cfg, fmt.Errorf("TENANT_DB_PULL_POLICY must be missing or always")
+	}
+
+	bundles, err := parseBundles(getEnv("MIGRATION_BUNDLES", ""))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MigrationBundles = bundles
+	if _, ok := bundles[cfg.MigrationDefault]; cfg.MigrationDefault != "" && !ok {
+		return cfg, fmt.Errorf("MIGRATION_DEFAULT_BUNDLE %q is not listed in MIGRATION_BUNDLES", cfg.MigrationDefault)
+	}
+
+	switch cfg.StorageQuotaPolicy {
+	case "warn", "read-only":
+	default:
+		return cfg, fmt.Errorf("STORAGE_QUOTA_POLICY must be warn or read-only")
+	}
+
+	switch cfg.ReconcilePolicy {
+	case "report", "repair":
+	default:
+		return cfg, fmt.Errorf("RECONCILE_POLICY must be report or repair")
+	}
+
+	switch cfg.TracingExporter {
+	case "none", "otlp", "stdout", "file":
+	default:
+		return cfg, fmt.Errorf("TRACING_EXPORTER must be none, otlp, stdout or file")
+	}
+	sampleRatio, err := parseFloat64Env("TRACING_SAMPLE_RATIO")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.TracingSampleRatio = 1
+	if sampleRatio != nil {
+		cfg.TracingSampleRatio = *sampleRatio
+	}
+
+	switch cfg.LogFormat {
+	case "json", "text":
+	default:
+		return cfg, fmt.Errorf("LOG_FORMAT must be json or text")
+	}
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return cfg, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error")
+	}
+
+	switch cfg.TenantLockBackend {
+	case "memory":
+	case "file":
+		if cfg.TenantLockDir == "" {
+			return cfg, fmt.Errorf("TENANT_LOCK_DIR is required when TENANT_LOCK_BACKEND=file")
+		}
+	default:
+		return cfg, fmt.Errorf("TENANT_LOCK_BACKEND must be memory or file")
 	}
 
 	timeoutSec, err := parseInt64Env("DOCKER_COMMAND_TIMEOUT_SECONDS")
@@ -58,6 +238,61 @@ func Load() (Config, error) {
 		return cfg, err
 	}
 
+	cfg.MinMemoryMB, err = parseInt64Env("TENANT_DB_MIN_MEMORY_MB")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MinCPUCores, err = parseFloat64Env("TENANT_DB_MIN_CPU_CORES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxMemoryMB, err = parseInt64Env("TENANT_DB_MAX_MEMORY_MB")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxCPUCores, err = parseFloat64Env("TENANT_DB_MAX_CPU_CORES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxPidsLimit, err = parseInt64Env("TENANT_DB_MAX_PIDS")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.TenantStorageQuotaMB, err = parseInt64Env("TENANT_STORAGE_QUOTA_MB")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MemoryBudgetMB, err = parseInt64Env("TENANT_MEMORY_BUDGET_MB")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CPUBudgetCores, err = parseFloat64Env("TENANT_CPU_BUDGET_CORES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.PortRangeStart, err = parseIntEnv("TENANT_PORT_RANGE_START")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.PortRangeEnd, err = parseIntEnv("TENANT_PORT_RANGE_END")
+	if err != nil {
+		return cfg, err
+	}
+	if (cfg.PortRangeStart == nil) != (cfg.PortRangeEnd == nil) {
+		return cfg, fmt.Errorf("TENANT_PORT_RANGE_START and TENANT_PORT_RANGE_END must be set together")
+	}
+	if cfg.PortRangeStart != nil {
+		if *cfg.PortRangeStart < 1 || *cfg.PortRangeEnd > 65535 || *cfg.PortRangeStart > *cfg.PortRangeEnd {
+			return cfg, fmt.Errorf("TENANT_PORT_RANGE_START..TENANT_PORT_RANGE_END must be a valid port range")
+		}
+	}
+	if cfg.MinMemoryMB != nil && cfg.MaxMemoryMB != nil && *cfg.MinMemoryMB > *cfg.MaxMemoryMB {
+		return cfg, fmt.Errorf("TENANT_DB_MIN_MEMORY_MB must not exceed TENANT_DB_MAX_MEMORY_MB")
+	}
+	if cfg.MinCPUCores != nil && cfg.MaxCPUCores != nil && *cfg.MinCPUCores > *cfg.MaxCPUCores {
+		return cfg, fmt.Errorf("TENANT_DB_MIN_CPU_CORES must not exceed TENANT_DB_MAX_CPU_CORES")
+	}
+
 	httpReadTimeoutSec, err := parseInt64Env("HTTP_READ_TIMEOUT_SECONDS")
 	if err != nil {
 		return cfg, err
@@ -82,6 +317,86 @@ func Load() (Config, error) {
 	if err != nil {
 		return cfg, err
 	}
+	idempotencyTTLSec, err := parseInt64Env("IDEMPOTENCY_TTL_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	dockerMaxConcurrent, err := parseIntEnv("DOCKER_MAX_CONCURRENT_OPERATIONS")
+	if err != nil {
+		return cfg, err
+	}
+	dockerMaxQueued, err := parseIntEnv("DOCKER_MAX_QUEUED_OPERATIONS")
+	if err != nil {
+		return cfg, err
+	}
+	dockerQueueRetrySec, err := parseInt64Env("DOCKER_QUEUE_RETRY_AFTER_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	readyTimeoutSec, err := parseInt64Env("TENANT_DB_READY_TIMEOUT_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	readinessCacheSec, err := parseInt64Env("READINESS_CACHE_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	maxContainers, err := parseIntEnv("TENANT_MAX_CONTAINERS")
+	if err != nil {
+		return cfg, err
+	}
+	drainTimeoutSec, err := parseInt64Env("SHUTDOWN_DRAIN_TIMEOUT_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	reconcileIntervalSec, err := parseInt64Env("RECONCILE_INTERVAL_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	reconcileGraceSec, err := parseInt64Env("RECONCILE_ORPHAN_GRACE_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	stopTimeoutSec, err := parseInt64Env("TENANT_STOP_TIMEOUT_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	idleCheckSec, err := parseInt64Env("IDLE_CHECK_INTERVAL_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	idleSuspendSec, err := parseInt64Env("IDLE_SUSPEND_AFTER_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	idleCPU, err := parseFloat64Env("IDLE_CPU_PERCENT")
+	if err != nil {
+		return cfg, err
+	}
+	certDays, err := parseInt64Env("TENANT_TLS_CERT_DAYS")
+	if err != nil {
+		return cfg, err
+	}
+	renewDays, err := parseInt64Env("TENANT_TLS_RENEW_BEFORE_DAYS")
+	if err != nil {
+		return cfg, err
+	}
+	certCheckSec, err := parseInt64Env("TENANT_TLS_CHECK_INTERVAL_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	storageMonitorSec, err := parseInt64Env("STORAGE_MONITOR_INTERVAL_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
+	crashLoopRestarts, err := parseIntEnv("TENANT_CRASHLOOP_RESTARTS")
+	if err != nil {
+		return cfg, err
+	}
+	crashLoopWindowSec, err := parseInt64Env("TENANT_CRASHLOOP_WINDOW_SECONDS")
+	if err != nil {
+		return cfg, err
+	}
 
 	cfg.HTTPReadTimeout = withDefaultDurationSeconds(httpReadTimeoutSec, 10)
 	cfg.HTTPWriteTimeout = withDefaultDurationSeconds(httpWriteTimeoutSec, 30)
@@ -89,6 +404,32 @@ func Load() (Config, error) {
 	cfg.HTTPBodyLimitBytes = withDefaultInt(httpBodyLimitBytes, 1024*1024)
 	cfg.RateLimitMax = withDefaultInt(rateLimitMax, 60)
 	cfg.RateLimitWindow = withDefaultDurationSeconds(rateLimitWindowSec, 60)
+	cfg.IdempotencyTTL = withDefaultDurationSeconds(idempotencyTTLSec, 24*60*60)
+	cfg.DockerMaxConcurrent = withDefaultInt(dockerMaxConcurrent, 4)
+	cfg.DockerMaxQueued = withDefaultInt(dockerMaxQueued, 32)
+	cfg.DockerQueueRetry = withDefaultDurationSeconds(dockerQueueRetrySec, 5)
+	cfg.TenantDBReadyTimeout = withDefaultDurationSeconds(readyTimeoutSec, 0)
+	cfg.ReadinessCacheTTL = withDefaultDurationSeconds(readinessCacheSec, 5)
+	cfg.TenantMaxContainers = withDefaultInt(maxContainers, 0)
+	cfg.ShutdownDrainTimeout = withDefaultDurationSeconds(drainTimeoutSec, 30)
+	cfg.ReconcileInterval = withDefaultDurationSeconds(reconcileIntervalSec, 300)
+	cfg.ReconcileOrphanGrace = withDefaultDurationSeconds(reconcileGraceSec, 600)
+	cfg.CrashLoopRestarts = withDefaultInt(crashLoopRestarts, 3)
+	cfg.CrashLoopWindow = withDefaultDurationSeconds(crashLoopWindowSec, 600)
+	cfg.StorageMonitorEvery = withDefaultDurationSeconds(storageMonitorSec, 300)
+	cfg.TenantStopTimeout = withDefaultDurationSeconds(stopTimeoutSec, 30)
+	cfg.IdleCheckInterval = withDefaultDurationSeconds(idleCheckSec, 60)
+	cfg.IdleSuspendAfter = withDefaultDurationSeconds(idleSuspendSec, 0)
+	cfg.TenantCertValidity = withDefaultDurationDays(certDays, 90)
+	cfg.TenantCertRenewBefore = withDefaultDurationDays(renewDays, 30)
+	cfg.CertCheckInterval = withDefaultDurationSeconds(certCheckSec, 3600)
+	if cfg.TenantCertRenewBefore >= cfg.TenantCertValidity {
+		return cfg, fmt.Errorf("TENANT_TLS_RENEW_BEFORE_DAYS must be less than TENANT_TLS_CERT_DAYS")
+	}
+	cfg.IdleCPUPercent = 1
+	if idleCPU != nil {
+		cfg.IdleCPUPercent = *idleCPU
+	}
 
 	return cfg, nil
 }
@@ -144,9 +485,40 @@ func withDefaultDurationSeconds(value *int64, defaultSeconds int64) time.Duratio
 	return time.Duration(*value) * time.Second
 }
 
+func withDefaultDurationDays(value *int64, defaultDays int64) time.Duration {
+	return withDefaultDurationSeconds(value, defaultDays) * 24 * 60 * 60
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func withDefaultInt(value *int, defaultValue int) int {
 	if value == nil {
 		return defaultValue
 	}
 	return *value
 }
+
+// parseBundles reads a comma separated list of name=directory pairs.
+func parseBundles(value string) (map[string]string, error) {
+	bundles := map[string]string{}
+	for _, item := range splitList(value) {
+		name, dir, ok := strings.Cut(item, "=")
+		name, dir = strings.TrimSpace(name), strings.TrimSpace(dir)
+		if !ok || name == "" || dir == "" {
+			return nil, fmt.Errorf("MIGRATION_BUNDLES entry %q must be name=directory", item)
+		}
+		if _, dup := bundles[name]; dup {
+			return nil, fmt.Errorf("MIGRATION_BUNDLES lists %q twice", name)
+		}
+		bundles[name] = dir
+	}
+	return bundles, nil
+}
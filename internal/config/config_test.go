@@ -25,6 +25,48 @@ func TestLoadDefaults(t *testing.T) {
 		if cfg.RateLimitMax != 60 {
 			t.Fatalf("rate limit max = %d, want 60", cfg.RateLimitMax)
 		}
+		if cfg.IdempotencyTTL != 24*time.Hour {
+			t.Fatalf("idempotency ttl = %s, want 24h", cfg.IdempotencyTTL)
+		}
+		if cfg.TracingExporter != "none" || cfg.TracingSampleRatio != 1 {
+			t.Fatalf("tracing = %s/%g, want none/1", cfg.TracingExporter, cfg.TracingSampleRatio)
+		}
+		if cfg.ReadinessCacheTTL != 5*time.Second || cfg.TenantMaxContainers != 0 {
+			t.Fatalf("readiness = %s/%d, want 5s/0", cfg.ReadinessCacheTTL, cfg.TenantMaxContainers)
+		}
+		if cfg.MaxMemoryMB != nil || cfg.MaxCPUCores != nil || cfg.MaxPidsLimit != nil {
+			t.Fatal("expected no resource maxima by default")
+		}
+		if cfg.StorageQuotaMode != "none" || cfg.StorageQuotaPolicy != "warn" || cfg.StorageMonitorEvery != 5*time.Minute {
+			t.Fatalf("storage = %s/%s/%s, want none/warn/5m", cfg.StorageQuotaMode, cfg.StorageQuotaPolicy, cfg.StorageMonitorEvery)
+		}
+		if cfg.IdleSuspendAfter != 0 || cfg.IdleCheckInterval != time.Minute || cfg.IdleCPUPercent != 1 {
+			t.Fatalf("idle = %s/%s/%g, want 0s/1m/1", cfg.IdleSuspendAfter, cfg.IdleCheckInterval, cfg.IdleCPUPercent)
+		}
+		if cfg.TenantCertValidity != 90*24*time.Hour || cfg.TenantCertRenewBefore != 30*24*time.Hour {
+			t.Fatalf("cert validity = %s, renew before = %s", cfg.TenantCertValidity, cfg.TenantCertRenewBefore)
+		}
+		if cfg.TenantStopTimeout != 30*time.Second {
+			t.Fatalf("stop timeout = %s, want 30s", cfg.TenantStopTimeout)
+		}
+		if cfg.TenantDBRestartPolicy != "unless-stopped" {
+			t.Fatalf("restart policy = %q, want unless-stopped", cfg.TenantDBRestartPolicy)
+		}
+		if cfg.ReconcilePolicy != "report" || cfg.ReconcileInterval != 5*time.Minute {
+			t.Fatalf("reconcile = %s/%s, want report/5m", cfg.ReconcilePolicy, cfg.ReconcileInterval)
+		}
+		if cfg.ShutdownDrainTimeout != 30*time.Second {
+			t.Fatalf("drain timeout = %s, want 30s", cfg.ShutdownDrainTimeout)
+		}
+		if cfg.TenantDBReadyTimeout != 0 {
+			t.Fatalf("ready timeout = %s, want 0", cfg.TenantDBReadyTimeout)
+		}
+		if cfg.LogFormat != "json" || cfg.LogLevel != "info" {
+			t.Fatalf("log = %s/%s, want json/info", cfg.LogFormat, cfg.LogLevel)
+		}
+		if cfg.DockerMaxConcurrent != 4 || cfg.DockerMaxQueued != 32 {
+			t.Fatalf("docker queue = %d/%d, want 4/32", cfg.DockerMaxConcurrent, cfg.DockerMaxQueued)
+		}
 	})
 }
 
@@ -38,6 +80,208 @@ func TestLoadInvalidEnv(t *testing.T) {
 	})
 }
 
+func TestLoadInvalidLogLevel(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("LOG_LEVEL", "verbose")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadRestartPolicy(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("TENANT_DB_RESTART_POLICY", "on-failure:5")
+		if _, err := Load(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		t.Setenv("TENANT_DB_RESTART_POLICY", "sometimes")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadRejectsInvertedLimitBounds(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("TENANT_DB_MIN_MEMORY_MB", "1024")
+		t.Setenv("TENANT_DB_MAX_MEMORY_MB", "512")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadPortRange(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("TENANT_PORT_RANGE_START", "55000")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error for a range without end, got nil")
+		}
+
+		t.Setenv("TENANT_PORT_RANGE_END", "54000")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error for an inverted range, got nil")
+		}
+
+		t.Setenv("TENANT_PORT_RANGE_END", "55999")
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if *cfg.PortRangeStart != 55000 || *cfg.PortRangeEnd != 55999 {
+			t.Fatalf("range = %d-%d, want 55000-55999", *cfg.PortRangeStart, *cfg.PortRangeEnd)
+		}
+	})
+}
+
+func TestLoadPublishSettings(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.TenantDBPublish != "host" || cfg.TenantDBBindAddress != "" {
+			t.Fatalf("publish = %q/%q, want host on all interfaces", cfg.TenantDBPublish, cfg.TenantDBBindAddress)
+		}
+
+		t.Setenv("TENANT_DB_BIND_ADDRESS", "localhost")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error for a hostname bind address, got nil")
+		}
+		t.Setenv("TENANT_DB_BIND_ADDRESS", "10.0.0.5")
+		t.Setenv("TENANT_DB_PUBLISH", "none")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error for an unknown publish mode, got nil")
+		}
+	})
+}
+
+func TestLoadProxyTLSRequiresKey(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("PGPROXY_LISTEN_ADDR", ":6432")
+		t.Setenv("PGPROXY_TLS_CERT_FILE", "/etc/pgproxy/tls.crt")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadRejectsRenewalLongerThanValidity(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("TENANT_TLS_CERT_DAYS", "30")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadNetworkIsolation(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("TENANT_NETWORK_ISOLATION", "dedicated")
+		t.Setenv("TENANT_NETWORK_ATTACH", "pgproxy, ,provisioner")
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(cfg.TenantNetworkAttach) != 2 || cfg.TenantNetworkAttach[0] != "pgproxy" || cfg.TenantNetworkAttach[1] != "provisioner" {
+			t.Fatalf("attach = %q", cfg.TenantNetworkAttach)
+		}
+
+		t.Setenv("TENANT_NETWORK_ISOLATION", "vlan")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadTenantDBExtensions(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(cfg.TenantDBExtensions) == 0 || cfg.TenantDBExtensions[0] != "pgcrypto" {
+			t.Fatalf("default extensions = %q", cfg.TenantDBExtensions)
+		}
+
+		t.Setenv("TENANT_DB_EXTENSIONS", "postgis, pgcrypto")
+		cfg, err = Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(cfg.TenantDBExtensions) != 2 || cfg.TenantDBExtensions[0] != "postgis" {
+			t.Fatalf("extensions = %q", cfg.TenantDBExtensions)
+		}
+	})
+}
+
+func TestLoadMigrationBundles(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("MIGRATION_BUNDLES", "iam=/srv/migrations/iam, billing = /srv/migrations/billing")
+		t.Setenv("MIGRATION_DEFAULT_BUNDLE", "iam")
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(cfg.MigrationBundles) != 2 || cfg.MigrationBundles["billing"] != "/srv/migrations/billing" {
+			t.Fatalf("bundles = %v", cfg.MigrationBundles)
+		}
+
+		t.Setenv("MIGRATION_DEFAULT_BUNDLE", "crm")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error for an unknown default bundle, got nil")
+		}
+
+		t.Setenv("MIGRATION_DEFAULT_BUNDLE", "")
+		t.Setenv("MIGRATION_BUNDLES", "iam")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error for an entry without directory, got nil")
+		}
+	})
+}
+
+func TestLoadPullPolicy(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.TenantDBPullPolicy != "missing" {
+			t.Fatalf("pull policy = %q, want missing", cfg.TenantDBPullPolicy)
+		}
+
+		t.Setenv("TENANT_DB_PULL_POLICY", "Always")
+		if cfg, err = Load(); err != nil || cfg.TenantDBPullPolicy != "always" {
+			t.Fatalf("pull policy = %q, %v", cfg.TenantDBPullPolicy, err)
+		}
+
+		t.Setenv("TENANT_DB_PULL_POLICY", "never")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestLoadFileLockRequiresDir(t *testing.T) {
+	withIsolatedEnv(t, func() {
+		t.Setenv("TENANT_LOCK_BACKEND", "file")
+		if _, err := Load(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+
+		t.Setenv("TENANT_LOCK_DIR", "/var/lib/provisioner/locks")
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.TenantLockBackend != "file" {
+			t.Fatalf("lock backend = %q, want file", cfg.TenantLockBackend)
+		}
+	})
+}
+
 func withIsolatedEnv(t *testing.T, fn func()) {
 	t.Helper()
 	keys := []string{
@@ -57,6 +301,63 @@ func withIsolatedEnv(t *testing.T, fn func()) {
 		"HTTP_IDLE_TIMEOUT_SECONDS",
 		"HTTP_RATE_LIMIT_MAX",
 		"HTTP_RATE_LIMIT_WINDOW_SECONDS",
+		"IDEMPOTENCY_TTL_SECONDS",
+		"TENANT_LOCK_BACKEND",
+		"TENANT_LOCK_DIR",
+		"DOCKER_MAX_CONCURRENT_OPERATIONS",
+		"DOCKER_MAX_QUEUED_OPERATIONS",
+		"DOCKER_QUEUE_RETRY_AFTER_SECONDS",
+		"LOG_FORMAT",
+		"LOG_LEVEL",
+		"TENANT_DB_READY_TIMEOUT_SECONDS",
+		"TRACING_EXPORTER",
+		"TRACING_FILE",
+		"TRACING_SAMPLE_RATIO",
+		"READINESS_CACHE_SECONDS",
+		"TENANT_MAX_CONTAINERS",
+		"SHUTDOWN_DRAIN_TIMEOUT_SECONDS",
+		"REGISTRY_PATH",
+		"RECONCILE_INTERVAL_SECONDS",
+		"RECONCILE_POLICY",
+		"RECONCILE_ORPHAN_GRACE_SECONDS",
+		"TENANT_DB_RESTART_POLICY",
+		"TENANT_CRASHLOOP_RESTARTS",
+		"TENANT_CRASHLOOP_WINDOW_SECONDS",
+		"TENANT_DB_MAX_MEMORY_MB",
+		"TENANT_DB_MAX_CPU_CORES",
+		"TENANT_DB_MAX_PIDS",
+		"TENANT_DB_MIN_MEMORY_MB",
+		"TENANT_DB_MIN_CPU_CORES",
+		"TENANT_MEMORY_BUDGET_MB",
+		"TENANT_CPU_BUDGET_CORES",
+		"PLANS_FILE",
+		"TENANT_STORAGE_QUOTA_MODE",
+		"TENANT_STORAGE_QUOTA_MB",
+		"TENANT_VOLUME_DRIVER",
+		"TENANT_VOLUME_SIZE_OPT",
+		"STORAGE_MONITOR_INTERVAL_SECONDS",
+		"STORAGE_QUOTA_POLICY",
+		"TENANT_STOP_TIMEOUT_SECONDS",
+		"IDLE_CHECK_INTERVAL_SECONDS",
+		"IDLE_SUSPEND_AFTER_SECONDS",
+		"IDLE_CPU_PERCENT",
+		"TENANT_PORT_RANGE_START",
+		"TENANT_PORT_RANGE_END",
+		"TENANT_DB_PUBLISH",
+		"TENANT_DB_BIND_ADDRESS",
+		"PGPROXY_LISTEN_ADDR",
+		"PGPROXY_TLS_CERT_FILE",
+		"PGPROXY_TLS_KEY_FILE",
+		"TENANT_TLS_DIR",
+		"TENANT_TLS_CERT_DAYS",
+		"TENANT_TLS_RENEW_BEFORE_DAYS",
+		"TENANT_TLS_CHECK_INTERVAL_SECONDS",
+		"TENANT_NETWORK_ISOLATION",
+		"TENANT_NETWORK_ATTACH",
+		"TENANT_DB_EXTENSIONS",
+		"MIGRATION_BUNDLES",
+		"MIGRATION_DEFAULT_BUNDLE",
+		"TENANT_DB_PULL_POLICY",
 	}
 
 	backup := make(map[string]*string, len(keys))
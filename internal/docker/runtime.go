@@ -3,37 +3,123 @@ package docker
 import (
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os/exec"
+	"regexp"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/tracing"
+)
+
+var (
+	sensitiveKeyMarkers = []string{"PASSWORD", "SECRET", "TOKEN"}
+	restartPolicyFormat = regexp.MustCompile(`^(no|always|unless-stopped|on-failure(:[0-9]+)?)$`)
 )
 
+// ValidRestartPolicy reports whether policy is accepted by docker run
+// --restart.
+func ValidRestartPolicy(policy string) bool {
+	return restartPolicyFormat.MatchString(policy)
+}
+
 type Runtime struct {
 	bin     string
 	timeout time.Duration
+	tracer  trace.Tracer
 }
 
 func NewRuntime(bin string, timeout time.Duration) *Runtime {
-	return &Runtime{bin: bin, timeout: timeout}
+	return &Runtime{bin: bin, timeout: timeout, tracer: tracing.Tracer("go-service/internal/docker")}
 }
 
-func (r *Runtime) Run(parentCtx context.Context, args ...string) (string, error) {
+func (r *Runtime) Run(ctx context.Context, args ...string) (string, error) {
+	return r.run(ctx, nil, args)
+}
+
+// RunInput runs a docker command with input on its stdin, e.g. a script for
+// "exec -i" that is too large to pass as an argument.
+func (r *Runtime) RunInput(ctx context.Context, input string, args ...string) (string, error) {
+	return r.run(ctx, strings.NewReader(input), args)
+}
+
+func (r *Runtime) run(parentCtx context.Context, stdin io.Reader, args []string) (out string, err error) {
+	redacted := RedactArgs(args)
+	parentCtx, span := r.tracer.Start(
+		parentCtx, "docker "+Subcommand(args),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("docker.command", strings.Join(redacted, " "))),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	ctx, cancel := context.WithTimeout(parentCtx, r.timeout)
 	defer cancel()
 
+	start := time.Now()
 	cmd := exec.CommandContext(ctx, r.bin, args...)
+	cmd.Stdin = stdin
 	output, err := cmd.CombinedOutput()
-	out := strings.TrimSpace(string(output))
+	out = strings.TrimSpace(string(output))
+	duration := time.Since(start)
+
+	logAttrs := []any{
+		slog.String("command", r.bin+" "+strings.Join(redacted, " ")),
+		slog.Duration("duration", duration),
+	}
 
 	if ctx.Err() == context.DeadlineExceeded {
-		return "", fmt.Errorf("docker %v timeout after %s", args, r.timeout)
+		slog.WarnContext(parentCtx, "docker command timed out", logAttrs...)
+		return "", fmt.Errorf("docker %v timeout after %s", redacted, r.timeout)
 	}
 	if err != nil {
+		slog.WarnContext(parentCtx, "docker command failed", append(logAttrs, slog.String("error", err.Error()))...)
 		if out == "" {
-			return "", fmt.Errorf("docker %v failed: %w", args, err)
+			return "", fmt.Errorf("docker %v failed: %w", redacted, err)
 		}
-		return "", fmt.Errorf("docker %v failed: %s", args, out)
+		return "", fmt.Errorf("docker %v failed: %s", redacted, out)
 	}
 
+	slog.InfoContext(parentCtx, "docker command finished", logAttrs...)
 	return out, nil
 }
+
+// RedactArgs masks the value of KEY=value arguments whose key looks like a
+// credential, so command lines can be logged and returned in errors.
+func RedactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = arg
+		key, _, ok := strings.Cut(arg, "=")
+		if !ok {
+			continue
+		}
+		upper := strings.ToUpper(key)
+		for _, marker := range sensitiveKeyMarkers {
+			if strings.Contains(upper, marker) {
+				redacted[i] = key + "=***"
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// Subcommand names a docker invocation with bounded cardinality: management
+// commands such as "network inspect" keep their verb, everything else is the
+// first argument.
+func Subcommand(args []string) string {
+	if len(args) == 0 {
+		return "none"
+	}
+	switch args[0] {
+	case "network", "volume", "image", "container":
+		if len(args) > 1 {
+			return args[0] + "_" + args[1]
+		}
+	}
+	return args[0]
+}
@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"run", "-e", "POSTGRES_PASSWORD=s3cret", "-e", "POSTGRES_USER=tenant_user", "--label", "api_token=abc"}
+	got := strings.Join(RedactArgs(args), " ")
+
+	if strings.Contains(got, "s3cret") || strings.Contains(got, "abc") {
+		t.Fatalf("secret leaked in %q", got)
+	}
+	if !strings.Contains(got, "POSTGRES_PASSWORD=***") || !strings.Contains(got, "POSTGRES_USER=tenant_user") {
+		t.Fatalf("unexpected redaction %q", got)
+	}
+	if args[2] != "POSTGRES_PASSWORD=s3cret" {
+		t.Fatal("RedactArgs must not modify its input")
+	}
+}
+
+func TestValidRestartPolicy(t *testing.T) {
+	for _, policy := range []string{"no", "always", "unless-stopped", "on-failure", "on-failure:5"} {
+		if !ValidRestartPolicy(policy) {
+			t.Fatalf("%q rejected", policy)
+		}
+	}
+	for _, policy := range []string{"", "sometimes", "on-failure:", "always:3", "on-failure:-1"} {
+		if ValidRestartPolicy(policy) {
+			t.Fatalf("%q accepted", policy)
+		}
+	}
+}
+
+func TestRunErrorDoesNotLeakSecrets(t *testing.T) {
+	bin, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false binary not available")
+	}
+	r := NewRuntime(bin, time.Second)
+
+	_, err = r.Run(context.Background(), "run", "-e", "POSTGRES_PASSWORD=s3cret")
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("secret leaked in error: %v", err)
+	}
+}
+
+func TestRunInputWritesStdin(t *testing.T) {
+	bin, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip("cat binary not available")
+	}
+	r := NewRuntime(bin, time.Second)
+
+	out, err := r.RunInput(context.Background(), "SELECT 1;\n", "-")
+	if err != nil || out != "SELECT 1;" {
+		t.Fatalf("out = %q, %v", out, err)
+	}
+}
+
+func TestSubcommand(t *testing.T) {
+	cases := map[string][]string{
+		"run":             {"run", "-d", "postgres"},
+		"network_inspect": {"network", "inspect", "auth-tenants"},
+		"network":         {"network"},
+		"none":            nil,
+	}
+	for want, args := range cases {
+		if got := Subcommand(args); got != want {
+			t.Fatalf("Subcommand(%v) = %q, want %q", args, got, want)
+		}
+	}
+}
@@ -3,42 +3,121 @@ package httpapi
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
+	"math"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 
+	"go-service/internal/idempotency"
 	"go-service/internal/provisioner"
+	"go-service/internal/reconciler"
+	"go-service/internal/workqueue"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
 )
 
 type Handler struct {
-	service *provisioner.Service
+	service     *provisioner.Service
+	idempotency *idempotency.Store
+	reconciler  *reconciler.Reconciler
 }
 
+type Option func(*Handler)
+
 type deprovisionRequest struct {
 	ResourceID string `json:"resource_id"`
 }
 
+type changePlanRequest struct {
+	Plan string `json:"plan"`
+}
+
+type upgradeRequest struct {
+	Image string `json:"image"`
+}
+
+type attachAppRequest struct {
+	Container string `json:"container"`
+}
+
 type errorResponse struct {
-	Error      string `json:"error"`
-	ResourceID string `json:"resource_id,omitempty"`
+	Error      string                   `json:"error"`
+	ResourceID string                   `json:"resource_id,omitempty"`
+	Fields     []provisioner.FieldError `json:"fields,omitempty"`
+}
+
+func NewHandler(service *provisioner.Service, opts ...Option) *Handler {
+	h := &Handler{service: service}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
-func NewHandler(service *provisioner.Service) *Handler {
-	return &Handler{service: service}
+func WithIdempotencyStore(store *idempotency.Store) Option {
+	return func(h *Handler) {
+		h.idempotency = store
+	}
+}
+
+func WithReconciler(r *reconciler.Reconciler) Option {
+	return func(h *Handler) {
+		h.reconciler = r
+	}
 }
 
 func (h *Handler) Register(app *fiber.App) {
 	app.Get("/healthz", h.healthz)
+	app.Get("/readyz", h.readyz)
 	app.Post("/api/v1/provision/tenants", h.provisionTenant)
+	app.Get("/api/v1/provision/tenants/:name", h.tenantStatus)
+	app.Patch("/api/v1/provision/tenants/:name/limits", h.updateLimits)
+	app.Put("/api/v1/provision/tenants/:name/plan", h.changePlan)
+	app.Post("/api/v1/provision/tenants/:name/stop", h.changeState(h.service.StopTenant))
+	app.Post("/api/v1/provision/tenants/:name/start", h.changeState(h.service.StartTenant))
+	app.Post("/api/v1/provision/tenants/:name/restart", h.changeState(h.service.RestartTenant))
+	app.Post("/api/v1/provision/tenants/:name/wake", h.changeState(h.service.WakeTenant))
+	app.Post("/api/v1/provision/tenants/:name/apps", h.attachApp)
+	app.Post("/api/v1/provision/tenants/:name/upgrade", h.upgradeTenant)
+	app.Post("/api/v1/provision/upgrades/rollouts", h.startUpgradeRollout)
+	app.Get("/api/v1/provision/plans", h.listPlans)
+	app.Get("/api/v1/provision/tls/ca.pem", h.caBundle)
+	app.Post("/api/v1/provision/migrations", h.migrateTenants)
+	app.Post("/api/v1/provision/migrations/rollouts", h.startMigrationRollout)
+	app.Get("/api/v1/provision/operations", h.listOperations)
+	app.Get("/api/v1/provision/operations/:id", h.operation)
 	app.Delete("/api/v1/provision/resources/:resource_id", h.deprovisionByPath)
 	app.Post("/api/v1/provision/deprovision", h.deprovisionByBody)
+	if h.reconciler != nil {
+		app.Get("/api/v1/provision/reconcile/report", h.reconcileReport)
+		app.Post("/api/v1/provision/reconcile", h.triggerReconcile)
+	}
 }
 
 func (h *Handler) healthz(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
+func (h *Handler) readyz(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	report := h.service.Readiness(ctx)
+	status := fiber.StatusOK
+	if !report.Ready {
+		status = fiber.StatusServiceUnavailable
+	}
+	return c.Status(status).JSON(report)
+}
+
 func (h *Handler) provisionTenant(c *fiber.Ctx) error {
 	var req provisioner.ProvisionRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -50,9 +129,37 @@ func (h *Handler) provisionTenant(c *fiber.Ctx) error {
 		ctx = context.Background()
 	}
 
-	result, err := h.service.ProvisionTenant(ctx, req)
+	idempotencyKey := strings.TrimSpace(c.Get(idempotencyKeyHeader))
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		return writeError(c, fiber.StatusBadRequest, "Idempotency-Key is too long")
+	}
+
+	var (
+		result   provisioner.ProvisionResult
+		replayed bool
+		err      error
+	)
+	if idempotencyKey != "" && h.idempotency != nil {
+		fingerprint, fpErr := idempotency.Fingerprint(req)
+		if fpErr != nil {
+			return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+		}
+		result, replayed, err = h.idempotency.Do(ctx, idempotencyKey, fingerprint, func() (provisioner.ProvisionResult, error) {
+			return h.service.ProvisionTenant(ctx, req)
+		})
+	} else {
+		result, err = h.service.ProvisionTenant(ctx, req)
+	}
 	if err != nil {
-		if errors.Is(err, provisioner.ErrInvalidTenant) {
+		if errors.Is(err, idempotency.ErrFingerprintMismatch) {
+			return writeError(c, fiber.StatusUnprocessableEntity, err.Error())
+		}
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		if errors.Is(err, provisioner.ErrInvalidTenant) || errors.Is(err, provisioner.ErrInvalidRestartPolicy) ||
+			errors.Is(err, provisioner.ErrUnknownPlan) || errors.Is(err, provisioner.ErrAppContainerNotFound) {
 			return writeError(c, fiber.StatusBadRequest, err.Error())
 		}
 		var alreadyProvisioned *provisioner.ErrAlreadyProvisioned
@@ -62,19 +169,348 @@ func (h *Handler) provisionTenant(c *fiber.Ctx) error {
 				ResourceID: alreadyProvisioned.ResourceID,
 			})
 		}
-		log.Printf(
-			"provision failed request_id=%q tenant=%q tenant_id=%q: %v",
-			c.Get("X-Request-ID"),
-			req.TenantName,
-			req.TenantID,
-			err,
+		if errors.Is(err, provisioner.ErrVolumeExists) {
+			return writeError(c, fiber.StatusConflict, err.Error())
+		}
+		var queueFull *workqueue.ErrQueueFull
+		if errors.As(err, &queueFull) {
+			return writeQueueFull(c, queueFull)
+		}
+		if errors.Is(err, provisioner.ErrShuttingDown) || errors.Is(err, provisioner.ErrNoFreePort) ||
+			errors.Is(err, provisioner.ErrCapacityExhausted) {
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		slog.ErrorContext(
+			ctx, "provision failed",
+			slog.String("tenant", req.TenantName),
+			slog.String("tenant_id", req.TenantID),
+			slog.String("error", err.Error()),
 		)
 		return writeError(c, fiber.StatusInternalServerError, "failed to provision tenant database")
 	}
 
+	if replayed {
+		c.Set(idempotentReplayedHeader, "true")
+	}
 	return c.Status(fiber.StatusCreated).JSON(result)
 }
 
+func (h *Handler) tenantStatus(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	status, err := h.service.TenantStatus(ctx, c.Params("name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, provisioner.ErrInvalidTenant):
+			return writeError(c, fiber.StatusBadRequest, err.Error())
+		case errors.Is(err, provisioner.ErrTenantNotFound):
+			return writeError(c, fiber.StatusNotFound, err.Error())
+		}
+		slog.ErrorContext(
+			ctx, "tenant status failed",
+			slog.String("tenant", c.Params("name")),
+			slog.String("error", err.Error()),
+		)
+		return writeError(c, fiber.StatusInternalServerError, "failed to inspect tenant database")
+	}
+	return c.JSON(status)
+}
+
+func (h *Handler) updateLimits(c *fiber.Ctx) error {
+	var limits provisioner.Limits
+	if err := c.BodyParser(&limits); err != nil {
+		return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+	}
+
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result, err := h.service.UpdateLimits(ctx, c.Params("name"), limits)
+	if err != nil {
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		switch {
+		case errors.Is(err, provisioner.ErrInvalidTenant):
+			return writeError(c, fiber.StatusBadRequest, err.Error())
+		case errors.Is(err, provisioner.ErrTenantNotFound):
+			return writeError(c, fiber.StatusNotFound, err.Error())
+		case errors.Is(err, provisioner.ErrShuttingDown):
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		var queueFull *workqueue.ErrQueueFull
+		if errors.As(err, &queueFull) {
+			return writeQueueFull(c, queueFull)
+		}
+		slog.ErrorContext(
+			ctx, "update limits failed",
+			slog.String("tenant", c.Params("name")),
+			slog.String("error", err.Error()),
+		)
+		return writeError(c, fiber.StatusInternalServerError, "failed to update tenant limits")
+	}
+	return c.JSON(result)
+}
+
+func (h *Handler) changePlan(c *fiber.Ctx) error {
+	var req changePlanRequest
+	if err := c.BodyParser(&req); err != nil {
+		return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+	}
+
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result, err := h.service.ChangePlan(ctx, c.Params("name"), req.Plan)
+	if err != nil {
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		switch {
+		case errors.Is(err, provisioner.ErrInvalidTenant), errors.Is(err, provisioner.ErrUnknownPlan):
+			return writeError(c, fiber.StatusBadRequest, err.Error())
+		case errors.Is(err, provisioner.ErrTenantNotFound):
+			return writeError(c, fiber.StatusNotFound, err.Error())
+		case errors.Is(err, provisioner.ErrPlanRequiresRecreate):
+			return writeError(c, fiber.StatusConflict, err.Error())
+		case errors.Is(err, provisioner.ErrShuttingDown):
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		var queueFull *workqueue.ErrQueueFull
+		if errors.As(err, &queueFull) {
+			return writeQueueFull(c, queueFull)
+		}
+		slog.ErrorContext(
+			ctx, "change plan failed",
+			slog.String("tenant", c.Params("name")),
+			slog.String("plan", req.Plan),
+			slog.String("error", err.Error()),
+		)
+		return writeError(c, fiber.StatusInternalServerError, "failed to change tenant plan")
+	}
+	return c.JSON(result)
+}
+
+func (h *Handler) changeState(fn func(context.Context, string) (provisioner.LifecycleResult, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		result, err := fn(ctx, c.Params("name"))
+		if err != nil {
+			switch {
+			case errors.Is(err, provisioner.ErrInvalidTenant):
+				return writeError(c, fiber.StatusBadRequest, err.Error())
+			case errors.Is(err, provisioner.ErrTenantNotFound):
+				return writeError(c, fiber.StatusNotFound, err.Error())
+			case errors.Is(err, provisioner.ErrTenantStopped):
+				return writeError(c, fiber.StatusConflict, err.Error())
+			case errors.Is(err, provisioner.ErrShuttingDown):
+				return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+			}
+			var queueFull *workqueue.ErrQueueFull
+			if errors.As(err, &queueFull) {
+				return writeQueueFull(c, queueFull)
+			}
+			slog.ErrorContext(
+				ctx, "tenant state change failed",
+				slog.String("tenant", c.Params("name")),
+				slog.String("error", err.Error()),
+			)
+			return writeError(c, fiber.StatusInternalServerError, "failed to change tenant state")
+		}
+		return c.JSON(result)
+	}
+}
+
+func (h *Handler) attachApp(c *fiber.Ctx) error {
+	var req attachAppRequest
+	if err := c.BodyParser(&req); err != nil {
+		return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+	}
+
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result, err := h.service.AttachApp(ctx, c.Params("name"), req.Container)
+	if err != nil {
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		switch {
+		case errors.Is(err, provisioner.ErrInvalidTenant), errors.Is(err, provisioner.ErrAppContainerNotFound):
+			return writeError(c, fiber.StatusBadRequest, err.Error())
+		case errors.Is(err, provisioner.ErrTenantNotFound):
+			return writeError(c, fiber.StatusNotFound, err.Error())
+		case errors.Is(err, provisioner.ErrSharedNetwork):
+			return writeError(c, fiber.StatusConflict, err.Error())
+		case errors.Is(err, provisioner.ErrShuttingDown):
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		var queueFull *workqueue.ErrQueueFull
+		if errors.As(err, &queueFull) {
+			return writeQueueFull(c, queueFull)
+		}
+		slog.ErrorContext(
+			ctx, "attach application failed",
+			slog.String("tenant", c.Params("name")),
+			slog.String("container", req.Container),
+			slog.String("error", err.Error()),
+		)
+		return writeError(c, fiber.StatusInternalServerError, "failed to attach application container")
+	}
+	return c.JSON(result)
+}
+
+func (h *Handler) migrateTenants(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result, err := h.service.MigrateTenants(ctx)
+	if err != nil {
+		if errors.Is(err, provisioner.ErrShuttingDown) {
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		slog.ErrorContext(ctx, "tenant migrations failed", slog.String("error", err.Error()))
+		return writeError(c, fiber.StatusInternalServerError, "failed to migrate tenants")
+	}
+	return c.JSON(result)
+}
+
+func (h *Handler) upgradeTenant(c *fiber.Ctx) error {
+	var req upgradeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+	}
+
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result, err := h.service.UpgradeTenant(ctx, c.Params("name"), req.Image)
+	if err != nil {
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		switch {
+		case errors.Is(err, provisioner.ErrInvalidTenant):
+			return writeError(c, fiber.StatusBadRequest, err.Error())
+		case errors.Is(err, provisioner.ErrTenantNotFound):
+			return writeError(c, fiber.StatusNotFound, err.Error())
+		case errors.Is(err, provisioner.ErrTenantStopped), errors.Is(err, provisioner.ErrUpgradeUnsupported), errors.Is(err, provisioner.ErrUpgradeNotNewer):
+			return writeError(c, fiber.StatusConflict, err.Error())
+		case errors.Is(err, provisioner.ErrShuttingDown):
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		var queueFull *workqueue.ErrQueueFull
+		if errors.As(err, &queueFull) {
+			return writeQueueFull(c, queueFull)
+		}
+		slog.ErrorContext(
+			ctx, "tenant upgrade failed",
+			slog.String("tenant", c.Params("name")),
+			slog.String("image", req.Image),
+			slog.String("error", err.Error()),
+		)
+		if errors.Is(err, provisioner.ErrUpgradeRolledBack) {
+			return writeError(c, fiber.StatusInternalServerError, provisioner.ErrUpgradeRolledBack.Error())
+		}
+		return writeError(c, fiber.StatusInternalServerError, "failed to upgrade tenant")
+	}
+	return c.JSON(result)
+}
+
+func (h *Handler) startUpgradeRollout(c *fiber.Ctx) error {
+	var req provisioner.UpgradeRolloutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+	}
+
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	op, err := h.service.StartUpgradeRollout(ctx, req)
+	if err != nil {
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		slog.ErrorContext(ctx, "start upgrade rollout failed", slog.String("error", err.Error()))
+		return writeError(c, fiber.StatusInternalServerError, "failed to start upgrade rollout")
+	}
+	c.Location("/api/v1/provision/operations/" + op.ID)
+	return c.Status(fiber.StatusAccepted).JSON(op)
+}
+
+func (h *Handler) startMigrationRollout(c *fiber.Ctx) error {
+	var req provisioner.MigrationRolloutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return writeError(c, fiber.StatusBadRequest, "invalid JSON body")
+	}
+
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	op, err := h.service.StartMigrationRollout(ctx, req)
+	if err != nil {
+		var validation *provisioner.ValidationError
+		if errors.As(err, &validation) {
+			return writeValidationError(c, validation)
+		}
+		slog.ErrorContext(ctx, "start migration rollout failed", slog.String("error", err.Error()))
+		return writeError(c, fiber.StatusInternalServerError, "failed to start migration rollout")
+	}
+	c.Location("/api/v1/provision/operations/" + op.ID)
+	return c.Status(fiber.StatusAccepted).JSON(op)
+}
+
+func (h *Handler) listOperations(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"operations": h.service.Operations()})
+}
+
+func (h *Handler) operation(c *fiber.Ctx) error {
+	op, ok := h.service.Operation(c.Params("id"))
+	if !ok {
+		return writeError(c, fiber.StatusNotFound, "operation not found")
+	}
+	return c.JSON(op)
+}
+
+func (h *Handler) caBundle(c *fiber.Ctx) error {
+	bundle, ok := h.service.CABundle()
+	if !ok {
+		return writeError(c, fiber.StatusNotFound, "tenant tls is not enabled")
+	}
+	c.Set(fiber.HeaderContentType, "application/x-pem-file")
+	return c.Send(bundle)
+}
+
+func (h *Handler) listPlans(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"plans": h.service.Plans()})
+}
+
 func (h *Handler) deprovisionByPath(c *fiber.Ctx) error {
 	resourceID := strings.TrimSpace(c.Params("resource_id"))
 	return h.deprovision(c, resourceID)
@@ -98,11 +534,17 @@ func (h *Handler) deprovision(c *fiber.Ctx, resourceID string) error {
 		if errors.Is(err, provisioner.ErrInvalidResource) {
 			return writeError(c, fiber.StatusBadRequest, err.Error())
 		}
-		log.Printf(
-			"deprovision failed request_id=%q resource=%q: %v",
-			c.Get("X-Request-ID"),
-			resourceID,
-			err,
+		var queueFull *workqueue.ErrQueueFull
+		if errors.As(err, &queueFull) {
+			return writeQueueFull(c, queueFull)
+		}
+		if errors.Is(err, provisioner.ErrShuttingDown) {
+			return writeError(c, fiber.StatusServiceUnavailable, err.Error())
+		}
+		slog.ErrorContext(
+			ctx, "deprovision failed",
+			slog.String("resource_id", resourceID),
+			slog.String("error", err.Error()),
 		)
 		return writeError(c, fiber.StatusInternalServerError, "failed to deprovision resource")
 	}
@@ -113,6 +555,43 @@ func (h *Handler) deprovision(c *fiber.Ctx, resourceID string) error {
 	})
 }
 
+func (h *Handler) reconcileReport(c *fiber.Ctx) error {
+	result, ok := h.reconciler.Last()
+	if !ok {
+		return writeError(c, fiber.StatusNotFound, "reconcile has not run yet")
+	}
+	return c.JSON(result)
+}
+
+func (h *Handler) triggerReconcile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result := h.reconciler.Trigger(ctx)
+	if result.Error != "" {
+		return c.Status(fiber.StatusInternalServerError).JSON(result)
+	}
+	return c.JSON(result)
+}
+
 func writeError(c *fiber.Ctx, status int, message string) error {
 	return c.Status(status).JSON(errorResponse{Error: message})
 }
+
+func writeValidationError(c *fiber.Ctx, err *provisioner.ValidationError) error {
+	return c.Status(fiber.StatusBadRequest).JSON(errorResponse{
+		Error:  provisioner.ErrInvalidRequest.Error(),
+		Fields: err.Fields,
+	})
+}
+
+func writeQueueFull(c *fiber.Ctx, err *workqueue.ErrQueueFull) error {
+	seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return writeError(c, fiber.StatusServiceUnavailable, "too many docker operations in progress, retry later")
+}
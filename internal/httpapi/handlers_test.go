@@ -9,11 +9,16 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 
+	"go-service/internal/certs"
 	"go-service/internal/config"
+	"go-service/internal/idempotency"
 	"go-service/internal/provisioner"
+	"go-service/internal/reconciler"
+	"go-service/internal/workqueue"
 )
 
 type testRunner struct {
@@ -24,6 +29,10 @@ func (r *testRunner) Run(_ context.Context, args ...string) (string, error) {
 	return r.handler(args...)
 }
 
+func (r *testRunner) RunInput(ctx context.Context, input string, args ...string) (string, error) {
+	return r.Run(ctx, append(args, input)...)
+}
+
 func newTestApp(t *testing.T, runner provisioner.DockerRunner) *fiber.App {
 	t.Helper()
 	svc := provisioner.NewService(runner, config.Config{
@@ -33,16 +42,24 @@ func newTestApp(t *testing.T, runner provisioner.DockerRunner) *fiber.App {
 		TenantDBUser:       "tenant_user",
 		TenantDBNamePrefix: "tenant_",
 	})
-	h := NewHandler(svc)
+	h := NewHandler(svc, WithIdempotencyStore(idempotency.NewStore(time.Hour)))
 	app := fiber.New()
 	h.Register(app)
 	return app
 }
 
 func performRequest(t *testing.T, app *fiber.App, method, path, body string) *http.Response {
+	t.Helper()
+	return performRequestWithHeaders(t, app, method, path, body, nil)
+}
+
+func performRequestWithHeaders(t *testing.T, app *fiber.App, method, path, body string, headers map[string]string) *http.Response {
 	t.Helper()
 	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	resp, err := app.Test(req, -1)
 	if err != nil {
 		t.Fatalf("request failed: %v", err)
@@ -60,6 +77,31 @@ func readBody(t *testing.T, resp *http.Response) string {
 	return string(b)
 }
 
+func TestReadyz(t *testing.T) {
+	daemonUp := true
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "version" && !daemonUp {
+			return "", fmt.Errorf("Cannot connect to the Docker daemon")
+		}
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodGet, "/readyz", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	body := readBody(t, resp)
+	if !strings.Contains(body, `"ready":true`) || !strings.Contains(body, `"name":"docker_daemon"`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	daemonUp = false
+	resp = performRequest(t, app, http.MethodGet, "/readyz", "")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
 func TestProvisionTenantInvalidBody(t *testing.T) {
 	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
 		return "", nil
@@ -115,6 +157,102 @@ func TestProvisionTenantCreated(t *testing.T) {
 	}
 }
 
+func TestProvisionTenantIdempotencyKey(t *testing.T) {
+	runs := 0
+	runner := &testRunner{handler: func(args ...string) (string, error) {
+		switch {
+		case len(args) > 0 && args[0] == "inspect":
+			if runs > 0 {
+				return "container-abc\n", nil
+			}
+			return "", fmt.Errorf("No such object")
+		case len(args) > 0 && args[0] == "run":
+			runs++
+			return "container-abc\n", nil
+		case len(args) > 0 && args[0] == "port":
+			return "0.0.0.0:50001", nil
+		default:
+			return "", nil
+		}
+	}}
+	app := newTestApp(t, runner)
+	headers := map[string]string{"Idempotency-Key": "retry-1"}
+
+	first := performRequestWithHeaders(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme"}`, headers)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", first.StatusCode, http.StatusCreated)
+	}
+	firstBody := readBody(t, first)
+
+	retry := performRequestWithHeaders(t, app, http.MethodPost, "/api/v1/provision/tenants", `{ "tenant_name": "acme" }`, headers)
+	if retry.StatusCode != http.StatusCreated {
+		t.Fatalf("retry status = %d, want %d", retry.StatusCode, http.StatusCreated)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("expected Idempotent-Replayed header on retry")
+	}
+	if body := readBody(t, retry); body != firstBody {
+		t.Fatalf("retry body = %s, want %s", body, firstBody)
+	}
+	if runs != 1 {
+		t.Fatalf("docker run calls = %d, want 1", runs)
+	}
+
+	mismatch := performRequestWithHeaders(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"other"}`, headers)
+	if mismatch.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("mismatch status = %d, want %d", mismatch.StatusCode, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestProvisionTenantQueueFull(t *testing.T) {
+	queue := workqueue.New(1, 0, 3*time.Second)
+	release, err := queue.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	svc := provisioner.NewService(&testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}}, config.Config{TenantDBNamePrefix: "tenant_"}, provisioner.WithQueue(queue))
+	app := fiber.New()
+	NewHandler(svc).Register(app)
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme"}`)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "3" {
+		t.Fatalf("Retry-After = %q, want 3", got)
+	}
+}
+
+func TestReconcileEndpoints(t *testing.T) {
+	svc := provisioner.NewService(&testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}}, config.Config{})
+	app := fiber.New()
+	NewHandler(svc, WithReconciler(reconciler.New(svc, 0, provisioner.ReconcileReport))).Register(app)
+
+	resp := performRequest(t, app, http.MethodGet, "/api/v1/provision/reconcile/report", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d before first run", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/reconcile", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("trigger status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp = performRequest(t, app, http.MethodGet, "/api/v1/provision/reconcile/report", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d after trigger", resp.StatusCode, http.StatusOK)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `"policy":"report"`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
 func TestDeprovisionInvalidBody(t *testing.T) {
 	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
 		return "", nil
@@ -137,3 +275,273 @@ func TestDeprovisionOK(t *testing.T) {
 		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
 	}
 }
+
+func TestTenantStatus(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "inspect" && args[len(args)-1] == "tenant-db-acme" {
+			return `[{"Id":"container-123","Name":"/tenant-db-acme","RestartCount":0,"State":{"Status":"running"},"HostConfig":{"RestartPolicy":{"Name":"unless-stopped"}}}]`, nil
+		}
+		return "", fmt.Errorf("Error: No such container")
+	}})
+
+	resp := performRequest(t, app, http.MethodGet, "/api/v1/provision/tenants/acme", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	body := readBody(t, resp)
+	if !strings.Contains(body, `"restart_policy":"unless-stopped"`) || !strings.Contains(body, `"crash_looping":false`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	resp = performRequest(t, app, http.MethodGet, "/api/v1/provision/tenants/ghost", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestUpdateLimits(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "inspect" && args[len(args)-1] == "tenant-db-acme" {
+			return "container-123\n", nil
+		}
+		if args[0] == "inspect" {
+			return "", fmt.Errorf("No such object")
+		}
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPatch, "/api/v1/provision/tenants/acme/limits", `{"memory_mb":512,"blkio_weight":500}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `"memory_mb":512`) || !strings.Contains(body, `"blkio_weight":500`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	resp = performRequest(t, app, http.MethodPatch, "/api/v1/provision/tenants/acme/limits", `{"blkio_weight":5}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp = performRequest(t, app, http.MethodPatch, "/api/v1/provision/tenants/ghost/limits", `{"memory_mb":512}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+func TestProvisionTenantInvalidRestartPolicy(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme","restart_policy":"sometimes"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestProvisionTenantInvalidLimits(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme","limits":{"memory_mb":-1}}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `"fields":[{"field":"memory_mb","message":"must be positive"}]`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestProvisionTenantInvalidSettings(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme","settings":{"work_mem":"lots"}}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	body := readBody(t, resp)
+	if !strings.Contains(body, `"error":"invalid request"`) || !strings.Contains(body, `"field":"settings.work_mem"`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestPlansWithoutCatalog(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodGet, "/api/v1/provision/plans", "")
+	if body := readBody(t, resp); body != `{"plans":[]}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	resp = performRequest(t, app, http.MethodPut, "/api/v1/provision/tenants/acme/plan", `{"plan":"pro"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme","plan":"pro"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestStopTenant(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "inspect" && args[len(args)-1] == "tenant-db-acme" {
+			return "container-123\n", nil
+		}
+		if args[0] == "inspect" {
+			return "", fmt.Errorf("No such object")
+		}
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/acme/stop", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `"status":"stopped"`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/ghost/start", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestWakeTenantStoppedByOperator(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "inspect" && args[len(args)-1] == "tenant-db-acme" {
+			return "container-123\n", nil
+		}
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/acme/stop", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/acme/wake", "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/ghost/wake", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+	resp := performRequest(t, app, http.MethodGet, "/api/v1/provision/tls/ca.pem", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d without tenant tls", resp.StatusCode, http.StatusNotFound)
+	}
+
+	ca, err := certs.LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := provisioner.NewService(&testRunner{}, config.Config{}, provisioner.WithCertificates(ca))
+	app = fiber.New()
+	NewHandler(svc).Register(app)
+	resp = performRequest(t, app, http.MethodGet, "/api/v1/provision/tls/ca.pem", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if body := readBody(t, resp); body != string(ca.BundlePEM()) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestAttachApp(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", fmt.Errorf("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants", `{"tenant_name":"acme"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/acme/apps", `{"container":"acme-api"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status = %d, want %d on the shared network", resp.StatusCode, http.StatusConflict)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/acme/apps", `{}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/ghost/apps", `{"container":"ghost-api"}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestMigrateTenants(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/migrations", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if body := readBody(t, resp); body != `{"tenants":[],"failed":0}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestMigrationRolloutAndOperations(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/migrations/rollouts", `{"bundle":"iam"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d for an unknown bundle", resp.StatusCode, http.StatusBadRequest)
+	}
+	resp = performRequest(t, app, http.MethodGet, "/api/v1/provision/operations", "")
+	if body := readBody(t, resp); body != `{"operations":[]}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	resp = performRequest(t, app, http.MethodGet, "/api/v1/provision/operations/missing", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestUpgradeEndpoints(t *testing.T) {
+	app := newTestApp(t, &testRunner{handler: func(args ...string) (string, error) {
+		return "", nil
+	}})
+
+	resp := performRequest(t, app, http.MethodPost, "/api/v1/provision/tenants/ghost/upgrade", `{"image":"postgres:16.4-alpine"}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/upgrades/rollouts", `{"image":"postgres:latest"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	resp = performRequest(t, app, http.MethodPost, "/api/v1/provision/upgrades/rollouts", `{"image":"postgres:16.4-alpine","parallelism":2}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `"kind":"upgrade"`) || !strings.Contains(body, `"parallelism":2`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
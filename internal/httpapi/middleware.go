@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/logging"
+	"go-service/internal/tracing"
+)
+
+// Tracing starts a server span per request, continuing any incoming W3C
+// traceparent, and stores it in the user context for the service layer.
+func Tracing() fiber.Handler {
+	tracer := tracing.Tracer("go-service/internal/httpapi")
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		carrier := propagation.MapCarrier{}
+		c.Request().Header.VisitAll(func(k, v []byte) {
+			carrier.Set(http.CanonicalHeaderKey(string(k)), string(v))
+		})
+		ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+		ctx, span := tracer.Start(
+			ctx, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Method()),
+				attribute.String("url.path", c.Path()),
+			),
+		)
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		route := c.Route().Path
+		span.SetName(c.Method() + " " + route)
+		span.SetAttributes(
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", status),
+		)
+		if err != nil {
+			span.RecordError(err)
+		}
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+		return err
+	}
+}
+
+// RequestContext seeds the request's user context with the request id so
+// every log record down to the docker runtime can be correlated, and writes
+// one access log record per request.
+func RequestContext() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		requestID := c.GetRespHeader(fiber.HeaderXRequestID)
+		if requestID == "" {
+			requestID = c.Get(fiber.HeaderXRequestID)
+		}
+
+		ctx := c.UserContext()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx = logging.With(ctx, slog.String("request_id", requestID))
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			ctx = logging.With(ctx, slog.String("trace_id", sc.TraceID().String()))
+		}
+		c.SetUserContext(ctx)
+
+		start := time.Now()
+		err := c.Next()
+		slog.InfoContext(
+			ctx, "http request",
+			slog.String("method", c.Method()),
+			slog.String("route", c.Route().Path),
+			slog.Int("status", c.Response().StatusCode()),
+			slog.Duration("duration", time.Since(start)),
+		)
+		return err
+	}
+}
@@ -0,0 +1,117 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go-service/internal/provisioner"
+)
+
+var ErrFingerprintMismatch = errors.New("idempotency key was already used with a different request")
+
+type Store struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	fingerprint string
+	done        chan struct{}
+	completed   bool
+	result      provisioner.ProvisionResult
+	expiresAt   time.Time
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Do runs fn at most once per key while its record is alive. A retry with the
+// same fingerprint gets the stored result (replayed=true); concurrent retries
+// wait for the first attempt instead of racing it. Failed attempts are not
+// recorded so the caller can retry them.
+func (s *Store) Do(
+	ctx context.Context,
+	key string,
+	fingerprint string,
+	fn func() (provisioner.ProvisionResult, error),
+) (result provisioner.ProvisionResult, replayed bool, err error) {
+	for {
+		s.mu.Lock()
+		s.purgeExpiredLocked()
+		e, ok := s.entries[key]
+		if !ok {
+			e = &entry{fingerprint: fingerprint, done: make(chan struct{})}
+			s.entries[key] = e
+			s.mu.Unlock()
+			return s.run(key, e, fn)
+		}
+		if e.fingerprint != fingerprint {
+			s.mu.Unlock()
+			return provisioner.ProvisionResult{}, false, ErrFingerprintMismatch
+		}
+		if e.completed {
+			res := e.result
+			s.mu.Unlock()
+			return res, true, nil
+		}
+		done := e.done
+		s.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return provisioner.ProvisionResult{}, false, ctx.Err()
+		}
+	}
+}
+
+func (s *Store) run(
+	key string,
+	e *entry,
+	fn func() (provisioner.ProvisionResult, error),
+) (provisioner.ProvisionResult, bool, error) {
+	result, err := fn()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(e.done)
+
+	if err != nil {
+		delete(s.entries, key)
+		return provisioner.ProvisionResult{}, false, err
+	}
+	e.completed = true
+	e.result = result
+	e.expiresAt = s.now().Add(s.ttl)
+	return result, false, nil
+}
+
+func (s *Store) purgeExpiredLocked() {
+	now := s.now()
+	for key, e := range s.entries {
+		if e.completed && !now.Before(e.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func Fingerprint(v any) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,130 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go-service/internal/provisioner"
+)
+
+func TestDoReplaysCompletedResult(t *testing.T) {
+	store := NewStore(time.Hour)
+	calls := 0
+	fn := func() (provisioner.ProvisionResult, error) {
+		calls++
+		return provisioner.ProvisionResult{ResourceID: "container-1"}, nil
+	}
+
+	first, replayed, err := store.Do(context.Background(), "key-1", "fp", fn)
+	if err != nil || replayed {
+		t.Fatalf("first call: replayed=%v err=%v", replayed, err)
+	}
+	second, replayed, err := store.Do(context.Background(), "key-1", "fp", fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !replayed {
+		t.Fatal("expected replayed result")
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+	if first.ResourceID != second.ResourceID {
+		t.Fatalf("resource id = %q, want %q", second.ResourceID, first.ResourceID)
+	}
+}
+
+func TestDoRejectsFingerprintMismatch(t *testing.T) {
+	store := NewStore(time.Hour)
+	fn := func() (provisioner.ProvisionResult, error) {
+		return provisioner.ProvisionResult{}, nil
+	}
+
+	if _, _, err := store.Do(context.Background(), "key-1", "fp-a", fn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _, err := store.Do(context.Background(), "key-1", "fp-b", fn)
+	if !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("err = %v, want ErrFingerprintMismatch", err)
+	}
+}
+
+func TestDoForgetsFailedAttempts(t *testing.T) {
+	store := NewStore(time.Hour)
+	calls := 0
+	fn := func() (provisioner.ProvisionResult, error) {
+		calls++
+		if calls == 1 {
+			return provisioner.ProvisionResult{}, errors.New("boom")
+		}
+		return provisioner.ProvisionResult{ResourceID: "container-1"}, nil
+	}
+
+	if _, _, err := store.Do(context.Background(), "key-1", "fp", fn); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	result, replayed, err := store.Do(context.Background(), "key-1", "fp", fn)
+	if err != nil || replayed {
+		t.Fatalf("retry: replayed=%v err=%v", replayed, err)
+	}
+	if result.ResourceID != "container-1" {
+		t.Fatalf("resource id = %q, want container-1", result.ResourceID)
+	}
+}
+
+func TestDoExpiresRecords(t *testing.T) {
+	store := NewStore(time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	calls := 0
+	fn := func() (provisioner.ProvisionResult, error) {
+		calls++
+		return provisioner.ProvisionResult{}, nil
+	}
+
+	_, _, _ = store.Do(context.Background(), "key-1", "fp", fn)
+	now = now.Add(2 * time.Minute)
+	_, replayed, _ := store.Do(context.Background(), "key-1", "fp", fn)
+	if replayed || calls != 2 {
+		t.Fatalf("replayed=%v calls=%d, want fresh execution after ttl", replayed, calls)
+	}
+}
+
+func TestDoConcurrentRetriesWaitForFirstAttempt(t *testing.T) {
+	store := NewStore(time.Hour)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	fn := func() (provisioner.ProvisionResult, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return provisioner.ProvisionResult{ResourceID: "container-1"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]provisioner.ProvisionResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = store.Do(context.Background(), "key-1", "fp", fn)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+	for i, r := range results {
+		if r.ResourceID != "container-1" {
+			t.Fatalf("results[%d].ResourceID = %q, want container-1", i, r.ResourceID)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package idlemonitor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go-service/internal/config"
+	"go-service/internal/provisioner"
+	"go-service/internal/registry"
+)
+
+type stubRunner struct {
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (r *stubRunner) Run(_ context.Context, args ...string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch args[0] {
+	case "exec":
+		return "0\n", nil
+	case "stats":
+		return "0.00%\n", nil
+	case "inspect":
+		return "abc123\n", nil
+	case "stop":
+		r.stopped = true
+	}
+	return "", nil
+}
+
+func (r *stubRunner) RunInput(ctx context.Context, _ string, args ...string) (string, error) {
+	return r.Run(ctx, args...)
+}
+
+func TestStartSuspendsIdleTenantsUntilCancelled(t *testing.T) {
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", DesiredState: registry.StateRunning}); err != nil {
+		t.Fatal(err)
+	}
+	runner := &stubRunner{}
+	svc := provisioner.NewService(runner, config.Config{IdleSuspendAfter: time.Nanosecond}, provisioner.WithRegistry(store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		New(svc, 5*time.Millisecond).Start(ctx)
+		close(done)
+	}()
+
+	deadline := time.After(time.Second)
+	for {
+		record, _, err := store.Get("acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Suspended {
+			if record.DesiredState != registry.StateStopped {
+				t.Fatalf("desired state = %q, want stopped", record.DesiredState)
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("tenant was never suspended")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLoggerIncludesContextAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx := With(context.Background(), slog.String("request_id", "req-1"))
+	ctx = With(ctx, slog.String("tenant", "acme"))
+	logger.InfoContext(ctx, "provisioned", "port", 5432)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid json log line %q: %v", buf.String(), err)
+	}
+	if record["request_id"] != "req-1" || record["tenant"] != "acme" {
+		t.Fatalf("context attrs missing from record: %v", record)
+	}
+	if record["msg"] != "provisioned" {
+		t.Fatalf("msg = %v, want provisioned", record["msg"])
+	}
+}
+
+func TestNewRejectsInvalidSettings(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := New(&buf, "xml", "info"); err == nil {
+		t.Fatal("expected error for invalid format")
+	}
+	if _, err := New(&buf, "json", "verbose"); err == nil {
+		t.Fatal("expected error for invalid level")
+	}
+}
+
+func TestLevelFiltersRecords(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "text", "warn")
+	logger.Info("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("info record written at warn level: %q", buf.String())
+	}
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var containerStates = []string{"created", "running", "paused", "restarting", "removing", "exited", "dead"}
+
+var (
+	managedContainersDesc = prometheus.NewDesc(
+		namespace+"_managed_containers",
+		"Managed tenant containers by docker state.",
+		[]string{"state"},
+		nil,
+	)
+	containerScrapeErrorDesc = prometheus.NewDesc(
+		namespace+"_managed_containers_scrape_error",
+		"1 if listing managed containers failed during the last scrape.",
+		nil,
+		nil,
+	)
+)
+
+type containerStateCollector struct {
+	fn      func(ctx context.Context) (map[string]int, error)
+	timeout time.Duration
+}
+
+func (c *containerStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- managedContainersDesc
+	ch <- containerScrapeErrorDesc
+}
+
+func (c *containerStateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	counts, err := c.fn(ctx)
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(containerScrapeErrorDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(containerScrapeErrorDesc, prometheus.GaugeValue, 0)
+
+	seen := make(map[string]bool, len(containerStates))
+	for _, state := range containerStates {
+		seen[state] = true
+		ch <- prometheus.MustNewConstMetric(managedContainersDesc, prometheus.GaugeValue, float64(counts[state]), state)
+	}
+	for state, n := range counts {
+		if !seen[state] {
+			ch <- prometheus.MustNewConstMetric(managedContainersDesc, prometheus.GaugeValue, float64(n), state)
+		}
+	}
+}
+
+var (
+	tenantRestartsDesc = prometheus.NewDesc(
+		namespace+"_tenant_restarts",
+		"Times docker restarted the tenant container under its restart policy.",
+		[]string{"tenant"},
+		nil,
+	)
+	tenantCrashLoopingDesc = prometheus.NewDesc(
+		namespace+"_tenant_crash_looping",
+		"1 if the tenant container is restarting repeatedly.",
+		[]string{"tenant"},
+		nil,
+	)
+)
+
+type TenantRestarts struct {
+	Tenant       string
+	RestartCount int
+	CrashLooping bool
+}
+
+type tenantRestartCollector struct {
+	fn      func(ctx context.Context) ([]TenantRestarts, error)
+	timeout time.Duration
+}
+
+func (c *tenantRestartCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantRestartsDesc
+	ch <- tenantCrashLoopingDesc
+}
+
+func (c *tenantRestartCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	tenants, err := c.fn(ctx)
+	if err != nil {
+		return
+	}
+	for _, t := range tenants {
+		crashLooping := 0.0
+		if t.CrashLooping {
+			crashLooping = 1
+		}
+		ch <- prometheus.MustNewConstMetric(tenantRestartsDesc, prometheus.GaugeValue, float64(t.RestartCount), t.Tenant)
+		ch <- prometheus.MustNewConstMetric(tenantCrashLoopingDesc, prometheus.GaugeValue, crashLooping, t.Tenant)
+	}
+}
+
+var (
+	tenantStorageDesc = prometheus.NewDesc(
+		namespace+"_tenant_storage_bytes",
+		"Database size reported by pg_database_size at the last storage check.",
+		[]string{"tenant"},
+		nil,
+	)
+	tenantStorageQuotaDesc = prometheus.NewDesc(
+		namespace+"_tenant_storage_quota_bytes",
+		"Storage quota of the tenant.",
+		[]string{"tenant"},
+		nil,
+	)
+)
+
+type TenantStorage struct {
+	Tenant     string
+	UsedBytes  int64
+	QuotaBytes int64
+}
+
+type tenantStorageCollector struct {
+	fn func() []TenantStorage
+}
+
+func (c *tenantStorageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantStorageDesc
+	ch <- tenantStorageQuotaDesc
+}
+
+func (c *tenantStorageCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.fn() {
+		ch <- prometheus.MustNewConstMetric(tenantStorageDesc, prometheus.GaugeValue, float64(t.UsedBytes), t.Tenant)
+		if t.QuotaBytes > 0 {
+			ch <- prometheus.MustNewConstMetric(tenantStorageQuotaDesc, prometheus.GaugeValue, float64(t.QuotaBytes), t.Tenant)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go-service/internal/docker"
+)
+
+type instrumentedRunner struct {
+	next    Runner
+	metrics *Metrics
+}
+
+func (m *Metrics) InstrumentRunner(next Runner) Runner {
+	return &instrumentedRunner{next: next, metrics: m}
+}
+
+func (r *instrumentedRunner) Run(ctx context.Context, args ...string) (string, error) {
+	start := time.Now()
+	out, err := r.next.Run(ctx, args...)
+	r.observe(args, start, err)
+	return out, err
+}
+
+func (r *instrumentedRunner) RunInput(ctx context.Context, input string, args ...string) (string, error) {
+	start := time.Now()
+	out, err := r.next.RunInput(ctx, input, args...)
+	r.observe(args, start, err)
+	return out, err
+}
+
+func (r *instrumentedRunner) observe(args []string, start time.Time, err error) {
+	subcommand := docker.Subcommand(args)
+	r.metrics.dockerDuration.WithLabelValues(subcommand).Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.metrics.dockerFailures.WithLabelValues(subcommand).Inc()
+	}
+}
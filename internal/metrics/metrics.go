@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "provisioner"
+
+type Runner interface {
+	Run(ctx context.Context, args ...string) (string, error)
+	RunInput(ctx context.Context, input string, args ...string) (string, error)
+}
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests      *prometheus.CounterVec
+	httpDuration      *prometheus.HistogramVec
+	operations        *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+	dockerDuration    *prometheus.HistogramVec
+	dockerFailures    *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Tenant lifecycle operations by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Tenant lifecycle operation latency by operation and outcome.",
+			Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+		}, []string{"operation", "outcome"}),
+		dockerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "docker_command_duration_seconds",
+			Help:      "Docker CLI command latency by subcommand.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"subcommand"}),
+		dockerFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "docker_command_failures_total",
+			Help:      "Docker CLI commands that returned an error, by subcommand.",
+		}, []string{"subcommand"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.operations,
+		m.operationDuration,
+		m.dockerDuration,
+		m.dockerFailures,
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if fe, ok := err.(*fiber.Error); ok {
+				status = fe.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+		route := c.Route().Path
+		method := c.Method()
+		m.httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+		m.httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (m *Metrics) ObserveOperation(operation, outcome string, duration time.Duration) {
+	m.operations.WithLabelValues(operation, outcome).Inc()
+	m.operationDuration.WithLabelValues(operation, outcome).Observe(duration.Seconds())
+}
+
+func (m *Metrics) RegisterQueue(depth, inFlight func() int) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "docker_queue_depth",
+			Help:      "Docker operations waiting for a free slot.",
+		}, func() float64 { return float64(depth()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "docker_operations_in_flight",
+			Help:      "Docker operations currently holding a slot.",
+		}, func() float64 { return float64(inFlight()) }),
+	)
+}
+
+// RegisterContainerStates reports managed containers by docker state. The
+// counts are collected on scrape through fn, bounded by timeout.
+func (m *Metrics) RegisterContainerStates(fn func(ctx context.Context) (map[string]int, error), timeout time.Duration) {
+	m.registry.MustRegister(&containerStateCollector{fn: fn, timeout: timeout})
+}
+
+// RegisterTenantRestarts reports per-tenant restart counts and crash-loop
+// state, collected on scrape through fn.
+func (m *Metrics) RegisterTenantRestarts(fn func(ctx context.Context) ([]TenantRestarts, error), timeout time.Duration) {
+	m.registry.MustRegister(&tenantRestartCollector{fn: fn, timeout: timeout})
+}
+
+// RegisterTenantStorage reports per-tenant database size from the last
+// storage check. fn must not block; it is called on every scrape.
+func (m *Metrics) RegisterTenantStorage(fn func() []TenantStorage) {
+	m.registry.MustRegister(&tenantStorageCollector{fn: fn})
+}
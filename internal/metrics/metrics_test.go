@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type stubRunner struct {
+	err error
+}
+
+func (r *stubRunner) Run(_ context.Context, _ ...string) (string, error) {
+	return "", r.err
+}
+
+func (r *stubRunner) RunInput(_ context.Context, _ string, _ ...string) (string, error) {
+	return "", r.err
+}
+
+func TestInstrumentRunnerCountsFailures(t *testing.T) {
+	m := New()
+	ok := m.InstrumentRunner(&stubRunner{})
+	failing := m.InstrumentRunner(&stubRunner{err: errors.New("boom")})
+
+	_, _ = ok.Run(context.Background(), "pull", "postgres")
+	_, _ = failing.Run(context.Background(), "pull", "postgres")
+
+	if got := testutil.ToFloat64(m.dockerFailures.WithLabelValues("pull")); got != 1 {
+		t.Fatalf("pull failures = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.dockerDuration); got != 1 {
+		t.Fatalf("duration series = %d, want 1", got)
+	}
+}
+
+func TestMiddlewareLabelsByRoute(t *testing.T) {
+	m := New()
+	app := fiber.New()
+	app.Use(m.Middleware())
+	app.Get("/tenants/:name", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	for _, name := range []string{"acme", "globex"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/tenants/"+name, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("/tenants/:name", "GET", "204")); got != 2 {
+		t.Fatalf("requests = %v, want 2", got)
+	}
+}
+
+func TestHandlerExposesContainerStatesAndOperations(t *testing.T) {
+	m := New()
+	m.ObserveOperation("provision", "success", 2*time.Second)
+	m.RegisterContainerStates(func(context.Context) (map[string]int, error) {
+		return map[string]int{"running": 3, "exited": 1}, nil
+	}, time.Second)
+	m.RegisterTenantRestarts(func(context.Context) ([]TenantRestarts, error) {
+		return []TenantRestarts{{Tenant: "acme", RestartCount: 7, CrashLooping: true}}, nil
+	}, time.Second)
+	m.RegisterTenantStorage(func() []TenantStorage {
+		return []TenantStorage{{Tenant: "acme", UsedBytes: 2048, QuotaBytes: 4096}}
+	})
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		`provisioner_managed_containers{state="running"} 3`,
+		`provisioner_managed_containers{state="exited"} 1`,
+		`provisioner_managed_containers{state="paused"} 0`,
+		`provisioner_operations_total{operation="provision",outcome="success"} 1`,
+		`provisioner_tenant_restarts{tenant="acme"} 7`,
+		`provisioner_tenant_crash_looping{tenant="acme"} 1`,
+		`provisioner_tenant_storage_bytes{tenant="acme"} 2048`,
+		`provisioner_tenant_storage_quota_bytes{tenant="acme"} 4096`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics output missing %q", want)
+		}
+	}
+}
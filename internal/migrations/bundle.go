@@ -0,0 +1,98 @@
+package migrations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Migration is one SQL file of a bundle. Version is the file name up to the
+// first underscore, so 001_init.sql has version 001.
+type Migration struct {
+	Version string
+	File    string
+	SQL     string
+}
+
+// Bundle is a named, ordered set of migrations.
+type Bundle struct {
+	Name       string
+	Migrations []Migration
+}
+
+// Versions returns the versions of the bundle in apply order.
+func (b *Bundle) Versions() []string {
+	versions := make([]string, len(b.Migrations))
+	for i, m := range b.Migrations {
+		versions[i] = m.Version
+	}
+	return versions
+}
+
+// Set is the read-only set of bundles loaded at startup.
+type Set struct {
+	bundles map[string]*Bundle
+}
+
+// Load reads every bundle in dirs, keyed by bundle name. The .sql files of
+// each directory are applied in lexical order of their names.
+func Load(dirs map[string]string) (*Set, error) {
+	set := &Set{bundles: make(map[string]*Bundle, len(dirs))}
+	for name, dir := range dirs {
+		bundle, err := LoadBundle(name, dir)
+		if err != nil {
+			return nil, err
+		}
+		set.bundles[name] = bundle
+	}
+	return set, nil
+}
+
+func LoadBundle(name, dir string) (*Bundle, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read migration bundle %q: %w", name, err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".sql") {
+			files = append(files, entry.Name())
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("migration bundle %q has no .sql files in %s", name, dir)
+	}
+	sort.Strings(files)
+
+	bundle := &Bundle{Name: name}
+	seen := make(map[string]string, len(files))
+	for _, file := range files {
+		version, _, _ := strings.Cut(strings.TrimSuffix(file, ".sql"), "_")
+		if prev, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migration bundle %q: %s and %s share version %s", name, prev, file, version)
+		}
+		seen[version] = file
+		raw, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s/%s: %w", name, file, err)
+		}
+		bundle.Migrations = append(bundle.Migrations, Migration{Version: version, File: file, SQL: string(raw)})
+	}
+	return bundle, nil
+}
+
+func (s *Set) Get(name string) (*Bundle, bool) {
+	b, ok := s.bundles[name]
+	return b, ok
+}
+
+func (s *Set) Names() []string {
+	names := make([]string, 0, len(s.bundles))
+	for name := range s.bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,62 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadOrdersMigrationsByFileName(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"002_roles.sql": "CREATE TABLE roles (id int);",
+		"001_init.sql":  "CREATE TABLE users (id int);",
+		"010_index.sql": "CREATE INDEX users_id ON users (id);",
+		"README.md":     "not a migration",
+	})
+
+	set, err := Load(map[string]string{"iam": dir})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	bundle, ok := set.Get("iam")
+	if !ok {
+		t.Fatal("bundle iam not loaded")
+	}
+	if got := strings.Join(bundle.Versions(), ","); got != "001,002,010" {
+		t.Fatalf("versions = %s", got)
+	}
+	if bundle.Migrations[0].SQL != "CREATE TABLE users (id int);" {
+		t.Fatalf("first migration = %+v", bundle.Migrations[0])
+	}
+	if names := set.Names(); len(names) != 1 || names[0] != "iam" {
+		t.Fatalf("names = %q", names)
+	}
+}
+
+func TestLoadRejectsInvalidBundles(t *testing.T) {
+	empty := t.TempDir()
+	if _, err := LoadBundle("iam", empty); err == nil {
+		t.Fatal("expected error for a bundle without .sql files")
+	}
+
+	dup := t.TempDir()
+	writeFiles(t, dup, map[string]string{"001_init.sql": "", "001_other.sql": ""})
+	if _, err := LoadBundle("iam", dup); err == nil || !strings.Contains(err.Error(), "share version 001") {
+		t.Fatalf("err = %v, want duplicate version error", err)
+	}
+
+	if _, err := LoadBundle("iam", filepath.Join(empty, "missing")); err == nil {
+		t.Fatal("expected error for a missing directory")
+	}
+}
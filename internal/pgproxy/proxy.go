@@ -0,0 +1,349 @@
+package pgproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"go-service/internal/logging"
+)
+
+// Startup packet codes from the Postgres frontend/backend protocol.
+const (
+	protocolVersion3 = 196608
+	sslRequestCode   = 80877103
+	gssRequestCode   = 80877104
+	cancelCode       = 80877102
+
+	maxStartupLength = 10000
+)
+
+// Route is what the proxy knows about a connection before choosing a tenant.
+type Route struct {
+	Database   string
+	User       string
+	ServerName string
+}
+
+// Resolver maps a connection to the address of its tenant database.
+type Resolver interface {
+	ProxyTarget(ctx context.Context, route Route) (string, error)
+}
+
+type ResolverFunc func(ctx context.Context, route Route) (string, error)
+
+func (f ResolverFunc) ProxyTarget(ctx context.Context, route Route) (string, error) {
+	return f(ctx, route)
+}
+
+type Option func(*Proxy)
+
+// WithTLS terminates TLS for clients that ask for it; the SNI server name is
+// passed on to the resolver.
+func WithTLS(cfg *tls.Config) Option {
+	return func(p *Proxy) {
+		p.tls = cfg
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.dialTimeout = timeout
+	}
+}
+
+// Proxy accepts Postgres connections on a single port and forwards each to
+// the tenant picked from the startup message.
+type Proxy struct {
+	resolver    Resolver
+	tls         *tls.Config
+	dialTimeout time.Duration
+
+	mu       sync.Mutex
+	backends map[[8]byte]string
+}
+
+func New(resolver Resolver, opts ...Option) *Proxy {
+	p := &Proxy{
+		resolver:    resolver,
+		dialTimeout: 5 * time.Second,
+		backends:    make(map[[8]byte]string),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Serve accepts connections on ln until ctx is done, then closes ln.
+// Connections already proxied are left to finish.
+func (p *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go p.handle(context.WithoutCancel(ctx), conn)
+	}
+}
+
+func (p *Proxy) handle(ctx context.Context, client net.Conn) {
+	defer client.Close()
+	// A client that opens a connection and sends nothing must not hold a
+	// goroutine forever.
+	client.SetDeadline(time.Now().Add(p.dialTimeout))
+	route, startup, err := p.negotiate(&client)
+	if err != nil {
+		if !errors.Is(err, errCancelHandled) && !errors.Is(err, io.EOF) {
+			slog.DebugContext(ctx, "proxy handshake failed", slog.String("error", err.Error()))
+		}
+		return
+	}
+	client.SetDeadline(time.Time{})
+	ctx = logging.With(ctx, slog.String("database", route.Database), slog.String("server_name", route.ServerName))
+
+	addr, err := p.resolver.ProxyTarget(ctx, route)
+	if err != nil {
+		slog.InfoContext(ctx, "proxy route rejected", slog.String("error", err.Error()))
+		writeFatal(client, "3D000", err.Error())
+		return
+	}
+	backend, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+	if err != nil {
+		slog.WarnContext(ctx, "proxy backend unreachable", slog.String("addr", addr), slog.String("error", err.Error()))
+		writeFatal(client, "08006", "tenant database is unreachable")
+		return
+	}
+	defer backend.Close()
+	if _, err := backend.Write(startup); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backend, client)
+		closeWrite(backend)
+		close(done)
+	}()
+	r, key, err := p.relayUntilReady(client, backend, addr)
+	if key != nil {
+		defer p.forget(*key)
+	}
+	if err != nil {
+		return
+	}
+	io.Copy(client, r)
+	closeWrite(client)
+	<-done
+}
+
+var errCancelHandled = errors.New("cancel request forwarded")
+
+// negotiate reads startup packets until the real startup message, answering
+// SSL and GSS encryption requests on the way. client is replaced by the TLS
+// connection when TLS is negotiated. It returns the raw startup message to
+// forward to the backend.
+func (p *Proxy) negotiate(client *net.Conn) (Route, []byte, error) {
+	var route Route
+	encrypted := false
+	for {
+		packet, err := readStartup(*client)
+		if err != nil {
+			return Route{}, nil, err
+		}
+		code := binary.BigEndian.Uint32(packet[4:8])
+		switch code {
+		case sslRequestCode:
+			if p.tls == nil || encrypted {
+				if _, err := (*client).Write([]byte{'N'}); err != nil {
+					return Route{}, nil, err
+				}
+				continue
+			}
+			if _, err := (*client).Write([]byte{'S'}); err != nil {
+				return Route{}, nil, err
+			}
+			conn := tls.Server(*client, p.tls)
+			if err := conn.Handshake(); err != nil {
+				return Route{}, nil, fmt.Errorf("tls handshake: %w", err)
+			}
+			*client = conn
+			encrypted = true
+			route.ServerName = conn.ConnectionState().ServerName
+		case gssRequestCode:
+			if _, err := (*client).Write([]byte{'N'}); err != nil {
+				return Route{}, nil, err
+			}
+		case cancelCode:
+			p.forwardCancel(packet)
+			return Route{}, nil, errCancelHandled
+		case protocolVersion3:
+			params := parseParams(packet[8:])
+			route.User = params["user"]
+			route.Database = params["database"]
+			if route.Database == "" {
+				route.Database = route.User
+			}
+			return route, packet, nil
+		default:
+			writeFatal(*client, "08P01", fmt.Sprintf("unsupported protocol %d.%d", code>>16, code&0xffff))
+			return Route{}, nil, fmt.Errorf("unsupported startup code %d", code)
+		}
+	}
+}
+
+func readStartup(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 8 || length > maxStartupLength {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+	packet := make([]byte, length)
+	copy(packet, header[:])
+	if _, err := io.ReadFull(r, packet[4:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func parseParams(body []byte) map[string]string {
+	params := make(map[string]string)
+	for {
+		key, rest, ok := cutNull(body)
+		if !ok || key == "" {
+			return params
+		}
+		value, rest, ok := cutNull(rest)
+		if !ok {
+			return params
+		}
+		params[key] = value
+		body = rest
+	}
+}
+
+func cutNull(b []byte) (string, []byte, bool) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:], true
+		}
+	}
+	return "", nil, false
+}
+
+// relayUntilReady forwards backend messages to the client one by one until
+// the backend is ready for queries, remembering the BackendKeyData so cancel
+// requests for this session can be routed.
+func (p *Proxy) relayUntilReady(client io.Writer, backend io.Reader, addr string) (io.Reader, *[8]byte, error) {
+	r := bufio.NewReader(backend)
+	var key *[8]byte
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, key, err
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if length < 4 {
+			return nil, key, fmt.Errorf("invalid backend message length %d", length)
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, key, err
+		}
+		if header[0] == 'K' && len(body) == 8 {
+			key = new([8]byte)
+			copy(key[:], body)
+			p.mu.Lock()
+			p.backends[*key] = addr
+			p.mu.Unlock()
+		}
+		if _, err := client.Write(append(header[:], body...)); err != nil {
+			return nil, key, err
+		}
+		switch header[0] {
+		case 'Z':
+			// r may already hold what the backend sent next.
+			return r, key, nil
+		case 'E':
+			return nil, key, errors.New("backend refused the connection")
+		}
+	}
+}
+
+func (p *Proxy) forwardCancel(packet []byte) {
+	if len(packet) != 16 {
+		return
+	}
+	var key [8]byte
+	copy(key[:], packet[8:16])
+	p.mu.Lock()
+	addr, ok := p.backends[key]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write(packet)
+}
+
+func (p *Proxy) forget(key [8]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.backends, key)
+}
+
+// writeFatal sends a Postgres ErrorResponse so clients show a useful message
+// instead of a dropped connection.
+func writeFatal(w io.Writer, code, message string) {
+	var body []byte
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{{'S', "FATAL"}, {'V', "FATAL"}, {'C', code}, {'M', message}} {
+		body = append(body, field.kind)
+		body = append(body, field.value...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = 'E'
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	w.Write(append(msg, body...))
+}
+
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		c.CloseWrite()
+	case *tls.Conn:
+		c.CloseWrite()
+	default:
+		c.Close()
+	}
+}
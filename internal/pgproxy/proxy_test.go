@@ -0,0 +1,256 @@
+package pgproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type routes struct {
+	mu   sync.Mutex
+	seen []Route
+	addr string
+}
+
+func (r *routes) ProxyTarget(_ context.Context, route Route) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = append(r.seen, route)
+	if route.Database != "tenant_acme" && !strings.HasPrefix(route.ServerName, "acme.") {
+		return "", errors.New("tenant not found")
+	}
+	return r.addr, nil
+}
+
+func (r *routes) last() Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seen[len(r.seen)-1]
+}
+
+// fakeBackend accepts sessions that finish startup with a BackendKeyData and
+// then echo, and records cancel requests.
+func fakeBackend(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cancels := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				packet, err := readStartup(conn)
+				if err != nil {
+					return
+				}
+				if binary.BigEndian.Uint32(packet[4:8]) == cancelCode {
+					cancels <- packet
+					return
+				}
+				conn.Write(message('R', []byte{0, 0, 0, 0}))
+				conn.Write(message('K', []byte{0, 0, 0, 7, 1, 2, 3, 4}))
+				conn.Write(message('Z', []byte{'I'}))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), cancels
+}
+
+func startProxy(t *testing.T, resolver Resolver, opts ...Option) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go New(resolver, opts...).Serve(ctx, ln)
+	return ln.Addr().String()
+}
+
+func message(kind byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+func startupPacket(code uint32, body []byte) []byte {
+	packet := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(packet, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(packet[4:], code)
+	return append(packet, body...)
+}
+
+func startupMessage(database string) []byte {
+	return startupPacket(protocolVersion3, []byte("user\x00tenant_user\x00database\x00"+database+"\x00\x00"))
+}
+
+// readUntilReady reads backend messages and returns their types.
+func readUntilReady(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var kinds []byte
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			t.Fatalf("read message: %v (got %q)", err, kinds)
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, header[0])
+		if header[0] == 'Z' || header[0] == 'E' {
+			if header[0] == 'E' {
+				return string(kinds) + ":" + string(body)
+			}
+			return string(kinds)
+		}
+	}
+}
+
+func TestProxyRoutesByDatabaseAndForwardsCancel(t *testing.T) {
+	backend, cancels := fakeBackend(t)
+	resolver := &routes{addr: backend}
+	addr := startProxy(t, resolver)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(startupPacket(sslRequestCode, nil))
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil || answer[0] != 'N' {
+		t.Fatalf("ssl answer = %q, %v; want N without TLS configured", answer, err)
+	}
+	conn.Write(startupMessage("tenant_acme"))
+	if kinds := readUntilReady(t, conn); kinds != "RKZ" {
+		t.Fatalf("messages = %q, want RKZ", kinds)
+	}
+	if route := resolver.last(); route.Database != "tenant_acme" || route.User != "tenant_user" {
+		t.Fatalf("route = %+v", route)
+	}
+
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+
+	cancelConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelConn.Write(startupPacket(cancelCode, []byte{0, 0, 0, 7, 1, 2, 3, 4}))
+	cancelConn.Close()
+	select {
+	case packet := <-cancels:
+		if len(packet) != 16 {
+			t.Fatalf("cancel packet = %v", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancel request was not forwarded to the backend")
+	}
+}
+
+func TestProxyRejectsUnknownTenant(t *testing.T) {
+	addr := startProxy(t, &routes{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(startupMessage("tenant_ghost"))
+	if got := readUntilReady(t, conn); !strings.HasPrefix(got, "E:") || !strings.Contains(got, "tenant not found") {
+		t.Fatalf("response = %q, want an ErrorResponse", got)
+	}
+}
+
+func TestProxyClosesSilentClients(t *testing.T) {
+	addr := startProxy(t, &routes{}, WithDialTimeout(50*time.Millisecond))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read err = %v, want the proxy to close the connection", err)
+	}
+}
+
+func TestProxyRoutesByServerName(t *testing.T) {
+	backend, _ := fakeBackend(t)
+	resolver := &routes{addr: backend}
+	addr := startProxy(t, resolver, WithTLS(&tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}))
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+
+	raw.Write(startupPacket(sslRequestCode, nil))
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(raw, answer); err != nil || answer[0] != 'S' {
+		t.Fatalf("ssl answer = %q, %v; want S", answer, err)
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: "acme.db.example.com", InsecureSkipVerify: true})
+	conn.Write(startupMessage("postgres"))
+	if kinds := readUntilReady(t, conn); kinds != "RKZ" {
+		t.Fatalf("messages = %q, want RKZ", kinds)
+	}
+	if route := resolver.last(); route.ServerName != "acme.db.example.com" || route.Database != "postgres" {
+		t.Fatalf("route = %+v", route)
+	}
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "*.db.example.com"},
+		DNSNames:     []string{"*.db.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,185 @@
+package plans
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"go-service/internal/docker"
+)
+
+const (
+	IsolationShared    = "shared"
+	IsolationDedicated = "dedicated"
+)
+
+// Overridable field names a plan can open up to callers.
+const (
+	FieldMemoryMB      = "memory_mb"
+	FieldCPUCores      = "cpu_cores"
+	FieldMemorySwapMB  = "memory_swap_mb"
+	FieldPidsLimit     = "pids_limit"
+	FieldBlkioWeight   = "blkio_weight"
+	FieldRestartPolicy = "restart_policy"
+)
+
+var overridableFields = map[string]bool{
+	FieldMemoryMB:      true,
+	FieldCPUCores:      true,
+	FieldMemorySwapMB:  true,
+	FieldPidsLimit:     true,
+	FieldBlkioWeight:   true,
+	FieldRestartPolicy: true,
+}
+
+type Plan struct {
+	Name               string   `json:"name" yaml:"name"`
+	Image              string   `json:"image,omitempty" yaml:"image"`
+	MemoryMB           *int64   `json:"memory_mb,omitempty" yaml:"memory_mb"`
+	CPUCores           *float64 `json:"cpu_cores,omitempty" yaml:"cpu_cores"`
+	MemorySwapMB       *int64   `json:"memory_swap_mb,omitempty" yaml:"memory_swap_mb"`
+	PidsLimit          *int64   `json:"pids_limit,omitempty" yaml:"pids_limit"`
+	BlkioWeight        *int64   `json:"blkio_weight,omitempty" yaml:"blkio_weight"`
+	StorageQuotaMB     *int64   `json:"storage_quota_mb,omitempty" yaml:"storage_quota_mb"`
+	RestartPolicy      string   `json:"restart_policy,omitempty" yaml:"restart_policy"`
+	BackupSchedule     string   `json:"backup_schedule,omitempty" yaml:"backup_schedule"`
+	Isolation          string   `json:"isolation,omitempty" yaml:"isolation"`
+	IdleSuspendSeconds *int64   `json:"idle_suspend_seconds,omitempty" yaml:"idle_suspend_seconds"`
+	MaxMemoryMB        *int64   `json:"max_memory_mb,omitempty" yaml:"max_memory_mb"`
+	MaxCPUCores        *float64 `json:"max_cpu_cores,omitempty" yaml:"max_cpu_cores"`
+	Overridable        []string `json:"overridable,omitempty" yaml:"overridable"`
+}
+
+func (p Plan) AllowsOverride(field string) bool {
+	for _, f := range p.Overridable {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// nonPositive names the first numeric attribute set to zero or less.
+func (p Plan) nonPositive() string {
+	ints := []struct {
+		name  string
+		value *int64
+	}{
+		{FieldMemoryMB, p.MemoryMB},
+		{FieldMemorySwapMB, p.MemorySwapMB},
+		{FieldPidsLimit, p.PidsLimit},
+		{FieldBlkioWeight, p.BlkioWeight},
+		{"storage_quota_mb", p.StorageQuotaMB},
+		{"idle_suspend_seconds", p.IdleSuspendSeconds},
+		{"max_memory_mb", p.MaxMemoryMB},
+	}
+	for _, f := range ints {
+		if f.value != nil && *f.value <= 0 {
+			return f.name
+		}
+	}
+	if p.CPUCores != nil && *p.CPUCores <= 0 {
+		return FieldCPUCores
+	}
+	if p.MaxCPUCores != nil && *p.MaxCPUCores <= 0 {
+		return "max_cpu_cores"
+	}
+	return ""
+}
+
+type file struct {
+	Default string `json:"default" yaml:"default"`
+	Plans   []Plan `json:"plans" yaml:"plans"`
+}
+
+// Catalog is the read-only set of plans loaded at startup.
+type Catalog struct {
+	defaultPlan string
+	plans       map[string]Plan
+}
+
+// Load reads a catalog from path. Files ending in .yaml or .yml are parsed as
+// YAML, anything else as JSON.
+func Load(path string) (*Catalog, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read plans file: %w", err)
+	}
+	var f file
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &f)
+	default:
+		err = json.Unmarshal(raw, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode plans file: %w", err)
+	}
+	return New(f.Default, f.Plans)
+}
+
+func New(defaultPlan string, plans []Plan) (*Catalog, error) {
+	c := &Catalog{defaultPlan: defaultPlan, plans: make(map[string]Plan, len(plans))}
+	for _, p := range plans {
+		p.Name = strings.TrimSpace(p.Name)
+		if p.Name == "" {
+			return nil, fmt.Errorf("plan without name")
+		}
+		if _, dup := c.plans[p.Name]; dup {
+			return nil, fmt.Errorf("plan %q defined twice", p.Name)
+		}
+		if p.Isolation == "" {
+			p.Isolation = IsolationShared
+		}
+		if p.Isolation != IsolationShared && p.Isolation != IsolationDedicated {
+			return nil, fmt.Errorf("plan %q: isolation must be shared or dedicated", p.Name)
+		}
+		if p.RestartPolicy != "" && !docker.ValidRestartPolicy(p.RestartPolicy) {
+			return nil, fmt.Errorf("plan %q: invalid restart_policy %q", p.Name, p.RestartPolicy)
+		}
+		if p.BackupSchedule != "" {
+			// Parsed only so that catalogs written for it fail loudly.
+			return nil, fmt.Errorf("plan %q: backup_schedule is not supported", p.Name)
+		}
+		if field := p.nonPositive(); field != "" {
+			return nil, fmt.Errorf("plan %q: %s must be positive", p.Name, field)
+		}
+		for _, field := range p.Overridable {
+			if !overridableFields[field] {
+				return nil, fmt.Errorf("plan %q: %q is not an overridable field", p.Name, field)
+			}
+		}
+		c.plans[p.Name] = p
+	}
+	if defaultPlan != "" {
+		if _, ok := c.plans[defaultPlan]; !ok {
+			return nil, fmt.Errorf("default plan %q is not defined", defaultPlan)
+		}
+	}
+	return c, nil
+}
+
+func (c *Catalog) Get(name string) (Plan, bool) {
+	p, ok := c.plans[name]
+	return p, ok
+}
+
+// Default is the plan used when a request does not name one, or "" if the
+// catalog has no default.
+func (c *Catalog) Default() string {
+	return c.defaultPlan
+}
+
+func (c *Catalog) List() []Plan {
+	list := make([]Plan, 0, len(c.plans))
+	for _, p := range c.plans {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,70 @@
+package plans
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadYAMLAndJSON(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "plans.yaml")
+	jsonPath := filepath.Join(dir, "plans.json")
+	if err := os.WriteFile(yamlPath, []byte(`
+default: free
+plans:
+  - name: free
+    memory_mb: 256
+    cpu_cores: 0.25
+    restart_policy: on-failure:3
+  - name: pro
+    image: postgres:17-alpine
+    memory_mb: 1024
+    max_memory_mb: 4096
+    isolation: dedicated
+    overridable: [memory_mb]
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jsonPath, []byte(`{"default":"free","plans":[{"name":"free","memory_mb":256,"cpu_cores":0.25,"restart_policy":"on-failure:3"},{"name":"pro","image":"postgres:17-alpine","memory_mb":1024,"max_memory_mb":4096,"isolation":"dedicated","overridable":["memory_mb"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		catalog, err := Load(path)
+		if err != nil {
+			t.Fatalf("Load(%s): %v", path, err)
+		}
+		if catalog.Default() != "free" || len(catalog.List()) != 2 {
+			t.Fatalf("%s: default=%q plans=%d", path, catalog.Default(), len(catalog.List()))
+		}
+		free, _ := catalog.Get("free")
+		if *free.MemoryMB != 256 || free.Isolation != IsolationShared || free.AllowsOverride(FieldMemoryMB) {
+			t.Fatalf("%s: unexpected free plan %+v", path, free)
+		}
+		pro, _ := catalog.Get("pro")
+		if pro.Image != "postgres:17-alpine" || !pro.AllowsOverride(FieldMemoryMB) || *pro.MaxMemoryMB != 4096 {
+			t.Fatalf("%s: unexpected pro plan %+v", path, pro)
+		}
+	}
+}
+
+func TestNewRejectsInvalidCatalogs(t *testing.T) {
+	cases := map[string]struct {
+		defaultPlan string
+		plans       []Plan
+	}{
+		"missing default": {defaultPlan: "gold", plans: []Plan{{Name: "free"}}},
+		"duplicate":       {plans: []Plan{{Name: "free"}, {Name: "free"}}},
+		"bad isolation":   {plans: []Plan{{Name: "free", Isolation: "vm"}}},
+		"bad override":    {plans: []Plan{{Name: "free", Overridable: []string{"image"}}}},
+		"bad restart":     {plans: []Plan{{Name: "free", RestartPolicy: "sometimes"}}},
+		"backup schedule": {plans: []Plan{{Name: "free", BackupSchedule: "0 3 * * *"}}},
+		"zero memory":     {plans: []Plan{{Name: "free", MemoryMB: new(int64)}}},
+	}
+	for name, tc := range cases {
+		if _, err := New(tc.defaultPlan, tc.plans); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
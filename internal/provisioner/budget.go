@@ -0,0 +1,129 @@
+package provisioner
+
+import (
+	"fmt"
+	"sync"
+)
+
+func (s *Service) validateLimits(l Limits) error {
+	verr := &ValidationError{}
+	if l.MemoryMB != nil {
+		switch {
+		case *l.MemoryMB <= 0:
+			verr.add("memory_mb", "must be positive")
+		case s.cfg.MinMemoryMB != nil && *l.MemoryMB < *s.cfg.MinMemoryMB:
+			verr.add("memory_mb", "must be at least %d", *s.cfg.MinMemoryMB)
+		case s.cfg.MaxMemoryMB != nil && *l.MemoryMB > *s.cfg.MaxMemoryMB:
+			verr.add("memory_mb", "must be at most %d", *s.cfg.MaxMemoryMB)
+		}
+	}
+	if l.MemorySwapMB != nil {
+		switch {
+		case *l.MemorySwapMB <= 0:
+			verr.add("memory_swap_mb", "must be positive")
+		case l.MemoryMB != nil && *l.MemorySwapMB < *l.MemoryMB:
+			verr.add("memory_swap_mb", "must be at least memory_mb (%d)", *l.MemoryMB)
+		}
+	}
+	if l.CPUCores != nil {
+		switch {
+		case *l.CPUCores <= 0:
+			verr.add("cpu_cores", "must be positive")
+		case s.cfg.MinCPUCores != nil && *l.CPUCores < *s.cfg.MinCPUCores:
+			verr.add("cpu_cores", "must be at least %g", *s.cfg.MinCPUCores)
+		case s.cfg.MaxCPUCores != nil && *l.CPUCores > *s.cfg.MaxCPUCores:
+			verr.add("cpu_cores", "must be at most %g", *s.cfg.MaxCPUCores)
+		}
+	}
+	if l.PidsLimit != nil {
+		switch {
+		case *l.PidsLimit <= 0:
+			verr.add("pids_limit", "must be positive")
+		case s.cfg.MaxPidsLimit != nil && *l.PidsLimit > *s.cfg.MaxPidsLimit:
+			verr.add("pids_limit", "must be at most %d", *s.cfg.MaxPidsLimit)
+		}
+	}
+	if l.BlkioWeight != nil && (*l.BlkioWeight < 10 || *l.BlkioWeight > 1000) {
+		verr.add("blkio_weight", "must be between 10 and 1000")
+	}
+	return verr.orNil()
+}
+
+// budgetReservations holds the limits of operations that passed the budget
+// check but have not been recorded in the registry yet, so concurrent
+// provisions cannot overcommit the host together.
+type budgetReservations struct {
+	mu      sync.Mutex
+	pending map[string]Limits
+}
+
+// reserveBudget checks that giving tenant the limits l keeps the sum across
+// all managed tenants within the configured budget. The reservation must be
+// released once the limits are recorded in the registry or abandoned.
+func (s *Service) reserveBudget(tenant string, l Limits) (func(), error) {
+	if s.cfg.MemoryBudgetMB == nil && s.cfg.CPUBudgetCores == nil {
+		return func() {}, nil
+	}
+
+	s.budget.mu.Lock()
+	defer s.budget.mu.Unlock()
+
+	records, err := s.registry.List()
+	if err != nil {
+		return nil, fmt.Errorf("load tenants: %w", err)
+	}
+	allocated := make(map[string]Limits, len(records)+len(s.budget.pending))
+	for _, record := range records {
+		allocated[record.Name] = Limits(record.Limits)
+	}
+	for name, pending := range s.budget.pending {
+		allocated[name] = pending
+	}
+	allocated[tenant] = l
+
+	var memoryMB int64
+	var cpuCores float64
+	for _, limits := range allocated {
+		if mem := s.effectiveMemoryMB(limits); mem != nil {
+			memoryMB += *mem
+		}
+		if cpu := s.effectiveCPUCores(limits); cpu != nil {
+			cpuCores += *cpu
+		}
+	}
+
+	verr := &ValidationError{}
+	if s.cfg.MemoryBudgetMB != nil && memoryMB > *s.cfg.MemoryBudgetMB {
+		verr.add("memory_mb", "exceeds host memory budget (%d of %d MB allocated)", memoryMB, *s.cfg.MemoryBudgetMB)
+	}
+	if s.cfg.CPUBudgetCores != nil && cpuCores > *s.cfg.CPUBudgetCores {
+		verr.add("cpu_cores", "exceeds host CPU budget (%g of %g cores allocated)", cpuCores, *s.cfg.CPUBudgetCores)
+	}
+	if err := verr.orNil(); err != nil {
+		return nil, err
+	}
+
+	if s.budget.pending == nil {
+		s.budget.pending = make(map[string]Limits)
+	}
+	s.budget.pending[tenant] = l
+	return func() {
+		s.budget.mu.Lock()
+		defer s.budget.mu.Unlock()
+		delete(s.budget.pending, tenant)
+	}, nil
+}
+
+func (s *Service) effectiveMemoryMB(l Limits) *int64 {
+	if l.MemoryMB != nil {
+		return l.MemoryMB
+	}
+	return s.cfg.DefaultMemoryMB
+}
+
+func (s *Service) effectiveCPUCores(l Limits) *float64 {
+	if l.CPUCores != nil {
+		return l.CPUCores
+	}
+	return s.cfg.DefaultCPUCores
+}
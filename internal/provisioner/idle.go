@@ -0,0 +1,158 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-service/internal/logging"
+	"go-service/internal/registry"
+)
+
+var ErrTenantStopped = errors.New("tenant was stopped by an operator and must be started explicitly")
+
+const activeConnectionsQuery = "SELECT count(*) FROM pg_stat_activity " +
+	"WHERE datname = current_database() AND backend_type = 'client backend' AND pid <> pg_backend_pid()"
+
+// idleTracker remembers when each tenant was last seen active. A tenant seen
+// for the first time counts as active at that moment, so a fresh or just
+// woken tenant gets its full idle allowance.
+type idleTracker struct {
+	mu         sync.Mutex
+	lastActive map[string]time.Time
+}
+
+func (t *idleTracker) observe(tenant string, active bool, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastActive == nil {
+		t.lastActive = make(map[string]time.Time)
+	}
+	last, seen := t.lastActive[tenant]
+	if active || !seen {
+		t.lastActive[tenant] = now
+		return 0
+	}
+	return now.Sub(last)
+}
+
+func (t *idleTracker) forget(tenant string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.lastActive, tenant)
+}
+
+// SuspendIdle stops running tenants that had no client connections and
+// negligible CPU for longer than their plan's idle threshold. Suspended
+// tenants are started again by WakeTenant. It returns the tenants it stopped.
+func (s *Service) SuspendIdle(ctx context.Context) ([]string, error) {
+	records, err := s.registry.List()
+	if err != nil {
+		return nil, fmt.Errorf("load tenants: %w", err)
+	}
+	var suspended []string
+	for _, record := range records {
+		if record.DesiredState == registry.StateStopped {
+			continue
+		}
+		threshold := s.idleThreshold(record)
+		if threshold <= 0 {
+			continue
+		}
+		tctx := logging.With(ctx, slog.String("tenant", record.Name))
+		active, err := s.tenantActive(tctx, record)
+		if err != nil {
+			slog.WarnContext(tctx, "idle check failed", slog.String("error", err.Error()))
+			continue
+		}
+		idleFor := s.idle.observe(record.Name, active, time.Now())
+		if idleFor < threshold {
+			continue
+		}
+
+		if _, err := s.changeState(tctx, ActionSuspend, record.Name); err != nil {
+			if errors.Is(err, ErrTenantStopped) || errors.Is(err, ErrTenantNotFound) {
+				continue
+			}
+			slog.ErrorContext(tctx, "idle suspend failed", slog.String("error", err.Error()))
+			continue
+		}
+		suspended = append(suspended, record.Name)
+	}
+	return suspended, nil
+}
+
+func (s *Service) idleThreshold(record registry.Tenant) time.Duration {
+	if record.Plan != "" && s.plans != nil {
+		if plan, ok := s.plans.Get(record.Plan); ok && plan.IdleSuspendSeconds != nil {
+			return time.Duration(*plan.IdleSuspendSeconds) * time.Second
+		}
+	}
+	return s.cfg.IdleSuspendAfter
+}
+
+// tenantActive reports whether the tenant has client connections or is using
+// more CPU than the idle threshold.
+func (s *Service) tenantActive(ctx context.Context, record registry.Tenant) (bool, error) {
+	container := record.Container
+	if container == "" {
+		container = record.ResourceID
+	}
+	out, err := s.psql(ctx, container, s.cfg.TenantDBNamePrefix+record.Name, activeConnectionsQuery)
+	if err != nil {
+		return false, fmt.Errorf("count connections: %w", err)
+	}
+	connections, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return false, fmt.Errorf("parse connection count %q", strings.TrimSpace(out))
+	}
+	if connections > 0 {
+		return true, nil
+	}
+
+	out, err = s.runner.Run(ctx, "stats", "--no-stream", "--format", "{{.CPUPerc}}", container)
+	if err != nil {
+		return false, fmt.Errorf("docker stats: %w", err)
+	}
+	cpu, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(out), "%"), 64)
+	if err != nil {
+		return false, fmt.Errorf("parse cpu usage %q", strings.TrimSpace(out))
+	}
+	return cpu > s.cfg.IdleCPUPercent, nil
+}
+
+// WakeTenant starts a tenant that was suspended for being idle. Running
+// tenants are returned as they are; tenants stopped through StopTenant are
+// not woken.
+func (s *Service) WakeTenant(ctx context.Context, tenantName string) (LifecycleResult, error) {
+	tenant := normalizeTenantName(tenantName)
+	if tenant == "" {
+		return LifecycleResult{}, ErrInvalidTenant
+	}
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return LifecycleResult{}, fmt.Errorf("load tenant: %w", err)
+	}
+	if !ok {
+		return LifecycleResult{}, ErrTenantNotFound
+	}
+	if record.DesiredState != registry.StateStopped {
+		host, port := s.recordedEndpoint(record)
+		return LifecycleResult{
+			Status:     "running",
+			Tenant:     tenant,
+			ResourceID: record.ResourceID,
+			Host:       host,
+			Port:       port,
+		}, nil
+	}
+	if !record.Suspended {
+		return LifecycleResult{}, ErrTenantStopped
+	}
+	return s.changeState(ctx, ActionWake, tenant)
+}
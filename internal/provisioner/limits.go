@@ -0,0 +1,270 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/logging"
+	"go-service/internal/registry"
+	"go-service/internal/tracing"
+)
+
+var (
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrInvalidLimits  = errors.New("invalid limits")
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every request field that was rejected. It matches
+// ErrInvalidRequest with errors.Is, and ErrInvalidLimits for callers that
+// only validate limits.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+" "+f.Message)
+	}
+	return ErrInvalidRequest.Error() + ": " + strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidRequest || target == ErrInvalidLimits
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationError) orNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+type UpdateLimitsResult struct {
+	Status     string `json:"status"`
+	Tenant     string `json:"tenant"`
+	ResourceID string `json:"resource_id"`
+	Limits     Limits `json:"limits"`
+}
+
+// merge returns l with every field set in override replaced.
+func (l Limits) merge(override Limits) Limits {
+	if override.MemoryMB != nil {
+		l.MemoryMB = override.MemoryMB
+	}
+	if override.CPUCores != nil {
+		l.CPUCores = override.CPUCores
+	}
+	if override.MemorySwapMB != nil {
+		l.MemorySwapMB = override.MemorySwapMB
+	}
+	if override.PidsLimit != nil {
+		l.PidsLimit = override.PidsLimit
+	}
+	if override.BlkioWeight != nil {
+		l.BlkioWeight = override.BlkioWeight
+	}
+	return l
+}
+
+// setFields names the fields present in l, using their JSON names.
+func (l Limits) setFields() []string {
+	var fields []string
+	if l.MemoryMB != nil {
+		fields = append(fields, "memory_mb")
+	}
+	if l.CPUCores != nil {
+		fields = append(fields, "cpu_cores")
+	}
+	if l.MemorySwapMB != nil {
+		fields = append(fields, "memory_swap_mb")
+	}
+	if l.PidsLimit != nil {
+		fields = append(fields, "pids_limit")
+	}
+	if l.BlkioWeight != nil {
+		fields = append(fields, "blkio_weight")
+	}
+	return fields
+}
+
+func (l Limits) empty() bool {
+	return l.MemoryMB == nil && l.CPUCores == nil && l.MemorySwapMB == nil && l.PidsLimit == nil && l.BlkioWeight == nil
+}
+
+// dockerArgs renders the limits as flags accepted by both docker run and
+// docker update. Unset and non-positive values are left to docker.
+func (l Limits) dockerArgs() []string {
+	var args []string
+	if l.MemoryMB != nil && *l.MemoryMB > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%dm", *l.MemoryMB))
+	}
+	if l.MemorySwapMB != nil && *l.MemorySwapMB > 0 {
+		args = append(args, "--memory-swap", fmt.Sprintf("%dm", *l.MemorySwapMB))
+	}
+	if l.CPUCores != nil && *l.CPUCores > 0 {
+		args = append(args, "--cpus", fmt.Sprintf("%g", *l.CPUCores))
+	}
+	if l.PidsLimit != nil && *l.PidsLimit > 0 {
+		args = append(args, "--pids-limit", fmt.Sprintf("%d", *l.PidsLimit))
+	}
+	if l.BlkioWeight != nil && *l.BlkioWeight > 0 {
+		args = append(args, "--blkio-weight", fmt.Sprintf("%d", *l.BlkioWeight))
+	}
+	return args
+}
+
+// UpdateLimits applies new resource limits to a running tenant container
+// with docker update, without recreating it.
+func (s *Service) UpdateLimits(ctx context.Context, tenantName string, limits Limits) (UpdateLimitsResult, error) {
+	start := time.Now()
+	tenant := normalizeTenantName(tenantName)
+	ctx, span := s.tracer.Start(ctx, "Service.UpdateLimits", trace.WithAttributes(
+		attribute.String("tenant.name", tenant),
+	))
+	ctx = logging.With(ctx, slog.String("tenant", tenant))
+	result, err := s.updateLimitsTracked(ctx, tenant, limits)
+	s.observe("update_limits", start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(
+			ctx, "tenant limits updated",
+			slog.String("resource_id", result.ResourceID),
+			slog.String("limits", strings.Join(limits.dockerArgs(), " ")),
+			slog.Duration("duration", time.Since(start)),
+		)
+	}
+	return result, err
+}
+
+func (s *Service) updateLimitsTracked(ctx context.Context, tenant string, limits Limits) (UpdateLimitsResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return UpdateLimitsResult{}, err
+	}
+	defer done()
+	return s.updateLimits(ctx, tenant, limits)
+}
+
+func (s *Service) updateLimits(ctx context.Context, tenant string, limits Limits) (UpdateLimitsResult, error) {
+	if tenant == "" {
+		return UpdateLimitsResult{}, ErrInvalidTenant
+	}
+	if limits.empty() {
+		verr := &ValidationError{}
+		verr.add("limits", "at least one limit is required")
+		return UpdateLimitsResult{}, verr
+	}
+	if err := s.validateLimits(limits); err != nil {
+		return UpdateLimitsResult{}, err
+	}
+
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return UpdateLimitsResult{}, err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return UpdateLimitsResult{}, err
+	}
+	defer release()
+
+	containerName := "tenant-db-" + tenant
+	containerID, err := s.lookupContainerID(ctx, containerName)
+	if err != nil {
+		return UpdateLimitsResult{}, err
+	}
+	if containerID == "" {
+		return UpdateLimitsResult{}, ErrTenantNotFound
+	}
+
+	record, _, err := s.registry.Get(tenant)
+	if err != nil {
+		return UpdateLimitsResult{}, fmt.Errorf("load tenant: %w", err)
+	}
+	previous := Limits(record.Limits)
+	updated := previous.merge(limits)
+	if record.Plan != "" && s.plans != nil {
+		if plan, ok := s.plans.Get(record.Plan); ok {
+			verr := &ValidationError{}
+			checkPlanMaxima(verr, plan, updated)
+			if err := verr.orNil(); err != nil {
+				return UpdateLimitsResult{}, err
+			}
+		}
+	}
+	if updated.MemoryMB != nil && updated.MemorySwapMB != nil && *updated.MemorySwapMB < *updated.MemoryMB {
+		verr := &ValidationError{}
+		verr.add("memory_swap_mb", "must be at least memory_mb (%d)", *updated.MemoryMB)
+		return UpdateLimitsResult{}, verr
+	}
+	releaseBudget, err := s.reserveBudget(tenant, updated)
+	if err != nil {
+		return UpdateLimitsResult{}, err
+	}
+	defer releaseBudget()
+
+	updated, err = s.dockerUpdate(ctx, containerID, previous, limits)
+	if err != nil {
+		return UpdateLimitsResult{}, err
+	}
+
+	err = s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			t.ResourceID = containerID
+			t.Container = containerName
+			t.DesiredState = registry.StateRunning
+		}
+		t.Limits = registry.Limits(updated)
+		return nil
+	})
+	if err != nil {
+		return UpdateLimitsResult{}, fmt.Errorf("record limits: %w", err)
+	}
+
+	return UpdateLimitsResult{
+		Status:     "updated",
+		Tenant:     tenant,
+		ResourceID: containerID,
+		Limits:     updated,
+	}, nil
+}
+
+// dockerUpdate applies the limits set in apply to a running container and
+// returns the limits the container ends up with. extra is appended to the
+// docker update flags.
+func (s *Service) dockerUpdate(ctx context.Context, containerID string, previous, apply Limits, extra ...string) (Limits, error) {
+	if apply.MemoryMB != nil && apply.MemorySwapMB == nil &&
+		(previous.MemorySwapMB == nil || *previous.MemorySwapMB < *apply.MemoryMB) {
+		// docker refuses a memory limit above the current swap limit, which
+		// defaulted to twice the old memory at run time; keep that ratio.
+		swap := *apply.MemoryMB * 2
+		apply.MemorySwapMB = &swap
+	}
+
+	args := append([]string{"update"}, apply.dockerArgs()...)
+	args = append(args, extra...)
+	args = append(args, containerID)
+	if _, err := s.runner.Run(ctx, args...); err != nil {
+		return Limits{}, fmt.Errorf("docker update: %w", err)
+	}
+	return previous.merge(apply), nil
+}
@@ -0,0 +1,228 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go-service/internal/logging"
+	"go-service/internal/migrations"
+	"go-service/internal/registry"
+	"go-service/internal/tracing"
+)
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	bundle text NOT NULL,
+	version text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (bundle, version)
+)`
+
+// Per-tenant outcomes of a migration run.
+const (
+	MigrationApplied  = "applied"
+	MigrationUpToDate = "up_to_date"
+	MigrationSkipped  = "skipped"
+	MigrationFailed   = "failed"
+)
+
+type TenantMigration struct {
+	Tenant  string   `json:"tenant"`
+	Bundle  string   `json:"bundle"`
+	Status  string   `json:"status"`
+	Applied []string `json:"applied,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type MigrateResult struct {
+	Tenants []TenantMigration `json:"tenants"`
+	Failed  int               `json:"failed"`
+}
+
+func WithMigrations(set *migrations.Set) Option {
+	return func(s *Service) {
+		s.migrations = set
+	}
+}
+
+// lookupBundle resolves the bundle a provision request asks for, falling back
+// to MIGRATION_DEFAULT_BUNDLE. It returns nil when no bundle applies.
+func (s *Service) lookupBundle(verr *ValidationError, name string) *migrations.Bundle {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = s.cfg.MigrationDefault
+	}
+	if name == "" {
+		return nil
+	}
+	if s.migrations != nil {
+		if bundle, ok := s.migrations.Get(name); ok {
+			return bundle
+		}
+	}
+	verr.add("migration_bundle", "%s is not a registered bundle", name)
+	return nil
+}
+
+// applyMigrations runs the migrations of bundle the tenant database has not
+// recorded yet, each in its own transaction together with its bookkeeping row.
+// A non-empty upTo stops after that version.
+func (s *Service) applyMigrations(ctx context.Context, container, dbName string, bundle *migrations.Bundle, upTo string) ([]string, error) {
+	if _, err := s.psql(ctx, container, dbName, createMigrationsTable); err != nil {
+		return nil, fmt.Errorf("create migrations table: %w", err)
+	}
+	out, err := s.psql(ctx, container, dbName, "SELECT version FROM schema_migrations WHERE bundle = "+quoteLiteral(bundle.Name))
+	if err != nil {
+		return nil, fmt.Errorf("read applied migrations: %w", err)
+	}
+	done := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			done[line] = true
+		}
+	}
+
+	var applied []string
+	for _, m := range bundle.Migrations {
+		if done[m.Version] {
+			if m.Version == upTo {
+				break
+			}
+			continue
+		}
+		script := m.SQL + "\n;\nINSERT INTO schema_migrations (bundle, version) VALUES (" +
+			quoteLiteral(bundle.Name) + ", " + quoteLiteral(m.Version) + ");\n"
+		if _, err := s.psqlScript(ctx, container, dbName, script); err != nil {
+			return applied, fmt.Errorf("apply migration %s: %w", m.File, err)
+		}
+		slog.InfoContext(ctx, "migration applied", slog.String("bundle", bundle.Name), slog.String("version", m.Version))
+		applied = append(applied, m.Version)
+		if m.Version == upTo {
+			break
+		}
+	}
+	return applied, nil
+}
+
+// MigrateTenants applies pending migrations to every running tenant that was
+// provisioned with a bundle. Failures are reported per tenant and do not stop
+// the run.
+func (s *Service) MigrateTenants(ctx context.Context) (MigrateResult, error) {
+	start := time.Now()
+	ctx, span := s.tracer.Start(ctx, "Service.MigrateTenants")
+	result, err := s.migrateTenantsTracked(ctx)
+	s.observe("migrate", start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(ctx, "tenant migrations finished", slog.Int("tenants", len(result.Tenants)), slog.Int("failed", result.Failed))
+	}
+	return result, err
+}
+
+func (s *Service) migrateTenantsTracked(ctx context.Context) (MigrateResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return MigrateResult{}, err
+	}
+	defer done()
+
+	records, err := s.registry.List()
+	if err != nil {
+		return MigrateResult{}, fmt.Errorf("load tenants: %w", err)
+	}
+	result := MigrateResult{Tenants: []TenantMigration{}}
+	for _, record := range records {
+		if record.MigrationBundle == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		tctx := logging.With(ctx, slog.String("tenant", record.Name))
+		outcome := s.migrateTenant(tctx, record.Name, record.MigrationBundle, "")
+		if outcome.Status == MigrationFailed {
+			result.Failed++
+			slog.ErrorContext(tctx, "tenant migration failed", slog.String("error", outcome.Error))
+		}
+		result.Tenants = append(result.Tenants, outcome)
+	}
+	return result, nil
+}
+
+func (s *Service) migrateTenant(ctx context.Context, tenant, bundleName, upTo string) TenantMigration {
+	outcome := TenantMigration{Tenant: tenant, Bundle: bundleName}
+	fail := func(err error) TenantMigration {
+		outcome.Status = MigrationFailed
+		outcome.Error = err.Error()
+		return outcome
+	}
+
+	var bundle *migrations.Bundle
+	if s.migrations != nil {
+		bundle, _ = s.migrations.Get(bundleName)
+	}
+	if bundle == nil {
+		return fail(fmt.Errorf("bundle %s is no longer registered", bundleName))
+	}
+
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return fail(err)
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer release()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return fail(fmt.Errorf("load tenant: %w", err))
+	}
+	if !ok {
+		return fail(ErrTenantNotFound)
+	}
+	if record.DesiredState == registry.StateStopped {
+		outcome.Status = MigrationSkipped
+		outcome.Error = "tenant is stopped"
+		return outcome
+	}
+	container := record.Container
+	if container == "" {
+		container = record.ResourceID
+	}
+
+	applied, err := s.applyMigrations(ctx, container, s.cfg.TenantDBNamePrefix+tenant, bundle, upTo)
+	outcome.Applied = applied
+	if len(applied) > 0 {
+		last := applied[len(applied)-1]
+		uerr := s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+			if !exists {
+				return registry.ErrNotFound
+			}
+			t.MigrationVersion = last
+			return nil
+		})
+		if uerr != nil && !errors.Is(uerr, registry.ErrNotFound) && err == nil {
+			err = fmt.Errorf("record migration version: %w", uerr)
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if len(applied) == 0 {
+		outcome.Status = MigrationUpToDate
+	} else {
+		outcome.Status = MigrationApplied
+	}
+	return outcome
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,191 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/logging"
+	"go-service/internal/plans"
+	"go-service/internal/registry"
+	"go-service/internal/tracing"
+)
+
+var (
+	ErrAppContainerNotFound = errors.New("application container not found")
+	ErrSharedNetwork        = errors.New("tenant uses the shared network; application containers attach to dedicated networks only")
+)
+
+type AttachResult struct {
+	Status        string   `json:"status"`
+	Tenant        string   `json:"tenant"`
+	Network       string   `json:"network"`
+	AppContainers []string `json:"app_containers"`
+}
+
+func tenantNetworkName(tenant string) string {
+	return "tenant-net-" + tenant
+}
+
+// networkFor returns the network a new tenant container joins: its own
+// network with dedicated isolation, the shared one otherwise.
+func (s *Service) networkFor(tenant, isolation string) string {
+	if isolation == plans.IsolationDedicated {
+		return tenantNetworkName(tenant)
+	}
+	return s.cfg.TenantDBNetwork
+}
+
+// ensureTenantNetwork creates the tenant's dedicated network and connects the
+// containers listed in TENANT_NETWORK_ATTACH, such as the proxy, to it. It
+// reports whether the network was created by this call.
+func (s *Service) ensureTenantNetwork(ctx context.Context, tenant string) (bool, error) {
+	network := tenantNetworkName(tenant)
+	created := false
+	if _, err := s.runner.Run(ctx, "network", "inspect", network); err != nil {
+		_, err = s.runner.Run(
+			ctx,
+			"network", "create",
+			"--label", managedByLabel,
+			"--label", "tenant_name="+tenant,
+			network,
+		)
+		if err != nil {
+			return false, err
+		}
+		created = true
+	}
+	for _, container := range s.cfg.TenantNetworkAttach {
+		if err := s.connectNetwork(ctx, network, container); err != nil {
+			return created, fmt.Errorf("attach %s: %w", container, err)
+		}
+	}
+	return created, nil
+}
+
+func (s *Service) networkExists(ctx context.Context, network string) (bool, error) {
+	_, err := s.runner.Run(ctx, "network", "inspect", network)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) || strings.Contains(err.Error(), "not found") {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *Service) connectNetwork(ctx context.Context, network, container string) error {
+	_, err := s.runner.Run(ctx, "network", "connect", network, container)
+	if err == nil || strings.Contains(err.Error(), "already exists") {
+		return nil
+	}
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrAppContainerNotFound, container)
+	}
+	return err
+}
+
+// removeTenantNetwork disconnects everything still attached to a dedicated
+// network and removes it. Docker refuses to remove a network in use.
+func (s *Service) removeTenantNetwork(ctx context.Context, network string, attached []string) error {
+	members := append(append([]string(nil), attached...), s.cfg.TenantNetworkAttach...)
+	for _, container := range members {
+		_, err := s.runner.Run(ctx, "network", "disconnect", "-f", network, container)
+		if err != nil && !isNotFound(err) && !strings.Contains(err.Error(), "is not connected") {
+			return fmt.Errorf("detach %s: %w", container, err)
+		}
+	}
+	_, err := s.runner.Run(ctx, "network", "rm", network)
+	if err != nil && !isNotFound(err) && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	return nil
+}
+
+// AttachApp connects an application container to the tenant's dedicated
+// network so it can reach the tenant database.
+func (s *Service) AttachApp(ctx context.Context, tenantName, container string) (AttachResult, error) {
+	start := time.Now()
+	tenant := normalizeTenantName(tenantName)
+	ctx, span := s.tracer.Start(ctx, "Service.AttachApp", trace.WithAttributes(
+		attribute.String("tenant.name", tenant),
+		attribute.String("container", container),
+	))
+	ctx = logging.With(ctx, slog.String("tenant", tenant), slog.String("app_container", container))
+	result, err := s.attachAppTracked(ctx, tenant, strings.TrimSpace(container))
+	s.observe("attach_app", start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(ctx, "application container attached", slog.String("network", result.Network))
+	}
+	return result, err
+}
+
+func (s *Service) attachAppTracked(ctx context.Context, tenant, container string) (AttachResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return AttachResult{}, err
+	}
+	defer done()
+	return s.attachApp(ctx, tenant, container)
+}
+
+func (s *Service) attachApp(ctx context.Context, tenant, container string) (AttachResult, error) {
+	if tenant == "" {
+		return AttachResult{}, ErrInvalidTenant
+	}
+	if container == "" {
+		verr := &ValidationError{}
+		verr.add("container", "is required")
+		return AttachResult{}, verr
+	}
+
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return AttachResult{}, err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return AttachResult{}, err
+	}
+	defer release()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return AttachResult{}, fmt.Errorf("load tenant: %w", err)
+	}
+	if !ok {
+		return AttachResult{}, ErrTenantNotFound
+	}
+	if !record.DedicatedNetwork {
+		return AttachResult{}, ErrSharedNetwork
+	}
+	if err := s.connectNetwork(ctx, record.Network, container); err != nil {
+		return AttachResult{}, err
+	}
+
+	apps := record.AppContainers
+	if !slices.Contains(apps, container) {
+		apps = append(append([]string(nil), apps...), container)
+	}
+	err = s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			return ErrTenantNotFound
+		}
+		t.AppContainers = apps
+		return nil
+	})
+	if err != nil {
+		return AttachResult{}, fmt.Errorf("record app container: %w", err)
+	}
+	return AttachResult{Status: "attached", Tenant: tenant, Network: record.Network, AppContainers: apps}, nil
+}
@@ -0,0 +1,63 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go-service/internal/workqueue"
+)
+
+type Observer interface {
+	ObserveOperation(operation, outcome string, duration time.Duration)
+}
+
+func (s *Service) observe(operation string, start time.Time, err error) {
+	if s.observer == nil {
+		return
+	}
+	s.observer.ObserveOperation(operation, outcomeOf(err), time.Since(start))
+}
+
+func outcomeOf(err error) string {
+	if err == nil {
+		return "success"
+	}
+	var alreadyProvisioned *ErrAlreadyProvisioned
+	var queueFull *workqueue.ErrQueueFull
+	switch {
+	case errors.Is(err, ErrInvalidTenant), errors.Is(err, ErrInvalidResource), errors.Is(err, ErrInvalidRestartPolicy), errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrUnknownPlan), errors.Is(err, ErrAppContainerNotFound):
+		return "invalid"
+	case errors.As(err, &alreadyProvisioned), errors.Is(err, ErrPlanRequiresRecreate), errors.Is(err, ErrTenantStopped), errors.Is(err, ErrSharedNetwork),
+		errors.Is(err, ErrUpgradeUnsupported), errors.Is(err, ErrUpgradeNotNewer), errors.Is(err, ErrVolumeExists):
+		return "conflict"
+	case errors.As(err, &queueFull), errors.Is(err, ErrNoFreePort), errors.Is(err, ErrCapacityExhausted):
+		return "rejected"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+func (s *Service) ContainerStates(ctx context.Context) (map[string]int, error) {
+	out, err := s.runner.Run(
+		ctx,
+		"ps", "-a",
+		"--filter", "label="+managedByLabel,
+		"--format", "{{.State}}",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		state := strings.TrimSpace(line)
+		if state != "" {
+			counts[state]++
+		}
+	}
+	return counts, nil
+}
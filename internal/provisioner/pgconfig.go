@@ -0,0 +1,86 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+var (
+	memorySetting   = regexp.MustCompile(`^[0-9]+(kB|MB|GB)?$`)
+	durationSetting = regexp.MustCompile(`^[0-9]+(us|ms|s|min|h|d)?$`)
+)
+
+// allowedSettings are the Postgres parameters a provision request may set,
+// with the check each value must pass. Anything that can break the server or
+// reach outside the container, such as file paths or preload libraries, is
+// left out on purpose.
+var allowedSettings = map[string]func(string) bool{
+	"max_connections":                     intBetween(1, 10000),
+	"shared_buffers":                      memorySetting.MatchString,
+	"work_mem":                            memorySetting.MatchString,
+	"maintenance_work_mem":                memorySetting.MatchString,
+	"effective_cache_size":                memorySetting.MatchString,
+	"temp_buffers":                        memorySetting.MatchString,
+	"wal_buffers":                         memorySetting.MatchString,
+	"statement_timeout":                   durationSetting.MatchString,
+	"lock_timeout":                        durationSetting.MatchString,
+	"idle_in_transaction_session_timeout": durationSetting.MatchString,
+	"log_min_duration_statement":          func(v string) bool { return v == "-1" || durationSetting.MatchString(v) },
+	"random_page_cost":                    floatBetween(0, 1000),
+	"effective_io_concurrency":            intBetween(0, 1000),
+	"max_parallel_workers_per_gather":     intBetween(0, 64),
+	"default_statistics_target":           intBetween(1, 10000),
+}
+
+func intBetween(lo, hi int64) func(string) bool {
+	return func(v string) bool {
+		n, err := strconv.ParseInt(v, 10, 64)
+		return err == nil && n >= lo && n <= hi
+	}
+}
+
+func floatBetween(lo, hi float64) func(string) bool {
+	return func(v string) bool {
+		n, err := strconv.ParseFloat(v, 64)
+		return err == nil && n >= lo && n <= hi
+	}
+}
+
+func (s *Service) checkPostgresConfig(verr *ValidationError, settings map[string]string, extensions []string) {
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		valid, ok := allowedSettings[name]
+		switch {
+		case !ok:
+			verr.add("settings."+name, "is not an allowed setting")
+		case !valid(settings[name]):
+			verr.add("settings."+name, "has an invalid value %q", settings[name])
+		}
+	}
+	for _, ext := range extensions {
+		if !slices.Contains(s.cfg.TenantDBExtensions, ext) {
+			verr.add("extensions", "%s is not an allowed extension", ext)
+		}
+	}
+}
+
+// settingsArgs returns the settings as postgres -c flags in a stable order.
+func settingsArgs(settings map[string]string) []string {
+	var args []string
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		args = append(args, "-c", name+"="+settings[name])
+	}
+	return args
+}
+
+func (s *Service) createExtensions(ctx context.Context, containerID, dbName string, extensions []string) error {
+	for _, ext := range extensions {
+		if _, err := s.psql(ctx, containerID, dbName, "CREATE EXTENSION IF NOT EXISTS "+quoteIdent(ext)); err != nil {
+			return fmt.Errorf("create extension %s: %w", ext, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/docker"
+	"go-service/internal/logging"
+	"go-service/internal/migrations"
+	"go-service/internal/plans"
+	"go-service/internal/registry"
+	"go-service/internal/tracing"
+)
+
+var (
+	ErrUnknownPlan          = errors.New("unknown plan")
+	ErrPlanRequiresRecreate = errors.New("plan cannot be applied without recreating the tenant container")
+)
+
+type ChangePlanResult struct {
+	Status     string `json:"status"`
+	Tenant     string `json:"tenant"`
+	ResourceID string `json:"resource_id"`
+	Plan       string `json:"plan"`
+	Limits     Limits `json:"limits"`
+}
+
+func WithPlans(catalog *plans.Catalog) Option {
+	return func(s *Service) {
+		s.plans = catalog
+	}
+}
+
+// CheckPlans validates the limits of every plan against the configured
+// bounds, so a bad catalog fails at startup instead of on each provision.
+func (s *Service) CheckPlans() error {
+	if s.plans == nil {
+		return nil
+	}
+	for _, plan := range s.plans.List() {
+		if err := s.validateLimits(planLimits(plan)); err != nil {
+			return fmt.Errorf("plan %s: %w", plan.Name, err)
+		}
+	}
+	return nil
+}
+
+// Plans lists the configured catalog, or nothing if plans are not in use.
+func (s *Service) Plans() []plans.Plan {
+	if s.plans == nil {
+		return []plans.Plan{}
+	}
+	return s.plans.List()
+}
+
+// provisionSpec is what a provision request resolves to once the plan and
+// the caller's overrides are applied.
+type provisionSpec struct {
+	plan           string
+	image          string
+	limits         Limits
+	restartPolicy  string
+	storageQuotaMB *int64
+	isolation      string
+	migrations     *migrations.Bundle
+}
+
+func (spec provisionSpec) migrationBundle() string {
+	if spec.migrations == nil {
+		return ""
+	}
+	return spec.migrations.Name
+}
+
+func (s *Service) resolveSpec(req ProvisionRequest) (provisionSpec, error) {
+	spec := provisionSpec{
+		image:          s.cfg.TenantDBImage,
+		limits:         Limits{MemoryMB: s.cfg.DefaultMemoryMB, CPUCores: s.cfg.DefaultCPUCores},
+		restartPolicy:  s.cfg.TenantDBRestartPolicy,
+		storageQuotaMB: s.cfg.TenantStorageQuotaMB,
+		isolation:      s.cfg.TenantNetworkIsolation,
+	}
+
+	plan, ok, err := s.lookupPlan(req.Plan)
+	if err != nil {
+		return provisionSpec{}, err
+	}
+	verr := &ValidationError{}
+	if ok {
+		spec.plan = plan.Name
+		spec.isolation = plan.Isolation
+		spec.limits = planLimits(plan)
+		if plan.Image != "" {
+			spec.image = plan.Image
+		}
+		if plan.RestartPolicy != "" {
+			spec.restartPolicy = plan.RestartPolicy
+		}
+		if plan.StorageQuotaMB != nil {
+			spec.storageQuotaMB = plan.StorageQuotaMB
+		}
+		if req.Limits != nil {
+			for _, field := range req.Limits.setFields() {
+				if !plan.AllowsOverride(field) {
+					verr.add(field, "is fixed by plan %s", plan.Name)
+				}
+			}
+		}
+		if strings.TrimSpace(req.RestartPolicy) != "" && !plan.AllowsOverride(plans.FieldRestartPolicy) {
+			verr.add(plans.FieldRestartPolicy, "is fixed by plan %s", plan.Name)
+		}
+	}
+
+	if req.Limits != nil {
+		spec.limits = spec.limits.merge(*req.Limits)
+	}
+	if policy := strings.TrimSpace(req.RestartPolicy); policy != "" {
+		spec.restartPolicy = policy
+	}
+	if ok {
+		checkPlanMaxima(verr, plan, spec.limits)
+	}
+	s.checkPostgresConfig(verr, req.Settings, req.Extensions)
+	spec.migrations = s.lookupBundle(verr, req.MigrationBundle)
+	if len(req.AppContainers) > 0 && spec.isolation != plans.IsolationDedicated {
+		verr.add("app_containers", "require dedicated network isolation")
+	}
+	if err := verr.orNil(); err != nil {
+		return provisionSpec{}, err
+	}
+	if spec.restartPolicy != "" && !docker.ValidRestartPolicy(spec.restartPolicy) {
+		return provisionSpec{}, ErrInvalidRestartPolicy
+	}
+	if err := s.validateLimits(spec.limits); err != nil {
+		return provisionSpec{}, err
+	}
+	return spec, nil
+}
+
+// lookupPlan resolves name, falling back to the catalog default. ok is false
+// when no plan applies and the config defaults should be used.
+func (s *Service) lookupPlan(name string) (plans.Plan, bool, error) {
+	name = strings.TrimSpace(name)
+	if s.plans == nil {
+		if name != "" {
+			return plans.Plan{}, false, ErrUnknownPlan
+		}
+		return plans.Plan{}, false, nil
+	}
+	if name == "" {
+		name = s.plans.Default()
+		if name == "" {
+			return plans.Plan{}, false, nil
+		}
+	}
+	plan, ok := s.plans.Get(name)
+	if !ok {
+		return plans.Plan{}, false, ErrUnknownPlan
+	}
+	return plan, true, nil
+}
+
+func planLimits(p plans.Plan) Limits {
+	return Limits{
+		MemoryMB:     p.MemoryMB,
+		CPUCores:     p.CPUCores,
+		MemorySwapMB: p.MemorySwapMB,
+		PidsLimit:    p.PidsLimit,
+		BlkioWeight:  p.BlkioWeight,
+	}
+}
+
+func checkPlanMaxima(verr *ValidationError, p plans.Plan, l Limits) {
+	if p.MaxMemoryMB != nil && l.MemoryMB != nil && *l.MemoryMB > *p.MaxMemoryMB {
+		verr.add(plans.FieldMemoryMB, "must be at most %d on plan %s", *p.MaxMemoryMB, p.Name)
+	}
+	if p.MaxCPUCores != nil && l.CPUCores != nil && *l.CPUCores > *p.MaxCPUCores {
+		verr.add(plans.FieldCPUCores, "must be at most %g on plan %s", *p.MaxCPUCores, p.Name)
+	}
+}
+
+// ChangePlan moves a tenant to another plan in place: the new plan's limits
+// and restart policy are applied with docker update, and limits the plan
+// leaves unset are lifted rather than kept from the old plan. Changes docker
+// cannot apply to a running container are rejected: a different image,
+// network isolation or enforced storage quota, and lifting a memory, CPU or
+// blkio limit.
+func (s *Service) ChangePlan(ctx context.Context, tenantName, planName string) (ChangePlanResult, error) {
+	start := time.Now()
+	tenant := normalizeTenantName(tenantName)
+	ctx, span := s.tracer.Start(ctx, "Service.ChangePlan", trace.WithAttributes(
+		attribute.String("tenant.name", tenant),
+		attribute.String("plan", planName),
+	))
+	ctx = logging.With(ctx, slog.String("tenant", tenant), slog.String("plan", planName))
+	result, err := s.changePlanTracked(ctx, tenant, planName)
+	s.observe("change_plan", start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(
+			ctx, "tenant plan changed",
+			slog.String("resource_id", result.ResourceID),
+			slog.Duration("duration", time.Since(start)),
+		)
+	}
+	return result, err
+}
+
+func (s *Service) changePlanTracked(ctx context.Context, tenant, planName string) (ChangePlanResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	defer done()
+	return s.changePlan(ctx, tenant, planName)
+}
+
+func (s *Service) changePlan(ctx context.Context, tenant, planName string) (ChangePlanResult, error) {
+	if tenant == "" {
+		return ChangePlanResult{}, ErrInvalidTenant
+	}
+	if strings.TrimSpace(planName) == "" {
+		return ChangePlanResult{}, ErrUnknownPlan
+	}
+	plan, _, err := s.lookupPlan(planName)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	limits := planLimits(plan)
+	if err := s.validateLimits(limits); err != nil {
+		return ChangePlanResult{}, err
+	}
+
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	defer release()
+
+	containerName := "tenant-db-" + tenant
+	containerID, err := s.lookupContainerID(ctx, containerName)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	if containerID == "" {
+		return ChangePlanResult{}, ErrTenantNotFound
+	}
+
+	record, _, err := s.registry.Get(tenant)
+	if err != nil {
+		return ChangePlanResult{}, fmt.Errorf("load tenant: %w", err)
+	}
+	image := s.cfg.TenantDBImage
+	if plan.Image != "" {
+		image = plan.Image
+	}
+	if record.Image != "" && record.Image != image {
+		return ChangePlanResult{}, fmt.Errorf("%w: plan uses image %s, upgrade the tenant instead", ErrPlanRequiresRecreate, image)
+	}
+	if record.DedicatedNetwork != (plan.Isolation == plans.IsolationDedicated) {
+		return ChangePlanResult{}, fmt.Errorf("%w: plan uses %s network isolation", ErrPlanRequiresRecreate, plan.Isolation)
+	}
+	quotaMB := s.cfg.TenantStorageQuotaMB
+	if plan.StorageQuotaMB != nil {
+		quotaMB = plan.StorageQuotaMB
+	}
+	if s.cfg.StorageQuotaMode != StorageQuotaNone && !sameQuota(record.StorageQuotaMB, quotaMB) {
+		return ChangePlanResult{}, fmt.Errorf("%w: storage quota is enforced by %s", ErrPlanRequiresRecreate, s.cfg.StorageQuotaMode)
+	}
+	extra, err := liftArgs(Limits(record.Limits), limits)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	restartPolicy := s.cfg.TenantDBRestartPolicy
+	if plan.RestartPolicy != "" {
+		restartPolicy = plan.RestartPolicy
+	}
+	if restartPolicy != "" {
+		extra = append(extra, "--restart", restartPolicy)
+	}
+
+	releaseBudget, err := s.reserveBudget(tenant, limits)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+	defer releaseBudget()
+
+	// The previous limits are not passed on: the swap limit follows the new
+	// memory limit as it would on docker run.
+	applied, err := s.dockerUpdate(ctx, containerID, Limits{}, limits, extra...)
+	if err != nil {
+		return ChangePlanResult{}, err
+	}
+
+	err = s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			t.ResourceID = containerID
+			t.Container = containerName
+			t.Image = image
+			t.DesiredState = registry.StateRunning
+		}
+		t.Plan = plan.Name
+		t.Limits = registry.Limits(applied)
+		t.RestartPolicy = restartPolicy
+		t.StorageQuotaMB = quotaMB
+		return nil
+	})
+	if err != nil {
+		return ChangePlanResult{}, fmt.Errorf("record plan: %w", err)
+	}
+
+	return ChangePlanResult{
+		Status:     "plan_changed",
+		Tenant:     tenant,
+		ResourceID: containerID,
+		Plan:       plan.Name,
+		Limits:     applied,
+	}, nil
+}
+
+// liftArgs returns the docker update flags that remove the limits set in
+// previous but not in target. Docker can only lift the pids limit in place;
+// the swap limit is reset through the memory limit.
+func liftArgs(previous, target Limits) ([]string, error) {
+	var args, fixed []string
+	if previous.PidsLimit != nil && target.PidsLimit == nil {
+		args = append(args, "--pids-limit", "-1")
+	}
+	if previous.MemoryMB != nil && target.MemoryMB == nil {
+		fixed = append(fixed, plans.FieldMemoryMB)
+	}
+	if previous.CPUCores != nil && target.CPUCores == nil {
+		fixed = append(fixed, plans.FieldCPUCores)
+	}
+	if previous.BlkioWeight != nil && target.BlkioWeight == nil {
+		fixed = append(fixed, plans.FieldBlkioWeight)
+	}
+	if len(fixed) > 0 {
+		return nil, fmt.Errorf("%w: plan leaves %s unlimited", ErrPlanRequiresRecreate, strings.Join(fixed, ", "))
+	}
+	return args, nil
+}
+
+func sameQuota(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,149 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-service/internal/registry"
+)
+
+const (
+	PublishHost    = "host"
+	PublishNetwork = "network"
+
+	postgresPort = "5432"
+)
+
+var ErrNoFreePort = errors.New("no free host port left in the configured range")
+
+// maxPortAttempts bounds how many ports a provision tries when docker reports
+// the chosen one already bound by something outside the registry.
+const maxPortAttempts = 5
+
+// portReservations holds ports handed to provisions that have not been
+// recorded in the registry yet.
+type portReservations struct {
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// reservePort picks the host port tenant is published on. A port already
+// recorded for the tenant is kept, so recreating the container does not break
+// stored connection strings; otherwise the lowest port in the range not used
+// by another tenant or listed in skip is taken. It returns 0 when no range is
+// configured and docker should choose. The reservation must be released once
+// the port is recorded in the registry or abandoned.
+func (s *Service) reservePort(tenant string, skip map[int]bool) (int, func(), error) {
+	if s.cfg.PortRangeStart == nil || s.cfg.PortRangeEnd == nil {
+		return 0, func() {}, nil
+	}
+	first, last := *s.cfg.PortRangeStart, *s.cfg.PortRangeEnd
+
+	s.ports.mu.Lock()
+	defer s.ports.mu.Unlock()
+
+	records, err := s.registry.List()
+	if err != nil {
+		return 0, nil, fmt.Errorf("load tenants: %w", err)
+	}
+	used := make(map[int]bool, len(records)+len(s.ports.pending))
+	own := 0
+	for _, record := range records {
+		port, err := strconv.Atoi(record.Port)
+		if err != nil {
+			continue
+		}
+		if record.Name == tenant {
+			own = port
+			continue
+		}
+		used[port] = true
+	}
+	for name, port := range s.ports.pending {
+		if name != tenant {
+			used[port] = true
+		}
+	}
+
+	port := 0
+	if own >= first && own <= last && !used[own] && !skip[own] {
+		port = own
+	} else {
+		for candidate := first; candidate <= last; candidate++ {
+			if !used[candidate] && !skip[candidate] {
+				port = candidate
+				break
+			}
+		}
+	}
+	if port == 0 {
+		return 0, nil, ErrNoFreePort
+	}
+
+	if s.ports.pending == nil {
+		s.ports.pending = make(map[string]int)
+	}
+	s.ports.pending[tenant] = port
+	return port, func() {
+		s.ports.mu.Lock()
+		defer s.ports.mu.Unlock()
+		if s.ports.pending[tenant] == port {
+			delete(s.ports.pending, tenant)
+		}
+	}, nil
+}
+
+// publishArg renders the -p value for port on the configured bind address.
+// Port 0 lets docker choose.
+func (s *Service) publishArg(port int) string {
+	arg := strconv.Itoa(port) + ":" + postgresPort
+	if bind := s.cfg.TenantDBBindAddress; bind != "" {
+		if strings.Contains(bind, ":") {
+			bind = "[" + bind + "]"
+		}
+		arg = bind + ":" + arg
+	}
+	return arg
+}
+
+func (s *Service) publishesPorts() bool {
+	return s.cfg.TenantDBPublish != PublishNetwork
+}
+
+// endpoint returns where clients reach a running tenant: the configured host
+// and the published port, or in network mode the container name and the
+// internal port on the tenant network.
+func (s *Service) endpoint(ctx context.Context, containerName, containerID string) (string, string, error) {
+	if !s.publishesPorts() {
+		return containerName, postgresPort, nil
+	}
+	mapping, err := s.runner.Run(ctx, "port", containerID, postgresPort+"/tcp")
+	if err != nil {
+		return "", "", fmt.Errorf("read published port: %w", err)
+	}
+	port, err := parseDockerPort(mapping)
+	if err != nil {
+		return "", "", err
+	}
+	return s.cfg.TenantDBHost, port, nil
+}
+
+// recordedEndpoint is endpoint for a tenant known to be running, without
+// asking docker.
+func (s *Service) recordedEndpoint(record registry.Tenant) (string, string) {
+	if !s.publishesPorts() {
+		if record.Container == "" {
+			return "tenant-db-" + record.Name, postgresPort
+		}
+		return record.Container, postgresPort
+	}
+	return s.cfg.TenantDBHost, record.Port
+}
+
+func isPortConflict(err error) bool {
+	return strings.Contains(err.Error(), "port is already allocated") || strings.Contains(err.Error(), "address already in use")
+}
@@ -0,0 +1,141 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go-service/internal/registry"
+)
+
+var ErrWakeThrottled = errors.New("tenant failed to wake recently, retry later")
+
+// proxyWakeCooldown is how long the proxy stops waking a tenant after a
+// failed wake, so every reconnecting client does not retry docker start and
+// the readiness wait.
+const proxyWakeCooldown = 30 * time.Second
+
+type wakeFailures struct {
+	mu     sync.Mutex
+	failed map[string]time.Time
+}
+
+func (w *wakeFailures) throttled(tenant string, now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	at, ok := w.failed[tenant]
+	return ok && now.Sub(at) < proxyWakeCooldown
+}
+
+func (w *wakeFailures) record(tenant string, err error, now time.Time) {
+	if err == nil {
+		w.forget(tenant)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed == nil {
+		w.failed = make(map[string]time.Time)
+	}
+	w.failed[tenant] = now
+}
+
+func (w *wakeFailures) forget(tenant string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.failed, tenant)
+}
+
+// ProxyTarget resolves a connection arriving at the embedded Postgres proxy to
+// the tenant container's IP on the tenant network. The first label of the TLS
+// server name picks the tenant when present, otherwise the database name
+// does. Tenants suspended for being idle are woken first; after a failed wake
+// the tenant is not woken again for proxyWakeCooldown.
+func (s *Service) ProxyTarget(ctx context.Context, database, serverName string) (string, error) {
+	record, ok, err := s.proxyTenant(database, serverName)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrTenantNotFound
+	}
+	if record.DesiredState == registry.StateStopped {
+		if s.wakes.throttled(record.Name, time.Now()) {
+			return "", ErrWakeThrottled
+		}
+		_, err := s.WakeTenant(ctx, record.Name)
+		if ctx.Err() == nil && !errors.Is(err, ErrTenantStopped) {
+			s.wakes.record(record.Name, err, time.Now())
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	container := record.Container
+	if container == "" {
+		container = "tenant-db-" + record.Name
+	}
+	ip, err := s.containerIP(ctx, container, record.Network)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip, postgresPort), nil
+}
+
+// containerIP returns the container's address on network, or on any of its
+// networks when it is not attached to that one. The container name only
+// resolves through Docker's DNS from inside the same network; the IP is
+// reachable from any container on it and from the host.
+func (s *Service) containerIP(ctx context.Context, container, network string) (string, error) {
+	out, err := s.runner.Run(ctx, "inspect", "--type", "container", "--format",
+		`{{range $name, $net := .NetworkSettings.Networks}}{{$name}}={{$net.IPAddress}} {{end}}`, container)
+	if err != nil {
+		if isNotFound(err) {
+			return "", ErrTenantNotFound
+		}
+		return "", fmt.Errorf("inspect %s: %w", container, err)
+	}
+	var fallback string
+	for _, field := range strings.Fields(out) {
+		name, ip, _ := strings.Cut(field, "=")
+		if ip == "" {
+			continue
+		}
+		if name == network {
+			return ip, nil
+		}
+		if fallback == "" {
+			fallback = ip
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("container %s has no network address", container)
+	}
+	return fallback, nil
+}
+
+// proxyTenant tries the tenant named by the SNI label first, so a shared
+// hostname without a tenant label still routes by database name.
+func (s *Service) proxyTenant(database, serverName string) (registry.Tenant, bool, error) {
+	var candidates []string
+	if label, _, _ := strings.Cut(serverName, "."); label != "" {
+		candidates = append(candidates, normalizeTenantName(label))
+	}
+	if tenant, ok := strings.CutPrefix(database, s.cfg.TenantDBNamePrefix); ok && tenant != "" {
+		candidates = append(candidates, tenant)
+	}
+	for _, tenant := range candidates {
+		record, ok, err := s.registry.Get(tenant)
+		if err != nil {
+			return registry.Tenant{}, false, fmt.Errorf("load tenant: %w", err)
+		}
+		if ok {
+			return record, true, nil
+		}
+	}
+	return registry.Tenant{}, false, nil
+}
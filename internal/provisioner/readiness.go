@@ -0,0 +1,202 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ReadinessReport struct {
+	Ready     bool             `json:"ready"`
+	CheckedAt time.Time        `json:"checked_at"`
+	Checks    []ReadinessCheck `json:"checks"`
+}
+
+var ErrCapacityExhausted = errors.New("managed container limit reached")
+
+type readinessCache struct {
+	mu     sync.Mutex
+	report *ReadinessReport
+}
+
+// Readiness checks that the service can actually provision: the docker daemon
+// answers. A missing network or image only warns because provisioning creates
+// or pulls them, and capacity is reported but never fails the probe, so
+// deprovisions can still reach the service when it is full. Results are
+// cached for ReadinessCacheTTL so probes do not hammer the daemon.
+func (s *Service) Readiness(ctx context.Context) ReadinessReport {
+	if s.ShuttingDown() {
+		return ReadinessReport{
+			CheckedAt: time.Now(),
+			Checks:    []ReadinessCheck{{Name: "shutdown", Status: CheckFail, Detail: ErrShuttingDown.Error()}},
+		}
+	}
+
+	s.readiness.mu.Lock()
+	cached := s.readiness.report
+	s.readiness.mu.Unlock()
+	if cached != nil && time.Since(cached.CheckedAt) < s.cfg.ReadinessCacheTTL {
+		return *cached
+	}
+
+	report := ReadinessReport{CheckedAt: time.Now()}
+	daemon := s.checkDaemon(ctx)
+	report.Checks = append(report.Checks, daemon)
+	if daemon.Status == CheckOK {
+		report.Checks = append(report.Checks, s.checkNetwork(ctx))
+		report.Checks = append(report.Checks, s.checkImages(ctx)...)
+		report.Checks = append(report.Checks, s.checkCapacity(ctx))
+	}
+	report.Checks = append(report.Checks, s.checkQueue())
+
+	report.Ready = true
+	for _, check := range report.Checks {
+		if check.Status == CheckFail {
+			report.Ready = false
+		}
+	}
+	s.readiness.mu.Lock()
+	s.readiness.report = &report
+	s.readiness.mu.Unlock()
+	return report
+}
+
+func (s *Service) checkDaemon(ctx context.Context) ReadinessCheck {
+	out, err := s.runner.Run(ctx, "version", "--format", "{{.Server.Version}}")
+	if err != nil {
+		return ReadinessCheck{Name: "docker_daemon", Status: CheckFail, Detail: err.Error()}
+	}
+	return ReadinessCheck{Name: "docker_daemon", Status: CheckOK, Detail: "server " + strings.TrimSpace(out)}
+}
+
+func (s *Service) checkNetwork(ctx context.Context) ReadinessCheck {
+	if _, err := s.runner.Run(ctx, "network", "inspect", s.cfg.TenantDBNetwork); err != nil {
+		return ReadinessCheck{Name: "network", Status: CheckWarn, Detail: "network " + s.cfg.TenantDBNetwork + " not found, it will be created on provision"}
+	}
+	return ReadinessCheck{Name: "network", Status: CheckOK, Detail: s.cfg.TenantDBNetwork}
+}
+
+// checkImages checks the default image and every image a plan overrides it
+// with.
+func (s *Service) checkImages(ctx context.Context) []ReadinessCheck {
+	images := []string{s.cfg.TenantDBImage}
+	if s.plans != nil {
+		for _, plan := range s.plans.List() {
+			if plan.Image != "" && !slices.Contains(images, plan.Image) {
+				images = append(images, plan.Image)
+			}
+		}
+	}
+	checks := make([]ReadinessCheck, 0, len(images))
+	for _, image := range images {
+		checks = append(checks, s.checkImage(ctx, image))
+	}
+	return checks
+}
+
+func (s *Service) checkImage(ctx context.Context, image string) ReadinessCheck {
+	if _, err := s.runner.Run(ctx, "image", "inspect", "--format", "{{.Id}}", image); err != nil {
+		return ReadinessCheck{Name: "image", Status: CheckWarn, Detail: "image " + image + " not available locally, it will be pulled on provision"}
+	}
+	return ReadinessCheck{Name: "image", Status: CheckOK, Detail: image}
+}
+
+func (s *Service) checkCapacity(ctx context.Context) ReadinessCheck {
+	total, err := s.managedContainers(ctx)
+	if err != nil {
+		return ReadinessCheck{Name: "capacity", Status: CheckWarn, Detail: err.Error()}
+	}
+	if s.cfg.TenantMaxContainers <= 0 {
+		return ReadinessCheck{Name: "capacity", Status: CheckOK, Detail: fmt.Sprintf("%d managed containers, no limit", total)}
+	}
+	detail := fmt.Sprintf("%d/%d managed containers", total, s.cfg.TenantMaxContainers)
+	if total >= s.cfg.TenantMaxContainers {
+		return ReadinessCheck{Name: "capacity", Status: CheckWarn, Detail: detail + ", new provisions are rejected"}
+	}
+	return ReadinessCheck{Name: "capacity", Status: CheckOK, Detail: detail}
+}
+
+func (s *Service) managedContainers(ctx context.Context) (int, error) {
+	states, err := s.ContainerStates(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, n := range states {
+		total += n
+	}
+	return total, nil
+}
+
+// capacityReservations counts provisions that passed the container limit
+// check but whose container may not exist yet.
+type capacityReservations struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// reserveCapacity enforces TENANT_MAX_CONTAINERS for a new tenant container.
+// The reservation must be released once the provision finishes either way.
+func (s *Service) reserveCapacity(ctx context.Context, tenant string) (func(), error) {
+	if s.cfg.TenantMaxContainers <= 0 {
+		return func() {}, nil
+	}
+	containers, err := s.ListManagedContainers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("count managed containers: %w", err)
+	}
+	listed := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		listed[c.Labels["tenant_name"]] = true
+	}
+
+	s.capacity.mu.Lock()
+	defer s.capacity.mu.Unlock()
+	// A reservation whose container is already listed is counted once.
+	total := len(containers)
+	for tenant := range s.capacity.pending {
+		if !listed[tenant] {
+			total++
+		}
+	}
+	if total >= s.cfg.TenantMaxContainers {
+		return nil, ErrCapacityExhausted
+	}
+	if s.capacity.pending == nil {
+		s.capacity.pending = make(map[string]bool)
+	}
+	s.capacity.pending[tenant] = true
+	return func() {
+		s.capacity.mu.Lock()
+		defer s.capacity.mu.Unlock()
+		delete(s.capacity.pending, tenant)
+	}, nil
+}
+
+func (s *Service) checkQueue() ReadinessCheck {
+	if s.queue == nil {
+		return ReadinessCheck{Name: "queue", Status: CheckOK, Detail: "unbounded"}
+	}
+	stats := s.queue.Stats()
+	detail := fmt.Sprintf("%d/%d in flight, %d/%d queued", stats.InFlight, stats.MaxConcurrent, stats.Queued, stats.MaxQueued)
+	if stats.InFlight >= stats.MaxConcurrent && stats.Queued >= stats.MaxQueued {
+		return ReadinessCheck{Name: "queue", Status: CheckWarn, Detail: detail}
+	}
+	return ReadinessCheck{Name: "queue", Status: CheckOK, Detail: detail}
+}
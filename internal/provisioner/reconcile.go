@@ -0,0 +1,409 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"go-service/internal/registry"
+)
+
+const (
+	ReconcileReport = "report"
+	ReconcileRepair = "repair"
+
+	FindingOrphan           = "orphan"
+	FindingStopped          = "stopped"
+	FindingMissingContainer = "missing_container"
+	FindingMissingNetwork   = "missing_network"
+	FindingLabelDrift       = "label_drift"
+
+	createdAtLayout = "2006-01-02 15:04:05 -0700 MST"
+)
+
+type ManagedContainer struct {
+	ID        string
+	Name      string
+	State     string
+	Labels    map[string]string
+	CreatedAt time.Time
+}
+
+type Finding struct {
+	Kind       string `json:"kind"`
+	Tenant     string `json:"tenant,omitempty"`
+	ResourceID string `json:"resource_id,omitempty"`
+	Detail     string `json:"detail"`
+	Action     string `json:"action"`
+}
+
+type ReconcileResult struct {
+	Policy     string    `json:"policy"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Findings   []Finding `json:"findings"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Reconcile compares managed containers with the registry. With the report
+// policy it only lists drift; with repair it restarts containers that should
+// be running, recreates the shared and dedicated tenant networks and removes
+// orphans older than the grace period (younger ones may belong to a provision
+// in flight). A run counts as an in-flight operation for Shutdown.
+func (s *Service) Reconcile(ctx context.Context, policy string) (result ReconcileResult) {
+	result = ReconcileResult{Policy: policy, StartedAt: time.Now().UTC(), Findings: []Finding{}}
+	defer func() { result.FinishedAt = time.Now().UTC() }()
+	repair := policy == ReconcileRepair
+
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer done()
+
+	containers, err := s.ListManagedContainers(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	records, err := s.registry.List()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if _, err := s.runner.Run(ctx, "network", "inspect", s.cfg.TenantDBNetwork); err != nil {
+		f := Finding{Kind: FindingMissingNetwork, Detail: "network " + s.cfg.TenantDBNetwork + " does not exist", Action: "reported"}
+		if repair {
+			f.Action = actionResult("recreated", s.ensureNetwork(ctx))
+		}
+		result.Findings = append(result.Findings, f)
+	}
+	for _, r := range records {
+		if !r.DedicatedNetwork {
+			continue
+		}
+		if _, err := s.runner.Run(ctx, "network", "inspect", r.Network); err != nil {
+			f := Finding{Kind: FindingMissingNetwork, Tenant: r.Name, Detail: "network " + r.Network + " does not exist", Action: "reported"}
+			if repair {
+				f.Action = actionResult("recreated", s.repairTenantNetwork(ctx, r.Name))
+			}
+			result.Findings = append(result.Findings, f)
+		}
+	}
+
+	recordsByName := make(map[string]registry.Tenant, len(records))
+	for _, r := range records {
+		recordsByName[r.Name] = r
+	}
+	seen := make(map[string]bool, len(containers))
+
+	for _, c := range containers {
+		tenant := c.Labels["tenant_name"]
+		if tenant == "" {
+			tenant = strings.TrimPrefix(c.Name, "tenant-db-")
+		}
+		seen[tenant] = true
+
+		if c.Name != "tenant-db-"+tenant {
+			result.Findings = append(result.Findings, Finding{
+				Kind: FindingLabelDrift, Tenant: tenant, ResourceID: c.ID, Action: "reported",
+				Detail: fmt.Sprintf("container %s carries tenant_name=%s", c.Name, tenant),
+			})
+		}
+
+		record, known := recordsByName[tenant]
+		if !known {
+			age := time.Since(c.CreatedAt)
+			if !c.CreatedAt.IsZero() && age < s.cfg.ReconcileOrphanGrace {
+				continue
+			}
+			f := Finding{
+				Kind: FindingOrphan, Tenant: tenant, ResourceID: c.ID, Action: "reported",
+				Detail: "managed container has no registry record",
+			}
+			if repair {
+				f.Action = actionResult("removed", s.removeOrphan(ctx, tenant, c.ID))
+			}
+			result.Findings = append(result.Findings, f)
+			continue
+		}
+
+		if record.ResourceID != "" && record.ResourceID != c.ID {
+			result.Findings = append(result.Findings, Finding{
+				Kind: FindingLabelDrift, Tenant: tenant, ResourceID: c.ID, Action: "reported",
+				Detail: "registry expects resource " + record.ResourceID,
+			})
+		}
+		if record.TenantID != c.Labels["tenant_id"] {
+			result.Findings = append(result.Findings, Finding{
+				Kind: FindingLabelDrift, Tenant: tenant, ResourceID: c.ID, Action: "reported",
+				Detail: fmt.Sprintf("tenant_id label %q differs from registry %q", c.Labels["tenant_id"], record.TenantID),
+			})
+		}
+
+		if record.DesiredState != registry.StateStopped && c.State != "running" && c.State != "restarting" {
+			f := Finding{
+				Kind: FindingStopped, Tenant: tenant, ResourceID: c.ID, Action: "reported",
+				Detail: "container is " + c.State + ", expected running",
+			}
+			if repair {
+				restarted, err := s.restartStopped(ctx, tenant, c.ID)
+				f.Action = actionResult("restarted", err)
+				if err == nil && !restarted {
+					f.Action = "skipped"
+				}
+			}
+			result.Findings = append(result.Findings, f)
+		}
+	}
+
+	for _, r := range records {
+		if !seen[r.Name] {
+			result.Findings = append(result.Findings, Finding{
+				Kind: FindingMissingContainer, Tenant: r.Name, ResourceID: r.ResourceID, Action: "reported",
+				Detail: "registry record has no container",
+			})
+		}
+	}
+
+	for _, f := range result.Findings {
+		slog.InfoContext(ctx, "reconcile finding",
+			slog.String("kind", f.Kind),
+			slog.String("tenant", f.Tenant),
+			slog.String("resource_id", f.ResourceID),
+			slog.String("action", f.Action),
+		)
+	}
+	return result
+}
+
+func (s *Service) ListManagedContainers(ctx context.Context) ([]ManagedContainer, error) {
+	out, err := s.runner.Run(
+		ctx,
+		"ps", "-a", "--no-trunc",
+		"--filter", "label="+managedByLabel,
+		"--format", "{{.ID}}\t{{.Names}}\t{{.State}}\t{{.CreatedAt}}\t{{.Labels}}",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []ManagedContainer
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 5)
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		createdAt, _ := time.Parse(createdAtLayout, strings.TrimSpace(fields[3]))
+		containers = append(containers, ManagedContainer{
+			ID:        strings.TrimSpace(fields[0]),
+			Name:      strings.TrimSpace(fields[1]),
+			State:     strings.TrimSpace(fields[2]),
+			CreatedAt: createdAt,
+			Labels:    parseLabels(fields[4]),
+		})
+	}
+	return containers, nil
+}
+
+// SeedRegistry records every existing managed container. It is used once,
+// when the registry file is first created, so containers provisioned before
+// the registry existed are not mistaken for orphans. The data volume, network
+// and published port are read back from the container.
+func (s *Service) SeedRegistry(ctx context.Context) (int, error) {
+	containers, err := s.ListManagedContainers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	seeded := 0
+	for _, c := range containers {
+		tenant := c.Labels["tenant_name"]
+		if tenant == "" {
+			continue
+		}
+		_, exists, err := s.registry.Get(tenant)
+		if err != nil {
+			return seeded, err
+		}
+		if exists {
+			continue
+		}
+		record, err := s.inspectTenant(ctx, tenant, c)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return seeded, fmt.Errorf("inspect %s: %w", c.Name, err)
+		}
+		err = s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+			if exists {
+				return nil
+			}
+			*t = record
+			seeded++
+			return nil
+		})
+		if err != nil {
+			return seeded, err
+		}
+	}
+	return seeded, nil
+}
+
+// seedInspectFormat prints the image, the named volume on the data
+// directory, the networks and the published Postgres port of a container.
+const seedInspectFormat = `{{.Config.Image}}` +
+	`	{{range .Mounts}}{{if and (eq .Type "volume") (eq .Destination "` + pgDataDir + `")}}{{.Name}}{{end}}{{end}}` +
+	`	{{range $name, $_ := .NetworkSettings.Networks}}{{$name}} {{end}}` +
+	`	{{range $port, $bindings := .HostConfig.PortBindings}}{{if eq $port "` + postgresPort + `/tcp"}}{{range $bindings}}{{.HostPort}}{{end}}{{end}}{{end}}`
+
+// inspectTenant rebuilds a registry record from a running tenant container.
+func (s *Service) inspectTenant(ctx context.Context, tenant string, c ManagedContainer) (registry.Tenant, error) {
+	out, err := s.runner.Run(ctx, "inspect", "--type", "container", "--format", seedInspectFormat, c.ID)
+	if err != nil {
+		return registry.Tenant{}, err
+	}
+	fields := strings.SplitN(strings.TrimSpace(out), "\t", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	record := registry.Tenant{
+		Name:           tenant,
+		TenantID:       c.Labels["tenant_id"],
+		ResourceID:     c.ID,
+		Container:      c.Name,
+		Network:        s.cfg.TenantDBNetwork,
+		Image:          strings.TrimSpace(fields[0]),
+		Plan:           c.Labels["plan"],
+		StorageQuotaMB: s.cfg.TenantStorageQuotaMB,
+		DesiredState:   registry.StateRunning,
+		CreatedAt:      c.CreatedAt,
+	}
+	if record.Image == "" {
+		record.Image = s.cfg.TenantDBImage
+	}
+	if volume := strings.TrimSpace(fields[1]); volume == volumeName(tenant) {
+		record.Volume = volume
+	}
+	if slices.Contains(strings.Fields(fields[2]), tenantNetworkName(tenant)) {
+		record.Network = tenantNetworkName(tenant)
+		record.DedicatedNetwork = true
+	}
+	if s.publishesPorts() {
+		record.Port = strings.TrimSpace(fields[3])
+	}
+	if record.Plan != "" && s.plans != nil {
+		if plan, ok := s.plans.Get(record.Plan); ok && plan.StorageQuotaMB != nil {
+			record.StorageQuotaMB = plan.StorageQuotaMB
+		}
+	}
+	return record, nil
+}
+
+func (s *Service) removeOrphan(ctx context.Context, tenant, resourceID string) error {
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, known, err := s.registry.Get(tenant); err != nil {
+		return err
+	} else if known {
+		return nil
+	}
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.removeContainer(ctx, resourceID)
+}
+
+// restartStopped starts the container unless, by the time the tenant lock is
+// held, an operator stopped the tenant or it was deprovisioned or replaced.
+func (s *Service) restartStopped(ctx context.Context, tenant, resourceID string) (bool, error) {
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return false, err
+	}
+	if !ok || record.DesiredState == registry.StateStopped || (record.ResourceID != "" && record.ResourceID != resourceID) {
+		return false, nil
+	}
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	if _, err := s.runner.Run(ctx, "start", resourceID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// repairTenantNetwork recreates a missing dedicated network and reconnects
+// the tenant container and its application containers to it.
+func (s *Service) repairTenantNetwork(ctx context.Context, tenant string) error {
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil || !ok {
+		return err
+	}
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := s.ensureTenantNetwork(ctx, tenant); err != nil {
+		return err
+	}
+	container := record.Container
+	if container == "" {
+		container = record.ResourceID
+	}
+	for _, member := range append([]string{container}, record.AppContainers...) {
+		if err := s.connectNetwork(ctx, record.Network, member); err != nil {
+			return fmt.Errorf("attach %s: %w", member, err)
+		}
+	}
+	return nil
+}
+
+func actionResult(action string, err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	return action
+}
+
+func parseLabels(raw string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSpace(raw), ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if ok {
+			labels[k] = v
+		}
+	}
+	return labels
+}
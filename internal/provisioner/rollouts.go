@@ -0,0 +1,164 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/logging"
+	"go-service/internal/rollout"
+	"go-service/internal/tracing"
+)
+
+type MigrationRolloutRequest struct {
+	Bundle  string `json:"bundle"`
+	Version string `json:"version,omitempty"`
+	// CanaryTenants pick the canary explicitly; otherwise the first Canary
+	// tenants by name are used.
+	CanaryTenants []string `json:"canary_tenants,omitempty"`
+	rollout.Options
+}
+
+func (s *Service) Operations() []rollout.Operation {
+	return s.rollouts.List()
+}
+
+func (s *Service) Operation(id string) (rollout.Operation, bool) {
+	return s.rollouts.Get(id)
+}
+
+// StartMigrationRollout validates req and starts applying the bundle, up to
+// req.Version, to every tenant provisioned with it. Progress is reported
+// through the returned operation.
+func (s *Service) StartMigrationRollout(ctx context.Context, req MigrationRolloutRequest) (rollout.Operation, error) {
+	ctx, span := s.tracer.Start(ctx, "Service.StartMigrationRollout", trace.WithAttributes(
+		attribute.String("migration.bundle", req.Bundle),
+		attribute.String("migration.version", req.Version),
+	))
+	ctx = logging.With(ctx, slog.String("bundle", req.Bundle), slog.String("version", req.Version))
+	op, err := s.startMigrationRollout(ctx, req)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(ctx, "migration rollout started", slog.String("operation_id", op.ID), slog.Int("tenants", op.Total))
+	}
+	return op, err
+}
+
+func (s *Service) startMigrationRollout(ctx context.Context, req MigrationRolloutRequest) (rollout.Operation, error) {
+	verr := &ValidationError{}
+	req.Bundle = strings.TrimSpace(req.Bundle)
+	bundleOK := false
+	if req.Bundle == "" {
+		verr.add("bundle", "is required")
+	} else if s.migrations != nil {
+		if bundle, ok := s.migrations.Get(req.Bundle); ok {
+			bundleOK = true
+			if req.Version != "" && !slices.Contains(bundle.Versions(), req.Version) {
+				verr.add("version", "%s is not a version of bundle %s", req.Version, req.Bundle)
+			}
+		}
+	}
+	if req.Bundle != "" && !bundleOK {
+		verr.add("bundle", "%s is not a registered bundle", req.Bundle)
+	}
+
+	records, err := s.registry.List()
+	if err != nil {
+		return rollout.Operation{}, fmt.Errorf("load tenants: %w", err)
+	}
+	var tenants []string
+	for _, record := range records {
+		if record.MigrationBundle == req.Bundle {
+			tenants = append(tenants, record.Name)
+		}
+	}
+	slices.Sort(tenants)
+	tenants, opts, err := rolloutOrder(verr, tenants, req.CanaryTenants, req.Options)
+	if err != nil {
+		return rollout.Operation{}, err
+	}
+
+	start := time.Now()
+	step := func(ctx context.Context, tenant string) (string, error) {
+		ctx, done, err := s.beginOperation(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer done()
+		outcome := s.migrateTenant(logging.With(ctx, slog.String("tenant", tenant)), tenant, req.Bundle, req.Version)
+		switch outcome.Status {
+		case MigrationFailed:
+			return strings.Join(outcome.Applied, ","), errors.New(outcome.Error)
+		case MigrationSkipped:
+			return outcome.Error, rollout.ErrSkipped
+		case MigrationUpToDate:
+			return "up to date", nil
+		}
+		return "applied " + strings.Join(outcome.Applied, ","), nil
+	}
+	finish := func(op rollout.Operation) {
+		s.finishRollout(ctx, op, start)
+	}
+	return s.rollouts.Start(ctx, "migration", tenants, opts, step, finish), nil
+}
+
+// rolloutOrder checks the rollout options and returns tenants with the
+// explicit canary tenants moved to the front.
+func rolloutOrder(verr *ValidationError, tenants, canary []string, opts rollout.Options) ([]string, rollout.Options, error) {
+	if opts.Canary < 0 {
+		verr.add("canary", "must not be negative")
+	}
+	if opts.BatchSize < 0 {
+		verr.add("batch_size", "must not be negative")
+	}
+	if opts.Parallelism < 0 {
+		verr.add("parallelism", "must not be negative")
+	}
+	for i, name := range canary {
+		if !slices.Contains(tenants, name) {
+			verr.add("canary_tenants", "%s is not part of the rollout", name)
+		} else if slices.Contains(canary[:i], name) {
+			verr.add("canary_tenants", "%s is listed twice", name)
+		}
+	}
+	if err := verr.orNil(); err != nil {
+		return nil, rollout.Options{}, err
+	}
+	if len(canary) == 0 {
+		return tenants, opts, nil
+	}
+	ordered := slices.Clone(canary)
+	for _, name := range tenants {
+		if !slices.Contains(canary, name) {
+			ordered = append(ordered, name)
+		}
+	}
+	opts.Canary = len(canary)
+	return ordered, opts, nil
+}
+
+func (s *Service) finishRollout(ctx context.Context, op rollout.Operation, start time.Time) {
+	var err error
+	if op.Status == rollout.StatusFailed {
+		err = errors.New(op.Error)
+	}
+	s.observe(op.Kind+"_rollout", start, err)
+	attrs := []any{
+		slog.String("operation_id", op.ID),
+		slog.Int("succeeded", op.Succeeded),
+		slog.Int("failed", op.Failed),
+		slog.Int("skipped", op.Skipped),
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "rollout stopped", append(attrs, slog.String("error", op.Error))...)
+		return
+	}
+	slog.InfoContext(ctx, "rollout finished", attrs...)
+}
@@ -5,14 +5,37 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/certs"
 	"go-service/internal/config"
+	"go-service/internal/logging"
+	"go-service/internal/migrations"
+	"go-service/internal/plans"
+	"go-service/internal/registry"
+	"go-service/internal/rollout"
+	"go-service/internal/tenantlock"
+	"go-service/internal/tracing"
+	"go-service/internal/workqueue"
+)
+
+const (
+	managedByLabel    = "managed_by=iam-provisioner"
+	readyPollInterval = 500 * time.Millisecond
+	// requiredReadyTimeout bounds the wait for steps that need a live
+	// database when TENANT_DB_READY_TIMEOUT_SECONDS is 0.
+	requiredReadyTimeout = time.Minute
 )
 
 var (
 	invalidTenantChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	nameConflictID     = regexp.MustCompile(`is already in use by container "([0-9a-fA-F]+)"`)
 	ErrInvalidTenant   = errors.New("invalid tenant_name")
 	ErrInvalidResource = errors.New("resource_id is required")
 )
@@ -28,22 +51,56 @@ func (e *ErrAlreadyProvisioned) Error() string {
 
 type DockerRunner interface {
 	Run(ctx context.Context, args ...string) (string, error)
+	RunInput(ctx context.Context, input string, args ...string) (string, error)
 }
 
 type Service struct {
-	runner DockerRunner
-	cfg    config.Config
+	runner     DockerRunner
+	cfg        config.Config
+	locker     tenantlock.Locker
+	queue      *workqueue.Queue
+	observer   Observer
+	tracer     trace.Tracer
+	readiness  readinessCache
+	lifecycle  *lifecycle
+	registry   *registry.Store
+	crashLoops crashTracker
+	budget     budgetReservations
+	capacity   capacityReservations
+	plans      *plans.Catalog
+	storage    storageUsages
+	idle       idleTracker
+	wakes      wakeFailures
+	ports      portReservations
+	ca         *certs.Authority
+	migrations *migrations.Set
+	rollouts   *rollout.Manager
 }
 
+type Option func(*Service)
+
 type Limits struct {
-	MemoryMB *int64   `json:"memory_mb,omitempty"`
-	CPUCores *float64 `json:"cpu_cores,omitempty"`
+	MemoryMB     *int64   `json:"memory_mb,omitempty"`
+	CPUCores     *float64 `json:"cpu_cores,omitempty"`
+	MemorySwapMB *int64   `json:"memory_swap_mb,omitempty"`
+	PidsLimit    *int64   `json:"pids_limit,omitempty"`
+	BlkioWeight  *int64   `json:"blkio_weight,omitempty"`
 }
 
 type ProvisionRequest struct {
-	TenantName string  `json:"tenant_name"`
-	TenantID   string  `json:"tenant_id,omitempty"`
-	Limits     *Limits `json:"limits,omitempty"`
+	TenantName    string  `json:"tenant_name"`
+	TenantID      string  `json:"tenant_id,omitempty"`
+	Limits        *Limits `json:"limits,omitempty"`
+	RestartPolicy string  `json:"restart_policy,omitempty"`
+	Plan          string  `json:"plan,omitempty"`
+	// AppContainers are connected to the tenant's dedicated network.
+	AppContainers []string `json:"app_containers,omitempty"`
+	// Settings are Postgres parameters passed to the server as -c flags.
+	Settings   map[string]string `json:"settings,omitempty"`
+	Extensions []string          `json:"extensions,omitempty"`
+	// MigrationBundle names a bundle from MIGRATION_BUNDLES to apply once
+	// the database is ready; MIGRATION_DEFAULT_BUNDLE applies when empty.
+	MigrationBundle string `json:"migration_bundle,omitempty"`
 }
 
 type ProvisionResult struct {
@@ -51,13 +108,81 @@ type ProvisionResult struct {
 	ResourceID       string `json:"resource_id"`
 	ConnectionString string `json:"connection_string"`
 	DBSecretPath     string `json:"db_secret_path"`
+	Plan             string `json:"plan,omitempty"`
+}
+
+func NewService(runner DockerRunner, cfg config.Config, opts ...Option) *Service {
+	s := &Service{
+		runner:    runner,
+		cfg:       cfg,
+		locker:    tenantlock.NewMemoryLocker(),
+		tracer:    tracing.Tracer("go-service/internal/provisioner"),
+		lifecycle: newLifecycle(),
+		registry:  registry.NewMemoryStore(),
+		rollouts:  rollout.NewManager(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func WithLocker(locker tenantlock.Locker) Option {
+	return func(s *Service) {
+		s.locker = locker
+	}
 }
 
-func NewService(runner DockerRunner, cfg config.Config) *Service {
-	return &Service{runner: runner, cfg: cfg}
+func WithQueue(queue *workqueue.Queue) Option {
+	return func(s *Service) {
+		s.queue = queue
+	}
+}
+
+func WithObserver(observer Observer) Option {
+	return func(s *Service) {
+		s.observer = observer
+	}
+}
+
+func WithRegistry(store *registry.Store) Option {
+	return func(s *Service) {
+		s.registry = store
+	}
 }
 
 func (s *Service) ProvisionTenant(ctx context.Context, req ProvisionRequest) (ProvisionResult, error) {
+	start := time.Now()
+	tenant := normalizeTenantName(req.TenantName)
+	tenantID := strings.TrimSpace(req.TenantID)
+	ctx, span := s.tracer.Start(ctx, "Service.ProvisionTenant", trace.WithAttributes(
+		attribute.String("tenant.name", tenant),
+		attribute.String("tenant.id", tenantID),
+	))
+	ctx = logging.With(ctx, slog.String("tenant", tenant), slog.String("tenant_id", tenantID))
+	result, err := s.provisionTracked(ctx, req)
+	s.observe("provision", start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(
+			ctx, "tenant provisioned",
+			slog.String("resource_id", result.ResourceID),
+			slog.Duration("duration", time.Since(start)),
+		)
+	}
+	return result, err
+}
+
+func (s *Service) provisionTracked(ctx context.Context, req ProvisionRequest) (ProvisionResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	defer done()
+	return s.provisionTenant(ctx, req)
+}
+
+func (s *Service) provisionTenant(ctx context.Context, req ProvisionRequest) (ProvisionResult, error) {
 	tenantName := strings.TrimSpace(req.TenantName)
 	tenantID := strings.TrimSpace(req.TenantID)
 	safeTenantName := normalizeTenantName(tenantName)
@@ -65,8 +190,30 @@ func (s *Service) ProvisionTenant(ctx context.Context, req ProvisionRequest) (Pr
 		return ProvisionResult{}, ErrInvalidTenant
 	}
 
+	spec, err := s.resolveSpec(req)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+
+	unlock, err := s.lockTenant(ctx, safeTenantName)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	defer release()
+
 	containerName := "tenant-db-" + safeTenantName
-	existingResourceID, err := s.lookupContainerID(ctx, containerName)
+	var existingResourceID string
+	err = s.step(ctx, "lookup", func(ctx context.Context) error {
+		var err error
+		existingResourceID, err = s.lookupContainerID(ctx, containerName)
+		return err
+	})
 	if err != nil {
 		return ProvisionResult{}, err
 	}
@@ -77,11 +224,59 @@ func (s *Service) ProvisionTenant(ctx context.Context, req ProvisionRequest) (Pr
 		}
 	}
 
-	if err := s.ensureNetwork(ctx); err != nil {
+	releaseCapacity, err := s.reserveCapacity(ctx, safeTenantName)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	defer releaseCapacity()
+
+	releaseBudget, err := s.reserveBudget(safeTenantName, spec.limits)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	defer releaseBudget()
+
+	hostPort, releasePort := 0, func() {}
+	if s.publishesPorts() {
+		hostPort, releasePort, err = s.reservePort(safeTenantName, nil)
+		if err != nil {
+			return ProvisionResult{}, err
+		}
+	}
+	defer func() { releasePort() }()
+
+	provisioned := false
+	dedicated := spec.isolation == plans.IsolationDedicated
+	network := s.networkFor(safeTenantName, spec.isolation)
+	// Only a network this call created is removed on failure; one that was
+	// already there may belong to a tenant that won a name conflict.
+	networkCreated := false
+	defer func() {
+		if !provisioned && networkCreated {
+			if err := s.removeTenantNetwork(context.WithoutCancel(ctx), network, req.AppContainers); err != nil {
+				slog.ErrorContext(ctx, "rollback of tenant network failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+	err = s.step(ctx, "ensure_network", func(ctx context.Context) error {
+		if dedicated {
+			var err error
+			networkCreated, err = s.ensureTenantNetwork(ctx, safeTenantName)
+			return err
+		}
+		return s.ensureNetwork(ctx)
+	})
+	if err != nil {
 		return ProvisionResult{}, err
 	}
 
-	if err := s.pullImage(ctx); err != nil {
+	var imageDigest string
+	err = s.step(ctx, "pull_image", func(ctx context.Context) error {
+		var err error
+		imageDigest, err = s.ensureImage(ctx, spec.image)
+		return err
+	})
+	if err != nil {
 		return ProvisionResult{}, err
 	}
 
@@ -92,83 +287,388 @@ func (s *Service) ProvisionTenant(ctx context.Context, req ProvisionRequest) (Pr
 		return ProvisionResult{}, fmt.Errorf("generate password: %w", err)
 	}
 
-	memoryMB := s.cfg.DefaultMemoryMB
-	cpuCores := s.cfg.DefaultCPUCores
-	if req.Limits != nil {
-		if req.Limits.MemoryMB != nil {
-			memoryMB = req.Limits.MemoryMB
-		}
-		if req.Limits.CPUCores != nil {
-			cpuCores = req.Limits.CPUCores
+	volume := ""
+	if s.cfg.StorageQuotaMode != StorageQuotaStorageOpt {
+		volume = volumeName(safeTenantName)
+		err = s.step(ctx, "create_volume", func(ctx context.Context) error {
+			exists, err := s.volumeExists(ctx, volume)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return ErrVolumeExists
+			}
+			return s.createVolume(ctx, volume, safeTenantName, spec.storageQuotaMB)
+		})
+		if err != nil {
+			return ProvisionResult{}, err
 		}
 	}
 
-	args := []string{
-		"run", "-d",
-		"--name", containerName,
-		"--network", s.cfg.TenantDBNetwork,
-		"--label", "managed_by=iam-provisioner",
-		"--label", "tenant_name=" + safeTenantName,
-		"-e", "POSTGRES_USER=" + s.cfg.TenantDBUser,
-		"-e", "POSTGRES_PASSWORD=" + password,
-		"-e", "POSTGRES_DB=" + dbName,
-		"-p", "0:5432",
-	}
-	if tenantID != "" {
-		args = append(args, "--label", "tenant_id="+tenantID)
+	var certExpiresAt time.Time
+	var cert *certStage
+	if s.ca != nil {
+		err = s.step(ctx, "issue_certificate", func(ctx context.Context) error {
+			var err error
+			cert, certExpiresAt, err = s.stageCertificate(safeTenantName)
+			return err
+		})
+		if err != nil {
+			s.rollback(ctx, "", volume)
+			return ProvisionResult{}, err
+		}
+		defer func() {
+			if !provisioned {
+				if err := cert.discard(); err != nil {
+					slog.ErrorContext(ctx, "rollback of tenant certificate failed", slog.String("error", err.Error()))
+				}
+			}
+		}()
 	}
 
-	if memoryMB != nil && *memoryMB > 0 {
-		args = append(args, "--memory", fmt.Sprintf("%dm", *memoryMB))
-	}
-	if cpuCores != nil && *cpuCores > 0 {
-		args = append(args, "--cpus", fmt.Sprintf("%g", *cpuCores))
+	args, publishAt := s.runArgs(containerConfig{
+		tenant:         safeTenantName,
+		tenantID:       tenantID,
+		network:        network,
+		password:       password,
+		hostPort:       hostPort,
+		restartPolicy:  spec.restartPolicy,
+		plan:           spec.plan,
+		volume:         volume,
+		storageQuotaMB: spec.storageQuotaMB,
+		limits:         spec.limits,
+		image:          spec.image,
+		settings:       req.Settings,
+	})
+
+	// The container installs its certificate as it starts, so it has to be
+	// in place before docker run; discard restores the previous directory if
+	// the run loses a name conflict.
+	if cert != nil {
+		if err := cert.install(); err != nil {
+			s.rollback(ctx, "", volume)
+			return ProvisionResult{}, err
+		}
 	}
 
-	args = append(args, s.cfg.TenantDBImage)
-
-	containerIDRaw, err := s.runner.Run(ctx, args...)
+	var containerIDRaw string
+	err = s.step(ctx, "run", func(ctx context.Context) error {
+		collisions := map[int]bool{}
+		for attempt := 1; ; attempt++ {
+			var err error
+			containerIDRaw, err = s.runner.Run(ctx, args...)
+			if err == nil || hostPort == 0 || !isPortConflict(err) || attempt == maxPortAttempts {
+				return err
+			}
+			slog.WarnContext(ctx, "host port already in use", slog.Int("port", hostPort))
+			// docker creates the container before it fails to bind the port.
+			if err := s.removeContainer(ctx, containerName); err != nil {
+				return err
+			}
+			collisions[hostPort] = true
+			releasePort()
+			hostPort, releasePort, err = s.reservePort(safeTenantName, collisions)
+			if err != nil {
+				releasePort = func() {}
+				return err
+			}
+			args[publishAt] = s.publishArg(hostPort)
+		}
+	})
 	if err != nil {
+		if conflictID, ok := parseNameConflict(err); ok {
+			networkCreated = false
+			return ProvisionResult{}, &ErrAlreadyProvisioned{
+				TenantName: safeTenantName,
+				ResourceID: conflictID,
+			}
+		}
+		// docker may have created the container before failing, as it does
+		// when the port is taken or the run is interrupted.
+		s.rollback(ctx, containerName, volume)
 		return ProvisionResult{}, err
 	}
 	containerID := strings.TrimSpace(containerIDRaw)
+	ctx = logging.With(ctx, slog.String("resource_id", containerID))
 
-	portMapping, err := s.runner.Run(ctx, "port", containerID, "5432/tcp")
+	var host, port string
+	err = s.step(ctx, "port", func(ctx context.Context) error {
+		var err error
+		host, port, err = s.endpoint(ctx, containerName, containerID)
+		return err
+	})
 	if err != nil {
-		_ = s.Deprovision(ctx, containerID)
+		s.rollback(ctx, containerID, volume)
 		return ProvisionResult{}, err
 	}
 
-	port, err := parseDockerPort(portMapping)
+	err = s.step(ctx, "readiness", func(ctx context.Context) error {
+		return s.waitForReady(ctx, containerID, dbName, s.readyTimeout(len(req.Extensions) > 0 || spec.migrations != nil))
+	})
 	if err != nil {
-		_ = s.Deprovision(ctx, containerID)
+		s.rollback(ctx, containerID, volume)
 		return ProvisionResult{}, err
 	}
 
+	if len(req.Extensions) > 0 {
+		err = s.step(ctx, "create_extensions", func(ctx context.Context) error {
+			return s.createExtensions(ctx, containerID, dbName, req.Extensions)
+		})
+		if err != nil {
+			s.rollback(ctx, containerID, volume)
+			return ProvisionResult{}, err
+		}
+	}
+
+	var migrationVersion string
+	if spec.migrations != nil {
+		err = s.step(ctx, "migrate", func(ctx context.Context) error {
+			applied, err := s.applyMigrations(ctx, containerID, dbName, spec.migrations, "")
+			if len(applied) > 0 {
+				migrationVersion = applied[len(applied)-1]
+			}
+			return err
+		})
+		if err != nil {
+			s.rollback(ctx, containerID, volume)
+			return ProvisionResult{}, err
+		}
+	}
+
+	if len(req.AppContainers) > 0 {
+		err = s.step(ctx, "attach_apps", func(ctx context.Context) error {
+			for _, app := range req.AppContainers {
+				if err := s.connectNetwork(ctx, network, app); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			s.rollback(ctx, containerID, volume)
+			return ProvisionResult{}, err
+		}
+	}
+
+	// Only published host ports are recorded; the allocator reads them back.
+	recordedPort := ""
+	if s.publishesPorts() {
+		recordedPort = port
+	}
+	err = s.registry.Put(registry.Tenant{
+		Name:             safeTenantName,
+		TenantID:         tenantID,
+		ResourceID:       containerID,
+		Container:        containerName,
+		Network:          network,
+		DedicatedNetwork: dedicated,
+		Image:            spec.image,
+		ImageDigest:      imageDigest,
+		Plan:             spec.plan,
+		RestartPolicy:    spec.restartPolicy,
+		Limits:           registry.Limits(spec.limits),
+		Volume:           volume,
+		Port:             recordedPort,
+		StorageQuotaMB:   spec.storageQuotaMB,
+		CertExpiresAt:    certExpiresAt,
+		AppContainers:    req.AppContainers,
+		Settings:         req.Settings,
+		Extensions:       req.Extensions,
+		MigrationBundle:  spec.migrationBundle(),
+		MigrationVersion: migrationVersion,
+		DesiredState:     registry.StateRunning,
+	})
+	if err != nil {
+		s.rollback(ctx, containerID, volume)
+		return ProvisionResult{}, fmt.Errorf("record tenant: %w", err)
+	}
+
 	connectionString := fmt.Sprintf(
 		"postgres://%s:%s@%s:%s/%s",
 		s.cfg.TenantDBUser,
 		password,
-		s.cfg.TenantDBHost,
+		host,
 		port,
 		dbName,
 	)
+	if s.ca != nil {
+		connectionString += "?sslmode=verify-full"
+	}
+	provisioned = true
+	if cert != nil {
+		cert.commit()
+	}
 
 	return ProvisionResult{
 		Status:           "provisioned",
 		ResourceID:       containerID,
 		ConnectionString: connectionString,
 		DBSecretPath:     fmt.Sprintf("tenants/%s/db", safeTenantName),
+		Plan:             spec.plan,
 	}, nil
 }
 
 func (s *Service) Deprovision(ctx context.Context, resourceID string) error {
+	start := time.Now()
+	ctx = logging.With(ctx, slog.String("resource_id", strings.TrimSpace(resourceID)))
+	err := s.deprovisionTracked(ctx, resourceID)
+	s.observe("deprovision", start, err)
+	if err == nil {
+		slog.InfoContext(ctx, "resource deprovisioned", slog.Duration("duration", time.Since(start)))
+	}
+	return err
+}
+
+func (s *Service) deprovisionTracked(ctx context.Context, resourceID string) error {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return s.deprovision(ctx, resourceID)
+}
+
+func (s *Service) deprovision(ctx context.Context, resourceID string) error {
 	resourceID = strings.TrimSpace(resourceID)
 	if resourceID == "" {
 		return ErrInvalidResource
 	}
 
-	_, err := s.runner.Run(ctx, "rm", "-f", resourceID)
+	tenantName, err := s.lookupTenantName(ctx, resourceID)
+	if err != nil {
+		return err
+	}
+	if tenantName == "" {
+		if record, ok, err := s.registry.FindByResourceID(resourceID); err == nil && ok {
+			tenantName = record.Name
+		}
+	}
+	lockKey := tenantName
+	if lockKey == "" {
+		lockKey = resourceID
+	} else {
+		ctx = logging.With(ctx, slog.String("tenant", tenantName))
+	}
+	unlock, err := s.lockTenant(ctx, lockKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.removeContainer(ctx, resourceID); err != nil {
+		return err
+	}
+	if tenantName != "" {
+		// The volume and network names follow from the tenant name, so they
+		// are removed even when the record was seeded without them.
+		record, _, err := s.registry.Get(tenantName)
+		if err != nil {
+			return fmt.Errorf("load tenant: %w", err)
+		}
+		volume := record.Volume
+		if volume == "" {
+			volume = volumeName(tenantName)
+		}
+		if err := s.removeVolume(ctx, volume); err != nil {
+			return err
+		}
+		network := tenantNetworkName(tenantName)
+		dedicated := record.DedicatedNetwork
+		if !dedicated {
+			if dedicated, err = s.networkExists(ctx, network); err != nil {
+				return err
+			}
+		}
+		if dedicated {
+			if err := s.removeTenantNetwork(ctx, network, record.AppContainers); err != nil {
+				return fmt.Errorf("remove tenant network: %w", err)
+			}
+		}
+		s.forgetStorageUsage(tenantName)
+		s.wakes.forget(tenantName)
+		if err := s.removeCertificates(tenantName); err != nil {
+			return fmt.Errorf("remove tenant certificate: %w", err)
+		}
+		if err := s.registry.Delete(tenantName); err != nil {
+			return fmt.Errorf("forget tenant: %w", err)
+		}
+	}
+	return nil
+}
+
+// containerConfig is what docker run needs to create a tenant container.
+type containerConfig struct {
+	tenant         string
+	tenantID       string
+	network        string
+	password       string
+	hostPort       int
+	restartPolicy  string
+	plan           string
+	volume         string
+	storageQuotaMB *int64
+	limits         Limits
+	image          string
+	settings       map[string]string
+}
+
+// runArgs returns the docker run arguments for c and the index of the
+// published port argument, or -1 when no port is published. An empty password
+// is left out, for containers started on an initialized volume.
+func (s *Service) runArgs(c containerConfig) ([]string, int) {
+	args := []string{
+		"run", "-d",
+		"--name", "tenant-db-" + c.tenant,
+		"--network", c.network,
+		"--label", managedByLabel,
+		"--label", "tenant_name=" + c.tenant,
+		"-e", "POSTGRES_USER=" + s.cfg.TenantDBUser,
+	}
+	if c.password != "" {
+		args = append(args, "-e", "POSTGRES_PASSWORD="+c.password)
+	}
+	args = append(args, "-e", "POSTGRES_DB="+s.cfg.TenantDBNamePrefix+c.tenant)
+	publishAt := -1
+	if s.publishesPorts() {
+		args = append(args, "-p", s.publishArg(c.hostPort))
+		publishAt = len(args) - 1
+	}
+	if c.tenantID != "" {
+		args = append(args, "--label", "tenant_id="+c.tenantID)
+	}
+	if c.restartPolicy != "" {
+		args = append(args, "--restart", c.restartPolicy)
+	}
+	if c.plan != "" {
+		args = append(args, "--label", "plan="+c.plan)
+	}
+
+	args = append(args, s.storageArgs(c.volume, c.storageQuotaMB)...)
+	args = append(args, c.limits.dockerArgs()...)
+	if s.ca != nil {
+		args = append(args, s.tlsRunArgs(c.tenant)...)
+	}
+	args = append(args, c.image)
+	if s.ca != nil {
+		args = append(args, tlsCommand(settingsArgs(c.settings))...)
+	} else if len(c.settings) > 0 {
+		args = append(args, "postgres")
+		args = append(args, settingsArgs(c.settings)...)
+	}
+	return args, publishAt
+}
+
+// removeContainer also drops the container's anonymous volumes: with
+// storage-opt there is no named volume on PGDATA, so the image's declared
+// volume would otherwise be left behind on every remove.
+func (s *Service) removeContainer(ctx context.Context, resourceID string) error {
+	_, err := s.runner.Run(ctx, "rm", "-f", "-v", resourceID)
 	if err != nil {
 		if strings.Contains(err.Error(), "No such container") {
 			return nil
@@ -178,6 +678,84 @@ func (s *Service) Deprovision(ctx context.Context, resourceID string) error {
 	return nil
 }
 
+func (s *Service) step(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx, span := s.tracer.Start(ctx, "provision."+name)
+	err := fn(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+// readyTimeout returns how long to wait for pg_isready, or 0 to skip the wait.
+// Steps that need a live database wait even when readiness is off.
+func (s *Service) readyTimeout(required bool) time.Duration {
+	if s.cfg.TenantDBReadyTimeout <= 0 && required {
+		return requiredReadyTimeout
+	}
+	return s.cfg.TenantDBReadyTimeout
+}
+
+// waitForReady polls pg_isready inside the container. Callers keep their queue
+// slot while it polls, so a slow start counts as an operation in flight.
+func (s *Service) waitForReady(ctx context.Context, containerID, dbName string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := s.runner.Run(
+			ctx,
+			"exec", containerID,
+			"pg_isready", "-h", "127.0.0.1", "-U", s.cfg.TenantDBUser, "-d", dbName,
+		)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("tenant database not ready after %s: %w", timeout, err)
+		}
+	}
+}
+
+// rollback removes a container and volume created by a failed provision;
+// either may be empty. It runs on a context detached from cancellation because
+// the usual reason for the failure is that ctx was cancelled.
+func (s *Service) rollback(ctx context.Context, containerID, volume string) {
+	if containerID != "" {
+		if err := s.removeContainer(context.WithoutCancel(ctx), containerID); err != nil {
+			slog.ErrorContext(ctx, "rollback of partially provisioned container failed", slog.String("error", err.Error()))
+			return
+		}
+	}
+	if volume != "" {
+		if err := s.removeVolume(context.WithoutCancel(ctx), volume); err != nil {
+			slog.ErrorContext(ctx, "rollback of tenant volume failed", slog.String("error", err.Error()))
+			return
+		}
+	}
+	slog.WarnContext(ctx, "rolled back partially provisioned container")
+}
+
+func (s *Service) lockTenant(ctx context.Context, key string) (func(), error) {
+	unlock, err := s.locker.Lock(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("lock tenant %q: %w", key, err)
+	}
+	return unlock, nil
+}
+
+func (s *Service) acquireSlot(ctx context.Context) (func(), error) {
+	if s.queue == nil {
+		return func() {}, nil
+	}
+	return s.queue.Acquire(ctx)
+}
+
 func (s *Service) ensureNetwork(ctx context.Context) error {
 	_, err := s.runner.Run(ctx, "network", "inspect", s.cfg.TenantDBNetwork)
 	if err == nil {
@@ -187,15 +765,31 @@ func (s *Service) ensureNetwork(ctx context.Context) error {
 	return err
 }
 
-func (s *Service) pullImage(ctx context.Context) error {
-	_, err := s.runner.Run(ctx, "pull", s.cfg.TenantDBImage)
+func (s *Service) pullImage(ctx context.Context, image string) error {
+	_, err := s.runner.Run(ctx, "pull", image)
 	return err
 }
 
 func (s *Service) lookupContainerID(ctx context.Context, containerName string) (string, error) {
 	out, err := s.runner.Run(ctx, "inspect", "--type", "container", "--format", "{{.Id}}", containerName)
 	if err != nil {
-		if strings.Contains(err.Error(), "No such object") || strings.Contains(err.Error(), "No such container") {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (s *Service) lookupTenantName(ctx context.Context, resourceID string) (string, error) {
+	out, err := s.runner.Run(
+		ctx,
+		"inspect", "--type", "container",
+		"--format", `{{index .Config.Labels "tenant_name"}}`,
+		resourceID,
+	)
+	if err != nil {
+		if isNotFound(err) {
 			return "", nil
 		}
 		return "", err
@@ -203,6 +797,19 @@ func (s *Service) lookupContainerID(ctx context.Context, containerName string) (
 	return strings.TrimSpace(out), nil
 }
 
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "No such object") || strings.Contains(err.Error(), "No such container") ||
+		strings.Contains(err.Error(), "No such image")
+}
+
+func parseNameConflict(err error) (string, bool) {
+	m := nameConflictID.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
 func normalizeTenantName(tenantName string) string {
 	trimmed := strings.TrimSpace(tenantName)
 	replaced := strings.ReplaceAll(trimmed, "-", "_")
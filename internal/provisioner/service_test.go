@@ -3,10 +3,25 @@ package provisioner
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"go-service/internal/certs"
 	"go-service/internal/config"
+	"go-service/internal/migrations"
+	"go-service/internal/plans"
+	"go-service/internal/registry"
+	"go-service/internal/rollout"
 )
 
 type fakeRunner struct {
@@ -20,6 +35,12 @@ func (f *fakeRunner) Run(_ context.Context, args ...string) (string, error) {
 	return f.handler(args...)
 }
 
+// RunInput records the input as the last argument, where a -c statement
+// would be.
+func (f *fakeRunner) RunInput(ctx context.Context, input string, args ...string) (string, error) {
+	return f.Run(ctx, append(args[:len(args):len(args)], input)...)
+}
+
 func TestNormalizeTenantName(t *testing.T) {
 	cases := []struct {
 		name string
@@ -149,3 +170,2239 @@ func TestProvisionTenantReturnsAlreadyProvisionedConflict(t *testing.T) {
 		}
 	}
 }
+
+func TestProvisionTenantTranslatesNameConflict(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if len(args) >= 1 && args[0] == "inspect" {
+			return "", errors.New("No such object")
+		}
+		if len(args) >= 1 && args[0] == "run" {
+			return "", errors.New(`docker [run] failed: docker: Error response from daemon: Conflict. The container name "/tenant-db-acme" is already in use by container "abc123def456". You have to remove (or rename) that container to be able to reuse that name.`)
+		}
+		return "", nil
+	}
+
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_"})
+
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	var conflictErr *ErrAlreadyProvisioned
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("expected ErrAlreadyProvisioned, got %T (%v)", err, err)
+	}
+	if conflictErr.ResourceID != "abc123def456" {
+		t.Fatalf("resource id = %q, want abc123def456", conflictErr.ResourceID)
+	}
+}
+
+func TestProvisionTenantSerializesSameTenant(t *testing.T) {
+	var mu sync.Mutex
+	created := false
+	runs := 0
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case len(args) >= 1 && args[0] == "inspect":
+			if created {
+				return "container-123\n", nil
+			}
+			return "", errors.New("No such object")
+		case len(args) >= 1 && args[0] == "run":
+			runs++
+			created = true
+			return "container-123\n", nil
+		case len(args) >= 1 && args[0] == "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	svc := NewService(&lockedRunner{next: runner}, config.Config{TenantDBNamePrefix: "tenant_"})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+		}(i)
+	}
+	wg.Wait()
+
+	if runs != 1 {
+		t.Fatalf("docker run calls = %d, want 1", runs)
+	}
+	conflicts := 0
+	for _, err := range errs {
+		var conflictErr *ErrAlreadyProvisioned
+		if errors.As(err, &conflictErr) {
+			conflicts++
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if conflicts != len(errs)-1 {
+		t.Fatalf("conflicts = %d, want %d", conflicts, len(errs)-1)
+	}
+}
+
+type lockedRunner struct {
+	mu   sync.Mutex
+	next *fakeRunner
+}
+
+func (r *lockedRunner) Run(ctx context.Context, args ...string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next.Run(ctx, args...)
+}
+
+func (r *lockedRunner) RunInput(ctx context.Context, input string, args ...string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next.RunInput(ctx, input, args...)
+}
+
+type recordingObserver struct {
+	outcomes []string
+}
+
+func (o *recordingObserver) ObserveOperation(operation, outcome string, _ time.Duration) {
+	o.outcomes = append(o.outcomes, operation+":"+outcome)
+}
+
+func TestServiceObservesOperationOutcomes(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if len(args) >= 1 && args[0] == "inspect" {
+			return "existing-container-id\n", nil
+		}
+		return "", nil
+	}}
+	observer := &recordingObserver{}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_"}, WithObserver(observer))
+
+	_, _ = svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	_, _ = svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "///"})
+	_ = svc.Deprovision(context.Background(), "existing-container-id")
+
+	want := []string{"provision:conflict", "provision:invalid", "deprovision:success"}
+	if strings.Join(observer.outcomes, ",") != strings.Join(want, ",") {
+		t.Fatalf("outcomes = %v, want %v", observer.outcomes, want)
+	}
+}
+
+func TestProvisionTenantRecordsStepSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_", TenantDBReadyTimeout: time.Second})
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := map[string]bool{}
+	for _, span := range exporter.GetSpans() {
+		names[span.Name] = true
+	}
+	for _, want := range []string{
+		"Service.ProvisionTenant",
+		"provision.lookup",
+		"provision.ensure_network",
+		"provision.pull_image",
+		"provision.run",
+		"provision.port",
+		"provision.readiness",
+	} {
+		if !names[want] {
+			t.Fatalf("missing span %q; got %v", want, names)
+		}
+	}
+}
+
+func TestProvisionTenantRollsBackWhenDatabaseNeverReady(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		case "exec":
+			return "", errors.New("no response")
+		}
+		return "", nil
+	}}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_", TenantDBReadyTimeout: 10 * time.Millisecond})
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	removeContainer := runner.calls[len(runner.calls)-2]
+	if strings.Join(removeContainer, " ") != "rm -f -v container-123" {
+		t.Fatalf("call = %v, want rollback rm -f", removeContainer)
+	}
+	last := runner.calls[len(runner.calls)-1]
+	if strings.Join(last, " ") != "volume rm -f tenant-data-acme" {
+		t.Fatalf("last call = %v, want volume removal", last)
+	}
+}
+
+func TestReadinessReportsDaemonFailureAndCaches(t *testing.T) {
+	daemonUp := false
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "version" {
+			if !daemonUp {
+				return "", errors.New("Cannot connect to the Docker daemon")
+			}
+			return "27.1.0", nil
+		}
+		return "", nil
+	}}
+	svc := NewService(runner, config.Config{ReadinessCacheTTL: time.Hour})
+
+	report := svc.Readiness(context.Background())
+	if report.Ready {
+		t.Fatalf("expected not ready, got %+v", report)
+	}
+	if report.Checks[0].Name != "docker_daemon" || report.Checks[0].Status != CheckFail {
+		t.Fatalf("unexpected daemon check: %+v", report.Checks[0])
+	}
+
+	daemonUp = true
+	calls := len(runner.calls)
+	if cached := svc.Readiness(context.Background()); cached.Ready || len(runner.calls) != calls {
+		t.Fatal("expected cached report without new docker calls")
+	}
+}
+
+func TestReadinessCapacityLimit(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "ps" {
+			return "running\nrunning\nexited", nil
+		}
+		return "", nil
+	}}
+	svc := NewService(runner, config.Config{TenantMaxContainers: 3})
+
+	report := svc.Readiness(context.Background())
+	if !report.Ready {
+		t.Fatalf("expected ready at capacity, got %+v", report)
+	}
+	var capacity ReadinessCheck
+	for _, check := range report.Checks {
+		if check.Name == "capacity" {
+			capacity = check
+		}
+	}
+	if capacity.Status != CheckWarn || capacity.Detail != "3/3 managed containers, new provisions are rejected" {
+		t.Fatalf("unexpected capacity check: %+v", capacity)
+	}
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); !errors.Is(err, ErrCapacityExhausted) {
+		t.Fatalf("err = %v, want ErrCapacityExhausted", err)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "run" {
+			t.Fatalf("unexpected docker run at capacity: %v", call)
+		}
+	}
+}
+
+func TestReserveCapacityCountsListedReservationsOnce(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "ps" {
+			return "id-acme\ttenant-db-acme\trunning\t\tmanaged_by=iam-provisioner,tenant_name=acme", nil
+		}
+		return "", nil
+	}}
+	svc := NewService(runner, config.Config{TenantMaxContainers: 2})
+	// acme's provision still holds its reservation, but its container is
+	// already listed by docker ps.
+	svc.capacity.pending = map[string]bool{"acme": true}
+
+	release, err := svc.reserveCapacity(context.Background(), "globex")
+	if err != nil {
+		t.Fatalf("err = %v, want a free slot", err)
+	}
+	defer release()
+	if _, err := svc.reserveCapacity(context.Background(), "initech"); !errors.Is(err, ErrCapacityExhausted) {
+		t.Fatalf("err = %v, want ErrCapacityExhausted", err)
+	}
+}
+
+func TestReadinessChecksPlanImages(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "image" && args[len(args)-1] == "postgres:17" {
+			return "", errors.New("No such image")
+		}
+		return "", nil
+	}}
+	catalog, err := plans.New("", []plans.Plan{{Name: "pro", Image: "postgres:17"}, {Name: "basic"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantDBImage: "postgres:16"}, WithPlans(catalog))
+
+	var images []ReadinessCheck
+	for _, check := range svc.Readiness(context.Background()).Checks {
+		if check.Name == "image" {
+			images = append(images, check)
+		}
+	}
+	if len(images) != 2 || images[0].Status != CheckOK || images[1].Status != CheckWarn {
+		t.Fatalf("image checks = %+v", images)
+	}
+}
+
+type blockingRunner struct {
+	mu      sync.Mutex
+	calls   [][]string
+	started chan struct{}
+}
+
+func (r *blockingRunner) Run(ctx context.Context, args ...string) (string, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, append([]string(nil), args...))
+	r.mu.Unlock()
+	switch args[0] {
+	case "inspect":
+		return "", errors.New("No such object")
+	case "run":
+		close(r.started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return "", nil
+}
+
+func (r *blockingRunner) RunInput(ctx context.Context, _ string, args ...string) (string, error) {
+	return r.Run(ctx, args...)
+}
+
+func TestShutdownCancelsAndRollsBackUnfinishedProvision(t *testing.T) {
+	runner := &blockingRunner{started: make(chan struct{})}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_"})
+
+	provisionErr := make(chan error, 1)
+	go func() {
+		_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+		provisionErr <- err
+	}()
+	<-runner.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := svc.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown err = %v, want deadline exceeded", err)
+	}
+	if err := <-provisionErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("provision err = %v, want context.Canceled", err)
+	}
+
+	runner.mu.Lock()
+	removeContainer := strings.Join(runner.calls[len(runner.calls)-2], " ")
+	last := strings.Join(runner.calls[len(runner.calls)-1], " ")
+	runner.mu.Unlock()
+	if removeContainer != "rm -f -v tenant-db-acme" {
+		t.Fatalf("call = %q, want rollback by container name", removeContainer)
+	}
+	if last != "volume rm -f tenant-data-acme" {
+		t.Fatalf("last call = %q, want volume removal", last)
+	}
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "globex"}); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("err = %v, want ErrShuttingDown after shutdown", err)
+	}
+	if svc.Readiness(context.Background()).Ready {
+		t.Fatal("expected not ready while shutting down")
+	}
+}
+
+func TestShutdownReturnsImmediatelyWhenIdle(t *testing.T) {
+	svc := NewService(&fakeRunner{handler: func(args ...string) (string, error) { return "", nil }}, config.Config{})
+	if err := svc.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown with nothing in flight: %v", err)
+	}
+}
+
+func TestReconcileRepairsDrift(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC().Format(createdAtLayout)
+	fresh := time.Now().UTC().Format(createdAtLayout)
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		switch {
+		case args[0] == "ps":
+			return strings.Join([]string{
+				"id-acme\ttenant-db-acme\texited\t" + old + "\tmanaged_by=iam-provisioner,tenant_name=acme",
+				"id-orphan\ttenant-db-orphan\trunning\t" + old + "\tmanaged_by=iam-provisioner,tenant_name=orphan",
+				"id-young\ttenant-db-young\trunning\t" + fresh + "\tmanaged_by=iam-provisioner,tenant_name=young",
+				"id-paused\ttenant-db-paused\texited\t" + old + "\tmanaged_by=iam-provisioner,tenant_name=paused",
+			}, "\n"), nil
+		case args[0] == "network" && args[1] == "inspect":
+			return "", errors.New("No such network")
+		}
+		return "", nil
+	}}
+	store := registry.NewMemoryStore()
+	_ = store.Put(registry.Tenant{Name: "acme", ResourceID: "id-acme", DesiredState: registry.StateRunning})
+	_ = store.Put(registry.Tenant{Name: "paused", ResourceID: "id-paused", DesiredState: registry.StateStopped})
+	_ = store.Put(registry.Tenant{Name: "gone", ResourceID: "id-gone", DesiredState: registry.StateRunning})
+	svc := NewService(runner, config.Config{
+		TenantDBNetwork:      "auth-tenants",
+		ReconcileOrphanGrace: 10 * time.Minute,
+	}, WithRegistry(store))
+
+	result := svc.Reconcile(context.Background(), ReconcileRepair)
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+
+	got := map[string]string{}
+	for _, f := range result.Findings {
+		got[f.Kind+":"+f.Tenant] = f.Action
+	}
+	want := map[string]string{
+		FindingMissingNetwork + ":":       "recreated",
+		FindingStopped + ":acme":          "restarted",
+		FindingOrphan + ":orphan":         "removed",
+		FindingMissingContainer + ":gone": "reported",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("findings = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("finding %s action = %q, want %q (all: %v)", k, got[k], v, got)
+		}
+	}
+
+	var calls []string
+	for _, call := range runner.calls {
+		calls = append(calls, strings.Join(call, " "))
+	}
+	joined := strings.Join(calls, "\n")
+	for _, want := range []string{"start id-acme", "rm -f -v id-orphan", "network create auth-tenants"} {
+		if !strings.Contains(joined, want) {
+			t.Fatalf("missing docker call %q in:\n%s", want, joined)
+		}
+	}
+	if strings.Contains(joined, "rm -f -v id-young") || strings.Contains(joined, "start id-paused") {
+		t.Fatalf("reconcile touched a young or intentionally stopped container:\n%s", joined)
+	}
+}
+
+func TestReconcileRechecksTenantsUnderLock(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC().Format(createdAtLayout)
+	store := registry.NewMemoryStore()
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		switch {
+		case args[0] == "ps":
+			return "id-acme\ttenant-db-acme\texited\t" + old + "\tmanaged_by=iam-provisioner,tenant_name=acme", nil
+		case args[0] == "network" && args[1] == "inspect" && args[2] == "tenant-net-acme":
+			// An operator stops the tenant after the reconciler took its snapshot.
+			_ = store.Update("acme", func(t *registry.Tenant, _ bool) error {
+				t.DesiredState = registry.StateStopped
+				return nil
+			})
+			return "", errors.New("No such network")
+		}
+		return "", nil
+	}}
+	_ = store.Put(registry.Tenant{Name: "acme", ResourceID: "id-acme", Container: "tenant-db-acme", Network: "tenant-net-acme", DedicatedNetwork: true, DesiredState: registry.StateRunning})
+	svc := NewService(runner, config.Config{TenantDBNetwork: "auth-tenants"}, WithRegistry(store))
+
+	result := svc.Reconcile(context.Background(), ReconcileRepair)
+	got := map[string]string{}
+	for _, f := range result.Findings {
+		got[f.Kind+":"+f.Tenant] = f.Action
+	}
+	if got[FindingMissingNetwork+":acme"] != "recreated" || got[FindingStopped+":acme"] != "skipped" {
+		t.Fatalf("findings = %v", got)
+	}
+	var calls []string
+	for _, call := range runner.calls {
+		calls = append(calls, strings.Join(call, " "))
+	}
+	joined := strings.Join(calls, "\n")
+	if !strings.Contains(joined, "network connect tenant-net-acme tenant-db-acme") || strings.Contains(joined, "start id-acme") {
+		t.Fatalf("unexpected docker calls:\n%s", joined)
+	}
+
+	if err := svc.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if result := svc.Reconcile(context.Background(), ReconcileRepair); result.Error != ErrShuttingDown.Error() {
+		t.Fatalf("error = %q, want shutting down", result.Error)
+	}
+}
+
+func TestReconcileReportPolicyDoesNotMutate(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC().Format(createdAtLayout)
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "ps" {
+			return "id-orphan\ttenant-db-orphan\texited\t" + old + "\tmanaged_by=iam-provisioner,tenant_name=orphan", nil
+		}
+		return "", nil
+	}}
+	svc := NewService(runner, config.Config{})
+
+	result := svc.Reconcile(context.Background(), ReconcileReport)
+	if len(result.Findings) != 1 || result.Findings[0].Action != "reported" {
+		t.Fatalf("unexpected findings: %+v", result.Findings)
+	}
+	if result.FinishedAt.IsZero() || result.FinishedAt.Before(result.StartedAt) {
+		t.Fatalf("finished_at = %s, started_at = %s", result.FinishedAt, result.StartedAt)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "rm" || call[0] == "start" {
+			t.Fatalf("report policy issued mutating call %v", call)
+		}
+	}
+}
+
+func TestDeprovisionForgetsRegistryRecord(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		if args[0] == "inspect" {
+			return "acme", nil
+		}
+		return "", nil
+	}}
+	store := registry.NewMemoryStore()
+	_ = store.Put(registry.Tenant{Name: "acme", ResourceID: "container-123"})
+	svc := NewService(runner, config.Config{}, WithRegistry(store))
+
+	if err := svc.Deprovision(context.Background(), "container-123"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := store.Get("acme"); ok {
+		t.Fatal("expected registry record to be removed")
+	}
+	// The record carried no volume or network, as seeded records do.
+	var calls []string
+	for _, call := range runner.calls {
+		calls = append(calls, strings.Join(call, " "))
+	}
+	for _, want := range []string{"volume rm -f tenant-data-acme", "network rm tenant-net-acme"} {
+		if !slices.Contains(calls, want) {
+			t.Fatalf("missing docker call %q in %q", want, calls)
+		}
+	}
+}
+
+func TestProvisionTenantRejectsExistingVolume(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "volume":
+			if args[1] == "ls" {
+				return "tenant-data-acme-old\ntenant-data-acme\n", nil
+			}
+		}
+		return "", nil
+	}
+	svc := NewService(runner, config.Config{})
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); !errors.Is(err, ErrVolumeExists) {
+		t.Fatalf("err = %v, want ErrVolumeExists", err)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "run" || (call[0] == "volume" && call[1] != "ls") {
+			t.Fatalf("unexpected docker call with an existing volume: %v", call)
+		}
+	}
+}
+
+func TestSeedRegistryReadsVolumeNetworkAndPort(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		switch args[0] {
+		case "ps":
+			return "id-acme\ttenant-db-acme\trunning\t\tmanaged_by=iam-provisioner,tenant_name=acme,plan=pro\n" +
+				"id-globex\ttenant-db-globex\trunning\t\tmanaged_by=iam-provisioner,tenant_name=globex", nil
+		case "inspect":
+			if args[len(args)-1] == "id-acme" {
+				return "postgres:16.4-alpine\ttenant-data-acme\ttenant-net-acme \t55001\n", nil
+			}
+			return "postgres:16.4-alpine\t\ttenant-db \t55002\n", nil
+		}
+		return "", nil
+	}}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{TenantDBNetwork: "tenant-db"}, WithRegistry(store))
+
+	if seeded, err := svc.SeedRegistry(context.Background()); err != nil || seeded != 2 {
+		t.Fatalf("seeded = %d, %v", seeded, err)
+	}
+	acme, _, _ := store.Get("acme")
+	if acme.Volume != "tenant-data-acme" || acme.Network != "tenant-net-acme" || !acme.DedicatedNetwork ||
+		acme.Port != "55001" || acme.Plan != "pro" || acme.Image != "postgres:16.4-alpine" {
+		t.Fatalf("acme = %+v", acme)
+	}
+	globex, _, _ := store.Get("globex")
+	if globex.Volume != "" || globex.Network != "tenant-db" || globex.DedicatedNetwork || globex.Port != "55002" {
+		t.Fatalf("globex = %+v", globex)
+	}
+}
+
+func TestProvisionTenantRestartPolicy(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	svc := NewService(runner, config.Config{TenantDBRestartPolicy: "unless-stopped"})
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme", RestartPolicy: "sometimes"}); !errors.Is(err, ErrInvalidRestartPolicy) {
+		t.Fatalf("err = %v, want ErrInvalidRestartPolicy", err)
+	}
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme", RestartPolicy: "on-failure:5"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "globex"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var policies []string
+	for _, call := range runner.calls {
+		if call[0] != "run" {
+			continue
+		}
+		for i, arg := range call {
+			if arg == "--restart" {
+				policies = append(policies, call[i+1])
+			}
+		}
+	}
+	if strings.Join(policies, ",") != "on-failure:5,unless-stopped" {
+		t.Fatalf("restart policies = %v", policies)
+	}
+}
+
+func TestTenantStatusDetectsCrashLoop(t *testing.T) {
+	restarts := 1
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] != "inspect" {
+			return "", nil
+		}
+		return fmt.Sprintf(`[{"Id":"container-123","Name":"/tenant-db-acme","RestartCount":%d,
+			"State":{"Status":"running","Restarting":false,"StartedAt":"2020-01-01T00:00:00Z"},
+			"Config":{"Labels":{"tenant_name":"acme","tenant_id":"t-1"}},
+			"HostConfig":{"RestartPolicy":{"Name":"on-failure","MaximumRetryCount":10}}}]`, restarts), nil
+	}
+	svc := NewService(runner, config.Config{CrashLoopRestarts: 3, CrashLoopWindow: time.Minute})
+
+	status, err := svc.TenantStatus(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.CrashLooping || status.RestartPolicy != "on-failure:10" || status.TenantID != "t-1" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	restarts = 4
+	status, err = svc.TenantStatus(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !status.CrashLooping || status.RestartCount != 4 {
+		t.Fatalf("expected crash loop, got %+v", status)
+	}
+
+	svc.crashLoops.mu.Lock()
+	svc.crashLoops.samples["removed-container"] = []restartSample{{at: time.Now().Add(-time.Hour)}}
+	svc.crashLoops.mu.Unlock()
+	if _, err := svc.TenantStatus(context.Background(), "acme"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, kept := svc.crashLoops.samples["removed-container"]; kept {
+		t.Fatal("expected samples of a container no longer inspected to be evicted")
+	}
+
+	runner.handler = func(args ...string) (string, error) {
+		return "", errors.New("Error: No such container: tenant-db-ghost")
+	}
+	if _, err := svc.TenantStatus(context.Background(), "ghost"); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("err = %v, want ErrTenantNotFound", err)
+	}
+}
+
+func TestUpdateLimitsAppliesDockerUpdateAndRecordsChange(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] == "inspect" {
+			return "container-123\n", nil
+		}
+		return "", nil
+	}
+	maxMemory := int64(2048)
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{MaxMemoryMB: &maxMemory}, WithRegistry(store))
+
+	tooMuch := int64(4096)
+	if _, err := svc.UpdateLimits(context.Background(), "acme", Limits{MemoryMB: &tooMuch}); !errors.Is(err, ErrInvalidLimits) {
+		t.Fatalf("err = %v, want ErrInvalidLimits", err)
+	}
+	if _, err := svc.UpdateLimits(context.Background(), "acme", Limits{}); !errors.Is(err, ErrInvalidLimits) {
+		t.Fatalf("err = %v, want ErrInvalidLimits", err)
+	}
+
+	memory, pids, cpus := int64(1024), int64(200), 1.5
+	result, err := svc.UpdateLimits(context.Background(), "acme", Limits{MemoryMB: &memory, PidsLimit: &pids, CPUCores: &cpus})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.ResourceID != "container-123" {
+		t.Fatalf("resource_id = %q, want container-123", result.ResourceID)
+	}
+
+	last := strings.Join(runner.calls[len(runner.calls)-1], " ")
+	if last != "update --memory 1024m --memory-swap 2048m --cpus 1.5 --pids-limit 200 container-123" {
+		t.Fatalf("docker update call = %q", last)
+	}
+
+	record, ok, err := store.Get("acme")
+	if err != nil || !ok {
+		t.Fatalf("expected registry record, ok=%v err=%v", ok, err)
+	}
+	if *record.Limits.MemoryMB != 1024 || *record.Limits.PidsLimit != 200 || *record.Limits.MemorySwapMB != 2048 {
+		t.Fatalf("recorded limits = %+v", record.Limits)
+	}
+}
+
+func TestProvisionTenantValidatesLimits(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) {
+		return "", errors.New("unexpected docker call")
+	}}
+	minMemory, maxCPU := int64(128), 2.0
+	svc := NewService(runner, config.Config{MinMemoryMB: &minMemory, MaxCPUCores: &maxCPU})
+
+	memory, cpus, pids := int64(64), 4.0, int64(0)
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{
+		TenantName: "acme",
+		Limits:     &Limits{MemoryMB: &memory, CPUCores: &cpus, PidsLimit: &pids},
+	})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || !errors.Is(err, ErrInvalidLimits) {
+		t.Fatalf("err = %v, want ValidationError", err)
+	}
+	var fields []string
+	for _, f := range validation.Fields {
+		fields = append(fields, f.Field)
+	}
+	if strings.Join(fields, ",") != "memory_mb,cpu_cores,pids_limit" {
+		t.Fatalf("fields = %v", fields)
+	}
+	if len(runner.calls) != 0 {
+		t.Fatalf("docker called %d times for invalid request", len(runner.calls))
+	}
+}
+
+func TestProvisionTenantEnforcesMemoryBudget(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-" + args[3] + "\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	budget, defaultMemory := int64(1024), int64(512)
+	svc := NewService(runner, config.Config{MemoryBudgetMB: &budget, DefaultMemoryMB: &defaultMemory})
+
+	for _, tenant := range []string{"acme", "globex"} {
+		if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: tenant}); err != nil {
+			t.Fatalf("provision %s: %v", tenant, err)
+		}
+	}
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "initech"})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || validation.Fields[0].Field != "memory_mb" {
+		t.Fatalf("err = %v, want memory budget violation", err)
+	}
+
+	if err := svc.Deprovision(context.Background(), "container-tenant-db-acme"); err != nil {
+		t.Fatalf("deprovision: %v", err)
+	}
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "initech"}); err != nil {
+		t.Fatalf("provision after freeing budget: %v", err)
+	}
+}
+
+func testCatalog(t *testing.T) *plans.Catalog {
+	t.Helper()
+	freeMemory, proMemory, proMax := int64(256), int64(1024), int64(2048)
+	catalog, err := plans.New("free", []plans.Plan{
+		{Name: "free", MemoryMB: &freeMemory, RestartPolicy: "on-failure:3"},
+		{Name: "pro", MemoryMB: &proMemory, MaxMemoryMB: &proMax, Overridable: []string{plans.FieldMemoryMB}},
+		{Name: "edge", Image: "postgres:17-alpine"},
+	})
+	if err != nil {
+		t.Fatalf("catalog: %v", err)
+	}
+	return catalog
+}
+
+func TestProvisionTenantAppliesPlan(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{TenantDBImage: "postgres:16-alpine"}, WithPlans(testCatalog(t)), WithRegistry(store))
+
+	override := int64(512)
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme", Limits: &Limits{MemoryMB: &override}})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || validation.Fields[0].Field != "memory_mb" {
+		t.Fatalf("err = %v, want memory_mb fixed by plan free", err)
+	}
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme", Plan: "gold"}); !errors.Is(err, ErrUnknownPlan) {
+		t.Fatalf("err = %v, want ErrUnknownPlan", err)
+	}
+
+	result, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Plan != "free" {
+		t.Fatalf("plan = %q, want free", result.Plan)
+	}
+	result, err = svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "globex", Plan: "pro", Limits: &Limits{MemoryMB: &override}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var runs []string
+	for _, call := range runner.calls {
+		if call[0] == "run" {
+			runs = append(runs, strings.Join(call, " "))
+		}
+	}
+	if !strings.Contains(runs[0], "--restart on-failure:3") || !strings.Contains(runs[0], "--memory 256m") {
+		t.Fatalf("free run = %q", runs[0])
+	}
+	if !strings.Contains(runs[1], "--memory 512m") || !strings.Contains(runs[1], "--label plan=pro") {
+		t.Fatalf("pro run = %q", runs[1])
+	}
+	record, _, _ := store.Get("globex")
+	if record.Plan != "pro" || *record.Limits.MemoryMB != 512 {
+		t.Fatalf("recorded tenant = %+v", record)
+	}
+}
+
+func TestChangePlanUpdatesLimitsInPlace(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] == "inspect" {
+			return "container-123\n", nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	freeMemory, pids, cpus := int64(256), int64(100), 0.5
+	if err := store.Put(registry.Tenant{
+		Name: "acme", ResourceID: "container-123", Image: "postgres:16-alpine", Plan: "free",
+		Limits: registry.Limits{MemoryMB: &freeMemory, PidsLimit: &pids}, RestartPolicy: "on-failure:3",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(registry.Tenant{
+		Name: "globex", ResourceID: "container-456", Image: "postgres:16-alpine", Plan: "free",
+		Limits: registry.Limits{MemoryMB: &freeMemory, CPUCores: &cpus},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantDBImage: "postgres:16-alpine", TenantDBRestartPolicy: "unless-stopped"},
+		WithPlans(testCatalog(t)), WithRegistry(store))
+
+	if _, err := svc.ChangePlan(context.Background(), "acme", "edge"); !errors.Is(err, ErrPlanRequiresRecreate) {
+		t.Fatalf("err = %v, want ErrPlanRequiresRecreate", err)
+	}
+
+	result, err := svc.ChangePlan(context.Background(), "acme", "pro")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Plan != "pro" || *result.Limits.MemoryMB != 1024 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	last := strings.Join(runner.calls[len(runner.calls)-1], " ")
+	if last != "update --memory 1024m --memory-swap 2048m --pids-limit -1 --restart unless-stopped container-123" {
+		t.Fatalf("docker update call = %q", last)
+	}
+	record, _, _ := store.Get("acme")
+	if record.Plan != "pro" || record.RestartPolicy != "unless-stopped" || record.Limits.PidsLimit != nil {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+
+	calls := len(runner.calls)
+	if _, err := svc.ChangePlan(context.Background(), "globex", "pro"); !errors.Is(err, ErrPlanRequiresRecreate) {
+		t.Fatalf("err = %v, want ErrPlanRequiresRecreate for a lifted cpu limit", err)
+	}
+	for _, call := range runner.calls[calls:] {
+		if call[0] == "update" {
+			t.Fatalf("rejected plan change ran %v", call)
+		}
+	}
+
+	tooMuch := int64(4096)
+	if _, err := svc.UpdateLimits(context.Background(), "acme", Limits{MemoryMB: &tooMuch}); !errors.Is(err, ErrInvalidLimits) {
+		t.Fatalf("err = %v, want plan maximum violation", err)
+	}
+}
+
+func TestProvisionTenantStorageQuota(t *testing.T) {
+	newRunner := func() *fakeRunner {
+		runner := &fakeRunner{}
+		runner.handler = func(args ...string) (string, error) {
+			switch args[0] {
+			case "inspect":
+				return "", errors.New("No such object")
+			case "run":
+				return "container-123\n", nil
+			case "port":
+				return "0.0.0.0:54321", nil
+			}
+			return "", nil
+		}
+		return runner
+	}
+	quota := int64(512)
+
+	volumeRunner := newRunner()
+	svc := NewService(volumeRunner, config.Config{StorageQuotaMode: StorageQuotaVolume, VolumeDriver: "local", VolumeSizeOpt: "size", TenantStorageQuotaMB: &quota})
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var joined []string
+	for _, call := range volumeRunner.calls {
+		joined = append(joined, strings.Join(call, " "))
+	}
+	all := strings.Join(joined, "\n")
+	if !strings.Contains(all, "volume create --label managed_by=iam-provisioner --label tenant_name=acme --driver local --opt size=512M tenant-data-acme") {
+		t.Fatalf("missing volume create in calls:\n%s", all)
+	}
+	if !strings.Contains(all, "-v tenant-data-acme:/var/lib/postgresql/data") {
+		t.Fatalf("missing volume mount in calls:\n%s", all)
+	}
+
+	layerRunner := newRunner()
+	svc = NewService(layerRunner, config.Config{StorageQuotaMode: StorageQuotaStorageOpt, TenantStorageQuotaMB: &quota})
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, call := range layerRunner.calls {
+		joinedCall := strings.Join(call, " ")
+		if call[0] == "volume" {
+			t.Fatalf("unexpected volume call %q with storage-opt", joinedCall)
+		}
+		if call[0] == "run" && !strings.Contains(joinedCall, "--storage-opt size=512M -e PGDATA=/var/lib/postgresql/pgdata") {
+			t.Fatalf("run call = %q", joinedCall)
+		}
+	}
+}
+
+func TestCheckStorageTogglesReadOnly(t *testing.T) {
+	size := "1048576"
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] == "exec" && strings.HasPrefix(args[len(args)-1], "SELECT pg_database_size") {
+			return size + "\n", nil
+		}
+		return "", nil
+	}
+	quota := int64(1)
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", StorageQuotaMB: &quota, DesiredState: registry.StateRunning}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_", StorageQuotaPolicy: StoragePolicyReadOnly}, WithRegistry(store))
+
+	usages, err := svc.CheckStorage(context.Background())
+	if err != nil || len(usages) != 1 || usages[0].Exceeded {
+		t.Fatalf("at quota: usages=%+v err=%v", usages, err)
+	}
+
+	size = "2097152"
+	usages, _ = svc.CheckStorage(context.Background())
+	if !usages[0].Exceeded || !usages[0].ReadOnly {
+		t.Fatalf("over quota: %+v", usages[0])
+	}
+	last := strings.Join(runner.calls[len(runner.calls)-1], " ")
+	if !strings.HasSuffix(last, `ALTER DATABASE "tenant_acme" SET default_transaction_read_only = on`) {
+		t.Fatalf("last call = %q", last)
+	}
+	if record, _, _ := store.Get("acme"); !record.StorageReadOnly {
+		t.Fatal("expected read-only recorded in registry")
+	}
+
+	size = "1024"
+	usages, _ = svc.CheckStorage(context.Background())
+	if usages[0].ReadOnly {
+		t.Fatalf("expected read-only lifted: %+v", usages[0])
+	}
+
+	size = "2097152"
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] == "exec" && strings.HasPrefix(args[len(args)-1], "ALTER DATABASE") {
+			if err := store.Delete("acme"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if args[0] == "exec" && strings.HasPrefix(args[len(args)-1], "SELECT pg_database_size") {
+			return size + "\n", nil
+		}
+		return "", nil
+	}
+	if _, err := svc.CheckStorage(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := store.Get("acme"); ok {
+		t.Fatal("storage check recreated a deleted tenant")
+	}
+}
+
+func TestStopAndStartTenantRecordStateAndPort(t *testing.T) {
+	port := "54321"
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:" + port, nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "acme", ResourceID: "container-123", Port: "54321", DesiredState: registry.StateRunning}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantDBHost: "127.0.0.1", TenantStopTimeout: 30 * time.Second}, WithRegistry(store))
+
+	result, err := svc.StopTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if result.Status != "stopped" {
+		t.Fatalf("status = %q, want stopped", result.Status)
+	}
+	if last := strings.Join(runner.calls[len(runner.calls)-1], " "); last != "stop --time 30 container-123" {
+		t.Fatalf("last call = %q", last)
+	}
+	if record, _, _ := store.Get("acme"); record.DesiredState != registry.StateStopped {
+		t.Fatalf("desired state = %q, want stopped", record.DesiredState)
+	}
+
+	port = "60000"
+	result, err = svc.StartTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if result.Port != "60000" || !result.PortChanged {
+		t.Fatalf("unexpected start result: %+v", result)
+	}
+	record, _, _ := store.Get("acme")
+	if record.DesiredState != registry.StateRunning || record.Port != "60000" {
+		t.Fatalf("recorded tenant = %+v", record)
+	}
+
+	runner.handler = func(args ...string) (string, error) {
+		return "", errors.New("No such object")
+	}
+	if _, err := svc.RestartTenant(context.Background(), "acme"); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("err = %v, want ErrTenantNotFound", err)
+	}
+}
+
+func TestSuspendIdleStopsOnlyIdleTenantsAndWakeStartsThem(t *testing.T) {
+	connections := map[string]string{"tenant-db-acme": "0", "tenant-db-busy": "2"}
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "exec":
+			return connections[args[1]] + "\n", nil
+		case "stats":
+			return "0.12%\n", nil
+		case "inspect":
+			return args[len(args)-1] + "-id\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	for _, name := range []string{"acme", "busy"} {
+		if err := store.Put(registry.Tenant{Name: name, Container: "tenant-db-" + name, Port: "54321", DesiredState: registry.StateRunning}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc := NewService(runner, config.Config{IdleSuspendAfter: time.Nanosecond, IdleCPUPercent: 1}, WithRegistry(store))
+
+	// The first pass only records when each tenant was seen.
+	suspended, err := svc.SuspendIdle(context.Background())
+	if err != nil || len(suspended) != 0 {
+		t.Fatalf("first pass = %v, %v", suspended, err)
+	}
+	suspended, err = svc.SuspendIdle(context.Background())
+	if err != nil {
+		t.Fatalf("suspend idle: %v", err)
+	}
+	if len(suspended) != 1 || suspended[0] != "acme" {
+		t.Fatalf("suspended = %v, want [acme]", suspended)
+	}
+	record, _, _ := store.Get("acme")
+	if record.DesiredState != registry.StateStopped || !record.Suspended {
+		t.Fatalf("recorded tenant = %+v", record)
+	}
+
+	result, err := svc.WakeTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("wake: %v", err)
+	}
+	if result.Status != "woken" || result.Port != "54321" {
+		t.Fatalf("unexpected wake result: %+v", result)
+	}
+	record, _, _ = store.Get("acme")
+	if record.DesiredState != registry.StateRunning || record.Suspended {
+		t.Fatalf("recorded tenant = %+v", record)
+	}
+
+	result, err = svc.WakeTenant(context.Background(), "busy")
+	if err != nil || result.Status != "running" {
+		t.Fatalf("wake running tenant = %+v, %v", result, err)
+	}
+	if _, err := svc.StopTenant(context.Background(), "busy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.WakeTenant(context.Background(), "busy"); !errors.Is(err, ErrTenantStopped) {
+		t.Fatalf("err = %v, want ErrTenantStopped", err)
+	}
+}
+
+func TestSuspendIdleSkipsTenantStoppedDuringCheck(t *testing.T) {
+	store := registry.NewMemoryStore()
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "exec":
+			return "0\n", nil
+		case "stats":
+			// An operator stops the tenant while the idle check runs.
+			if err := store.Update("acme", func(t *registry.Tenant, _ bool) error {
+				t.DesiredState = registry.StateStopped
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			return "0.00%\n", nil
+		case "inspect":
+			return "tenant-db-acme-id\n", nil
+		}
+		return "", nil
+	}
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", DesiredState: registry.StateRunning}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{IdleSuspendAfter: time.Nanosecond, IdleCPUPercent: 1}, WithRegistry(store))
+	svc.idle.observe("acme", false, time.Now().Add(-time.Hour))
+
+	suspended, err := svc.SuspendIdle(context.Background())
+	if err != nil || len(suspended) != 0 {
+		t.Fatalf("suspended = %v, %v", suspended, err)
+	}
+	if record, _, _ := store.Get("acme"); record.Suspended {
+		t.Fatalf("operator stop turned into a suspension: %+v", record)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "stop" {
+			t.Fatalf("unexpected docker stop: %v", call)
+		}
+	}
+}
+
+func TestWakeTenantLeavesTenantStoppedBeforeTheLock(t *testing.T) {
+	store := registry.NewMemoryStore()
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] == "inspect" {
+			// An operator stop lands after WakeTenant read the record.
+			if err := store.Update("acme", func(t *registry.Tenant, _ bool) error {
+				t.Suspended = false
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			return "tenant-db-acme-id\n", nil
+		}
+		return "", nil
+	}
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", DesiredState: registry.StateStopped, Suspended: true}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{}, WithRegistry(store))
+
+	if _, err := svc.WakeTenant(context.Background(), "acme"); !errors.Is(err, ErrTenantStopped) {
+		t.Fatalf("err = %v, want ErrTenantStopped", err)
+	}
+	if record, _, _ := store.Get("acme"); record.DesiredState != registry.StateStopped {
+		t.Fatalf("operator stop was undone: %+v", record)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "start" {
+			t.Fatalf("unexpected docker start: %v", call)
+		}
+	}
+}
+
+func TestIdleThresholdPrefersPlan(t *testing.T) {
+	seconds := int64(120)
+	catalog, err := plans.New("", []plans.Plan{{Name: "free", IdleSuspendSeconds: &seconds}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(&fakeRunner{}, config.Config{IdleSuspendAfter: time.Hour}, WithPlans(catalog))
+
+	if got := svc.idleThreshold(registry.Tenant{Plan: "free"}); got != 2*time.Minute {
+		t.Fatalf("plan threshold = %s, want 2m", got)
+	}
+	if got := svc.idleThreshold(registry.Tenant{}); got != time.Hour {
+		t.Fatalf("default threshold = %s, want 1h", got)
+	}
+}
+
+func TestProvisionTenantAllocatesStablePortInRange(t *testing.T) {
+	published := ""
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			for i, arg := range args {
+				if arg == "-p" {
+					published = strings.TrimSuffix(args[i+1], ":5432")
+				}
+			}
+			if published == "55001" {
+				return "", errors.New("Bind for 0.0.0.0:55001 failed: port is already allocated")
+			}
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:" + published, nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "other", Port: "55000", DesiredState: registry.StateRunning}); err != nil {
+		t.Fatal(err)
+	}
+	start, end := 55000, 55002
+	svc := NewService(runner, config.Config{PortRangeStart: &start, PortRangeEnd: &end}, WithRegistry(store))
+
+	result, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if !strings.Contains(result.ConnectionString, ":55002/") {
+		t.Fatalf("connection string = %q, want port 55002", result.ConnectionString)
+	}
+	var removed bool
+	for _, call := range runner.calls {
+		if strings.Join(call, " ") == "rm -f -v tenant-db-acme" {
+			removed = true
+		}
+	}
+	if !removed {
+		t.Fatalf("container left behind by the port collision was not removed: %v", runner.calls)
+	}
+
+	// The container is gone but the registry still has the tenant: recreating
+	// it keeps the recorded port.
+	published = ""
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err != nil {
+		t.Fatalf("reprovision: %v", err)
+	}
+	if published != "55002" {
+		t.Fatalf("published port = %q, want 55002", published)
+	}
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "third"}); !errors.Is(err, ErrNoFreePort) {
+		t.Fatalf("err = %v, want ErrNoFreePort", err)
+	}
+}
+
+func TestProvisionTenantRollsBackAfterLastPortAttempt(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "", errors.New("Bind for 0.0.0.0:55000 failed: port is already allocated")
+		}
+		return "", nil
+	}
+	start, end := 55000, 55099
+	svc := NewService(runner, config.Config{PortRangeStart: &start, PortRangeEnd: &end})
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err == nil {
+		t.Fatal("expected provision to fail")
+	}
+	calls := runner.calls
+	if len(calls) < 2 {
+		t.Fatalf("calls = %v", calls)
+	}
+	if got := strings.Join(calls[len(calls)-2], " "); got != "rm -f -v tenant-db-acme" {
+		t.Fatalf("container from the last attempt was not removed, got %q", got)
+	}
+	if got := strings.Join(calls[len(calls)-1], " "); got != "volume rm -f tenant-data-acme" {
+		t.Fatalf("volume was not removed, got %q", got)
+	}
+}
+
+func TestProvisionTenantPublishSettings(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "10.0.0.5:49160", nil
+		}
+		return "", nil
+	}
+	runCall := func() string {
+		for _, call := range runner.calls {
+			if call[0] == "run" {
+				return strings.Join(call, " ")
+			}
+		}
+		t.Fatal("expected docker run call")
+		return ""
+	}
+
+	svc := NewService(runner, config.Config{TenantDBHost: "db.internal", TenantDBBindAddress: "10.0.0.5"})
+	result, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if !strings.Contains(runCall(), "-p 10.0.0.5:0:5432") {
+		t.Fatalf("run args do not bind the configured address: %s", runCall())
+	}
+	if !strings.Contains(result.ConnectionString, "@db.internal:49160/") {
+		t.Fatalf("connection string = %q", result.ConnectionString)
+	}
+
+	runner.calls = nil
+	store := registry.NewMemoryStore()
+	svc = NewService(runner, config.Config{TenantDBHost: "db.internal", TenantDBPublish: PublishNetwork}, WithRegistry(store))
+	result, err = svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if strings.Contains(runCall(), " -p ") {
+		t.Fatalf("network mode published a port: %s", runCall())
+	}
+	for _, call := range runner.calls {
+		if call[0] == "port" {
+			t.Fatalf("network mode asked docker for the published port: %v", call)
+		}
+	}
+	if !strings.Contains(result.ConnectionString, "@tenant-db-acme:5432/") {
+		t.Fatalf("connection string = %q", result.ConnectionString)
+	}
+	if record, _, _ := store.Get("acme"); record.Port != "" {
+		t.Fatalf("recorded port = %q, want none in network mode", record.Port)
+	}
+}
+
+func TestProxyTargetRoutesAndWakesSuspendedTenants(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			if strings.Contains(strings.Join(args, " "), "IPAddress") {
+				return "bridge=172.17.0.5 tenant-net-acme=10.0.7.2 \n", nil
+			}
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", Network: "tenant-net-acme", DesiredState: registry.StateStopped, Suspended: true}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_"}, WithRegistry(store))
+
+	addr, err := svc.ProxyTarget(context.Background(), "tenant_acme", "")
+	if err != nil {
+		t.Fatalf("proxy target: %v", err)
+	}
+	if addr != "10.0.7.2:5432" {
+		t.Fatalf("addr = %q, want the address on the tenant network", addr)
+	}
+	if record, _, _ := store.Get("acme"); record.DesiredState != registry.StateRunning {
+		t.Fatalf("suspended tenant was not woken: %+v", record)
+	}
+
+	if addr, err := svc.ProxyTarget(context.Background(), "postgres", "acme.db.example.com"); err != nil || addr != "10.0.7.2:5432" {
+		t.Fatalf("sni route = %q, %v", addr, err)
+	}
+	if _, err := svc.ProxyTarget(context.Background(), "tenant_ghost", "db.example.com"); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("err = %v, want ErrTenantNotFound", err)
+	}
+}
+
+func TestProxyTargetThrottlesFailedWakes(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "container-123\n", nil
+		case "start":
+			return "", errors.New("cannot start container")
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", DesiredState: registry.StateStopped, Suspended: true}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_"}, WithRegistry(store))
+
+	if _, err := svc.ProxyTarget(context.Background(), "tenant_acme", ""); err == nil || errors.Is(err, ErrWakeThrottled) {
+		t.Fatalf("first wake err = %v, want the start failure", err)
+	}
+	calls := len(runner.calls)
+	if _, err := svc.ProxyTarget(context.Background(), "tenant_acme", ""); !errors.Is(err, ErrWakeThrottled) {
+		t.Fatalf("err = %v, want ErrWakeThrottled", err)
+	}
+	if len(runner.calls) != calls {
+		t.Fatalf("throttled wake ran docker: %v", runner.calls[calls:])
+	}
+}
+
+func TestProvisionTenantNameConflictKeepsExistingCertificate(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "", errors.New(`docker [run] failed: docker: Error response from daemon: Conflict. The container name "/tenant-db-acme" is already in use by container "abc123def456". You have to remove (or rename) that container to be able to reuse that name.`)
+		}
+		return "", nil
+	}
+	dir := t.TempDir()
+	ca, err := certs.LoadOrCreate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDir := filepath.Join(dir, "tenants", "acme")
+	if err := os.MkdirAll(certDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(certDir, "server.key"), []byte("live key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{TenantTLSDir: dir, TenantCertValidity: time.Hour}, WithCertificates(ca))
+
+	var conflict *ErrAlreadyProvisioned
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); !errors.As(err, &conflict) {
+		t.Fatalf("err = %v, want ErrAlreadyProvisioned", err)
+	}
+	key, err := os.ReadFile(filepath.Join(certDir, "server.key"))
+	if err != nil || string(key) != "live key" {
+		t.Fatalf("existing tenant key = %q, %v; want it untouched", key, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(certDir))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("leftover certificate dirs: %v, %v", entries, err)
+	}
+}
+
+func TestProvisionTenantWithTLSIssuesAndRenewsCertificate(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			if strings.Contains(strings.Join(args, " "), "tenant_name") {
+				return "acme\n", nil
+			}
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	dir := t.TempDir()
+	ca, err := certs.LoadOrCreate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{
+		TenantDBHost:          "127.0.0.1",
+		TenantDBNamePrefix:    "tenant_",
+		TenantDBImage:         "postgres:16-alpine",
+		TenantTLSDir:          dir,
+		TenantCertValidity:    90 * 24 * time.Hour,
+		TenantCertRenewBefore: 30 * 24 * time.Hour,
+	}, WithRegistry(store), WithCertificates(ca))
+
+	result, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if !strings.HasSuffix(result.ConnectionString, "/tenant_acme?sslmode=verify-full") {
+		t.Fatalf("connection string = %q", result.ConnectionString)
+	}
+	var run string
+	for _, call := range runner.calls {
+		if call[0] == "run" {
+			run = strings.Join(call, " ")
+		}
+	}
+	certDir := filepath.Join(dir, "tenants", "acme")
+	for _, want := range []string{"-v " + certDir + ":/etc/postgresql/tls:ro", "--entrypoint sh", "postgres:16-alpine -c ", "-c ssl=on"} {
+		if !strings.Contains(run, want) {
+			t.Fatalf("run args missing %q: %s", want, run)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(certDir, "server.key")); err != nil {
+		t.Fatalf("tenant key not written: %v", err)
+	}
+	record, _, _ := store.Get("acme")
+	if record.CertExpiresAt.IsZero() {
+		t.Fatal("certificate expiry not recorded")
+	}
+
+	if renewed, err := svc.RenewCertificates(context.Background()); err != nil || len(renewed) != 0 {
+		t.Fatalf("renewed fresh certificate: %v, %v", renewed, err)
+	}
+	record.CertExpiresAt = time.Now().Add(24 * time.Hour)
+	if err := store.Put(record); err != nil {
+		t.Fatal(err)
+	}
+	runner.calls = nil
+	renewed, err := svc.RenewCertificates(context.Background())
+	if err != nil || len(renewed) != 1 {
+		t.Fatalf("renewed = %v, %v; want [acme]", renewed, err)
+	}
+	if first := strings.Join(runner.calls[0], " "); !strings.HasPrefix(first, "exec -u root tenant-db-acme sh -c install ") {
+		t.Fatalf("certificate not installed in the container: %s", first)
+	}
+	if last := runner.calls[len(runner.calls)-1]; last[len(last)-1] != "SELECT pg_reload_conf()" {
+		t.Fatalf("configuration not reloaded: %v", last)
+	}
+	if record, _, _ := store.Get("acme"); time.Until(record.CertExpiresAt) < 60*24*time.Hour {
+		t.Fatalf("expiry not extended: %s", record.CertExpiresAt)
+	}
+
+	if err := svc.Deprovision(context.Background(), "container-123"); err != nil {
+		t.Fatalf("deprovision: %v", err)
+	}
+	if _, err := os.Stat(certDir); !os.IsNotExist(err) {
+		t.Fatalf("certificate dir left behind: %v", err)
+	}
+}
+
+func TestProvisionTenantDedicatedNetwork(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		call := strings.Join(args, " ")
+		switch {
+		case strings.HasPrefix(call, "inspect") && strings.Contains(call, "tenant_name"):
+			return "acme\n", nil
+		case args[0] == "inspect", strings.HasPrefix(call, "network inspect"):
+			return "", errors.New("No such object")
+		case strings.HasPrefix(call, "network connect tenant-net-acme ghost"):
+			return "", errors.New("Error: No such container: ghost")
+		case args[0] == "run":
+			return "container-123\n", nil
+		case args[0] == "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	has := func(want string) bool {
+		for _, call := range runner.calls {
+			if strings.Join(call, " ") == want {
+				return true
+			}
+		}
+		return false
+	}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{
+		TenantDBNetwork:        "tenant-db",
+		TenantNetworkIsolation: plans.IsolationDedicated,
+		TenantNetworkAttach:    []string{"pgproxy"},
+	}, WithRegistry(store))
+
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme", AppContainers: []string{"acme-api"}})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	for _, want := range []string{
+		"network create --label managed_by=iam-provisioner --label tenant_name=acme tenant-net-acme",
+		"network connect tenant-net-acme pgproxy",
+		"network connect tenant-net-acme acme-api",
+	} {
+		if !has(want) {
+			t.Fatalf("missing docker call %q in %v", want, runner.calls)
+		}
+	}
+	for _, call := range runner.calls {
+		if call[0] == "run" && !strings.Contains(strings.Join(call, " "), "--network tenant-net-acme") {
+			t.Fatalf("container not started on the tenant network: %v", call)
+		}
+	}
+	record, _, _ := store.Get("acme")
+	if record.Network != "tenant-net-acme" || !record.DedicatedNetwork || len(record.AppContainers) != 1 {
+		t.Fatalf("record = %+v", record)
+	}
+
+	if _, err := svc.AttachApp(context.Background(), "acme", "ghost"); !errors.Is(err, ErrAppContainerNotFound) {
+		t.Fatalf("err = %v, want ErrAppContainerNotFound", err)
+	}
+	result, err := svc.AttachApp(context.Background(), "acme", "acme-worker")
+	if err != nil || len(result.AppContainers) != 2 {
+		t.Fatalf("attach = %+v, %v", result, err)
+	}
+
+	runner.calls = nil
+	if err := svc.Deprovision(context.Background(), "container-123"); err != nil {
+		t.Fatalf("deprovision: %v", err)
+	}
+	for _, want := range []string{
+		"network disconnect -f tenant-net-acme acme-worker",
+		"network disconnect -f tenant-net-acme pgproxy",
+		"network rm tenant-net-acme",
+	} {
+		if !has(want) {
+			t.Fatalf("missing docker call %q in %v", want, runner.calls)
+		}
+	}
+}
+
+func TestProvisionTenantRollsBackOnlyNetworksItCreated(t *testing.T) {
+	nameConflict := errors.New(`docker [run] failed: docker: Error response from daemon: Conflict. The container name "/tenant-db-acme" is already in use by container "abc123def456". You have to remove (or rename) that container to be able to reuse that name.`)
+	cases := map[string]struct {
+		networkExists bool
+		runErr        error
+		wantRemoved   bool
+	}{
+		"created, run failed":  {runErr: errors.New("no space left on device"), wantRemoved: true},
+		"existing, run failed": {networkExists: true, runErr: errors.New("no space left on device")},
+		"created, name taken":  {runErr: nameConflict},
+	}
+	for name, tc := range cases {
+		runner := &fakeRunner{}
+		runner.handler = func(args ...string) (string, error) {
+			switch {
+			case args[0] == "network" && args[1] == "inspect":
+				if tc.networkExists {
+					return "", nil
+				}
+				return "", errors.New("No such object")
+			case args[0] == "inspect":
+				return "", errors.New("No such object")
+			case args[0] == "run":
+				return "", tc.runErr
+			}
+			return "", nil
+		}
+		svc := NewService(runner, config.Config{TenantNetworkIsolation: plans.IsolationDedicated})
+		if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err == nil {
+			t.Fatalf("%s: expected provision to fail", name)
+		}
+		removed := false
+		for _, call := range runner.calls {
+			if strings.Join(call, " ") == "network rm tenant-net-acme" {
+				removed = true
+			}
+		}
+		if removed != tc.wantRemoved {
+			t.Fatalf("%s: network removed = %v, want %v", name, removed, tc.wantRemoved)
+		}
+	}
+}
+
+func TestAppContainersRequireDedicatedNetwork(t *testing.T) {
+	runner := &fakeRunner{handler: func(args ...string) (string, error) { return "", nil }}
+	store := registry.NewMemoryStore()
+	_ = store.Put(registry.Tenant{Name: "acme", Network: "tenant-db"})
+	svc := NewService(runner, config.Config{TenantDBNetwork: "tenant-db"}, WithRegistry(store))
+
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "globex", AppContainers: []string{"globex-api"}})
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("err = %v, want ValidationError", err)
+	}
+	if _, err := svc.AttachApp(context.Background(), "acme", "acme-api"); !errors.Is(err, ErrSharedNetwork) {
+		t.Fatalf("err = %v, want ErrSharedNetwork", err)
+	}
+}
+
+func TestProvisionTenantPostgresSettingsAndExtensions(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{
+		TenantDBImage:      "postgres:16-alpine",
+		TenantDBNamePrefix: "tenant_",
+		TenantDBExtensions: []string{"pgcrypto", "uuid-ossp", "pg_trgm"},
+	}, WithRegistry(store))
+
+	_, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{
+		TenantName: "acme",
+		Settings:   map[string]string{"work_mem": "8MB", "max_connections": "50"},
+		Extensions: []string{"pgcrypto", "uuid-ossp"},
+	})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	var run string
+	var created []string
+	for _, call := range runner.calls {
+		joined := strings.Join(call, " ")
+		if call[0] == "run" {
+			run = joined
+		}
+		if strings.Contains(joined, "CREATE EXTENSION") {
+			created = append(created, call[len(call)-1])
+		}
+	}
+	if !strings.HasSuffix(run, "postgres:16-alpine postgres -c max_connections=50 -c work_mem=8MB") {
+		t.Fatalf("run args = %s", run)
+	}
+	if len(created) != 2 || created[1] != `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"` {
+		t.Fatalf("extensions = %q", created)
+	}
+	if record, _, _ := store.Get("acme"); record.Settings["work_mem"] != "8MB" || len(record.Extensions) != 2 {
+		t.Fatalf("record = %+v", record)
+	}
+
+	runner.calls = nil
+	_, err = svc.ProvisionTenant(context.Background(), ProvisionRequest{
+		TenantName: "globex",
+		Settings:   map[string]string{"shared_preload_libraries": "auto_explain", "max_connections": "lots"},
+		Extensions: []string{"plpython3u"},
+	})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || len(validation.Fields) != 3 {
+		t.Fatalf("err = %v, want three field errors", err)
+	}
+	if len(runner.calls) != 0 {
+		t.Fatalf("invalid request reached docker: %v", runner.calls)
+	}
+}
+
+func TestProvisionTenantAppliesMigrationBundle(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"001_users.sql": "CREATE TABLE users (id int);",
+		"002_roles.sql": "CREATE TABLE roles (id int);",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundles, err := migrations.Load(map[string]string{"iam": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := ""
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		case "exec":
+			if strings.HasPrefix(args[len(args)-1], "SELECT version FROM schema_migrations") {
+				return applied, nil
+			}
+		}
+		return "", nil
+	}
+	migrationCalls := func() []string {
+		var statements []string
+		for _, call := range runner.calls {
+			if call[0] == "exec" && strings.Contains(call[len(call)-1], "schema_migrations") {
+				statements = append(statements, call[len(call)-1])
+			}
+		}
+		return statements
+	}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{TenantDBNamePrefix: "tenant_", MigrationDefault: "iam"},
+		WithRegistry(store), WithMigrations(bundles))
+
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "acme"}); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	statements := migrationCalls()
+	if len(statements) != 4 || !strings.HasPrefix(statements[0], "CREATE TABLE IF NOT EXISTS schema_migrations") {
+		t.Fatalf("migration statements = %q", statements)
+	}
+	if !strings.Contains(statements[2], "CREATE TABLE users") || !strings.Contains(statements[2], "VALUES ('iam', '001')") {
+		t.Fatalf("first migration = %q", statements[2])
+	}
+	for _, call := range runner.calls {
+		if strings.Contains(call[len(call)-1], "CREATE TABLE users") {
+			if got := strings.Join(call[:3], " ") + " ... " + strings.Join(call[len(call)-5:len(call)-1], " "); got != "exec -i container-123 ... ON_ERROR_STOP=1 -1 -f -" {
+				t.Fatalf("migration call = %q, want the script on stdin", got)
+			}
+		}
+	}
+	record, _, _ := store.Get("acme")
+	if record.MigrationBundle != "iam" || record.MigrationVersion != "002" {
+		t.Fatalf("record = %+v", record)
+	}
+
+	_ = store.Put(registry.Tenant{Name: "globex", Container: "tenant-db-globex", MigrationBundle: "iam", DesiredState: registry.StateStopped})
+	applied = "001\n"
+	runner.calls = nil
+	result, err := svc.MigrateTenants(context.Background())
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	outcomes := map[string]TenantMigration{}
+	for _, outcome := range result.Tenants {
+		outcomes[outcome.Tenant] = outcome
+	}
+	if got := outcomes["acme"]; got.Status != MigrationApplied || len(got.Applied) != 1 || got.Applied[0] != "002" {
+		t.Fatalf("acme = %+v", got)
+	}
+	if got := outcomes["globex"]; got.Status != MigrationSkipped {
+		t.Fatalf("globex = %+v", got)
+	}
+
+	_, err = svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "initech", MigrationBundle: "crm"})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || validation.Fields[0].Field != "migration_bundle" {
+		t.Fatalf("err = %v, want migration_bundle validation error", err)
+	}
+
+	// A tenant deprovisioned while its migrations run is not recreated.
+	_ = store.Delete("acme")
+	_ = store.Put(registry.Tenant{Name: "umbrella", Container: "tenant-db-umbrella", MigrationBundle: "iam", DesiredState: registry.StateRunning})
+	handler := runner.handler
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] == "exec" && args[2] == "tenant-db-umbrella" && strings.Contains(args[len(args)-1], "INSERT INTO schema_migrations") {
+			_ = store.Delete("umbrella")
+		}
+		return handler(args...)
+	}
+	if _, err := svc.MigrateTenants(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, ok, _ := store.Get("umbrella"); ok {
+		t.Fatal("migration recreated a deleted tenant")
+	}
+}
+
+func waitForOperation(t *testing.T, svc *Service, id string) rollout.Operation {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if op, ok := svc.Operation(id); ok && op.Status != rollout.StatusRunning {
+			return op
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("operation %s did not finish", id)
+	return rollout.Operation{}
+}
+
+func TestMigrationRolloutStopsAfterFailedCanary(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"001_users.sql": "CREATE TABLE users (id int);",
+		"002_roles.sql": "CREATE TABLE roles (id int);",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundles, err := migrations.Load(map[string]string{"iam": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	broken := "tenant-db-globex"
+	migrated := map[string][]string{}
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		if args[0] != "exec" || !strings.Contains(args[len(args)-1], "INSERT INTO schema_migrations") {
+			return "", nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if args[2] == broken {
+			return "", errors.New(`ERROR:  relation "users" already exists`)
+		}
+		migrated[args[2]] = append(migrated[args[2]], args[len(args)-1])
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	for _, name := range []string{"acme", "globex", "initech", "umbrella"} {
+		_ = store.Put(registry.Tenant{Name: name, Container: "tenant-db-" + name, MigrationBundle: "iam", DesiredState: registry.StateRunning})
+	}
+	_ = store.Put(registry.Tenant{Name: "other", Container: "tenant-db-other", DesiredState: registry.StateRunning})
+	svc := NewService(&lockedRunner{next: runner}, config.Config{TenantDBNamePrefix: "tenant_"}, WithRegistry(store), WithMigrations(bundles))
+
+	op, err := svc.StartMigrationRollout(context.Background(), MigrationRolloutRequest{
+		Bundle:        "iam",
+		Version:       "001",
+		CanaryTenants: []string{"globex"},
+		Options:       rollout.Options{BatchSize: 2, Parallelism: 2},
+	})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if op.Total != 4 || op.Tenants[0].Tenant != "globex" {
+		t.Fatalf("operation = %+v", op)
+	}
+	op = waitForOperation(t, svc, op.ID)
+	if op.Status != rollout.StatusFailed || op.Phase != "canary" || op.Tenants[3].Status != rollout.TenantNotRun {
+		t.Fatalf("operation = %+v", op)
+	}
+	if len(migrated) != 0 {
+		t.Fatalf("rollout continued past the failed canary: %v", migrated)
+	}
+
+	broken = ""
+	op, err = svc.StartMigrationRollout(context.Background(), MigrationRolloutRequest{
+		Bundle:  "iam",
+		Version: "001",
+		Options: rollout.Options{Canary: 1, BatchSize: 2, Parallelism: 2},
+	})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	op = waitForOperation(t, svc, op.ID)
+	if op.Status != rollout.StatusSucceeded || op.Succeeded != 4 {
+		t.Fatalf("operation = %+v", op)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := migrated["tenant-db-acme"]; len(got) != 1 || !strings.Contains(got[0], "'001'") {
+		t.Fatalf("acme migrations = %q, want only 001", got)
+	}
+	if len(svc.Operations()) != 2 {
+		t.Fatalf("operations = %d, want 2", len(svc.Operations()))
+	}
+
+	_, err = svc.StartMigrationRollout(context.Background(), MigrationRolloutRequest{Bundle: "iam", Version: "009", CanaryTenants: []string{"other"}})
+	var validation *ValidationError
+	if !errors.As(err, &validation) || len(validation.Fields) != 2 {
+		t.Fatalf("err = %v, want version and canary_tenants errors", err)
+	}
+}
+
+func TestProvisionTenantRecordsImageDigestAndPullsOnlyWhenMissing(t *testing.T) {
+	present := false
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "inspect":
+			return "", errors.New("No such object")
+		case "image":
+			if !present {
+				return "", errors.New("Error: No such image: postgres:16.3-alpine")
+			}
+			return "postgres@sha256:abc\n", nil
+		case "pull":
+			present = true
+		case "run":
+			return "container-123\n", nil
+		case "port":
+			return "0.0.0.0:54321", nil
+		}
+		return "", nil
+	}
+	pulls := func() int {
+		n := 0
+		for _, call := range runner.calls {
+			if call[0] == "pull" {
+				n++
+			}
+		}
+		return n
+	}
+	store := registry.NewMemoryStore()
+	svc := NewService(runner, config.Config{TenantDBImage: "postgres:16.3-alpine"}, WithRegistry(store))
+
+	for _, name := range []string{"acme", "globex"} {
+		if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: name}); err != nil {
+			t.Fatalf("provision %s: %v", name, err)
+		}
+	}
+	if pulls() != 1 {
+		t.Fatalf("pulls = %d, want 1", pulls())
+	}
+	if record, _, _ := store.Get("globex"); record.ImageDigest != "postgres@sha256:abc" {
+		t.Fatalf("image digest = %q", record.ImageDigest)
+	}
+
+	svc = NewService(runner, config.Config{TenantDBImage: "postgres:16.3-alpine", TenantDBPullPolicy: PullAlways}, WithRegistry(store))
+	if _, err := svc.ProvisionTenant(context.Background(), ProvisionRequest{TenantName: "initech"}); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if pulls() != 2 {
+		t.Fatalf("pulls = %d, want a pull with policy always", pulls())
+	}
+}
+
+func upgradeFixture(t *testing.T, healthy func(container string) bool) (*fakeRunner, *registry.Store, *Service) {
+	t.Helper()
+	runner := &fakeRunner{}
+	runner.handler = func(args ...string) (string, error) {
+		switch args[0] {
+		case "image":
+			return "postgres@sha256:new\n", nil
+		case "run":
+			return "new-container\n", nil
+		case "port":
+			return "0.0.0.0:55001", nil
+		case "exec":
+			if !healthy(args[1]) {
+				return "", errors.New("no response")
+			}
+			if args[len(args)-1] == "SHOW server_version" {
+				return "16.4\n", nil
+			}
+		}
+		return "", nil
+	}
+	store := registry.NewMemoryStore()
+	_ = store.Put(registry.Tenant{
+		Name:         "acme",
+		ResourceID:   "old-container",
+		Container:    "tenant-db-acme",
+		Network:      "tenant-db",
+		Image:        "postgres:16.3-alpine",
+		Volume:       "tenant-data-acme",
+		Port:         "55001",
+		Settings:     map[string]string{"work_mem": "8MB"},
+		DesiredState: registry.StateRunning,
+	})
+	svc := NewService(runner, config.Config{
+		TenantDBImage:        "postgres:16.3-alpine",
+		TenantDBNamePrefix:   "tenant_",
+		TenantDBReadyTimeout: 50 * time.Millisecond,
+		TenantStopTimeout:    30 * time.Second,
+	}, WithRegistry(store))
+	return runner, store, svc
+}
+
+func TestUpgradeTenantRecreatesOnSameVolume(t *testing.T) {
+	runner, store, svc := upgradeFixture(t, func(string) bool { return true })
+
+	result, err := svc.UpgradeTenant(context.Background(), "acme", "postgres:16.4-alpine")
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if result.ResourceID != "new-container" || result.PreviousImage != "postgres:16.3-alpine" || result.ServerVersion != "16.4" {
+		t.Fatalf("result = %+v", result)
+	}
+	var calls []string
+	for _, call := range runner.calls {
+		calls = append(calls, strings.Join(call, " "))
+	}
+	joined := strings.Join(calls, "\n")
+	for _, want := range []string{
+		"stop --time 30 tenant-db-acme",
+		"rename tenant-db-acme tenant-db-acme-previous",
+		"rm -f -v tenant-db-acme-previous",
+	} {
+		if !slices.Contains(calls, want) {
+			t.Fatalf("missing docker call %q in:\n%s", want, joined)
+		}
+	}
+	for _, call := range calls {
+		if strings.HasPrefix(call, "run ") {
+			for _, want := range []string{"-p 55001:5432", "-v tenant-data-acme:/var/lib/postgresql/data", "postgres:16.4-alpine postgres -c work_mem=8MB"} {
+				if !strings.Contains(call, want) {
+					t.Fatalf("run args missing %q: %s", want, call)
+				}
+			}
+			if strings.Contains(call, "POSTGRES_PASSWORD") {
+				t.Fatalf("recreated container got a new password: %s", call)
+			}
+		}
+	}
+	record, _, _ := store.Get("acme")
+	if record.Image != "postgres:16.4-alpine" || record.ImageDigest != "postgres@sha256:new" || record.ResourceID != "new-container" {
+		t.Fatalf("record = %+v", record)
+	}
+
+	_, err = svc.UpgradeTenant(context.Background(), "acme", "postgres:17.0-alpine")
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("err = %v, want a validation error for a major upgrade", err)
+	}
+	for _, image := range []string{"postgres:16.3-alpine", "postgres:16.4-bookworm", "postgres:16.5", "postgres:16-alpine"} {
+		if _, err := svc.UpgradeTenant(context.Background(), "acme", image); !errors.As(err, &validation) {
+			t.Fatalf("%s: err = %v, want a validation error", image, err)
+		}
+	}
+}
+
+func TestUpgradeTenantOnFloatingTagComparesRunningVersion(t *testing.T) {
+	runner, store, svc := upgradeFixture(t, func(string) bool { return true })
+	_ = store.Update("acme", func(t *registry.Tenant, _ bool) error {
+		t.Image = "postgres:16-alpine"
+		return nil
+	})
+
+	// The fixture reports 16.4 as the running version.
+	if _, err := svc.UpgradeTenant(context.Background(), "acme", "postgres:16.4-alpine"); !errors.Is(err, ErrUpgradeNotNewer) {
+		t.Fatalf("err = %v, want ErrUpgradeNotNewer", err)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "stop" {
+			t.Fatalf("unexpected docker stop: %v", call)
+		}
+	}
+	if _, err := svc.UpgradeTenant(context.Background(), "acme", "postgres:16.5-alpine"); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+}
+
+func TestUpgradeTenantRequiresCertificateBeforeStopping(t *testing.T) {
+	runner, store, _ := upgradeFixture(t, func(string) bool { return true })
+	dir := t.TempDir()
+	ca, err := certs.LoadOrCreate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(runner, config.Config{
+		TenantDBImage:      "postgres:16.3-alpine",
+		TenantDBNamePrefix: "tenant_",
+		TenantTLSDir:       dir,
+	}, WithRegistry(store), WithCertificates(ca))
+
+	if _, err := svc.UpgradeTenant(context.Background(), "acme", "postgres:16.4-alpine"); err == nil {
+		t.Fatal("expected the upgrade to fail without a tenant certificate")
+	}
+	for _, call := range runner.calls {
+		if call[0] == "stop" {
+			t.Fatalf("old container stopped without a certificate to restart with: %v", call)
+		}
+	}
+}
+
+func TestUpgradeTenantRestoresPreviousContainerWhenUnhealthy(t *testing.T) {
+	runner, store, svc := upgradeFixture(t, func(container string) bool { return container != "new-container" })
+
+	_, err := svc.UpgradeTenant(context.Background(), "acme", "postgres:16.4-alpine")
+	if !errors.Is(err, ErrUpgradeRolledBack) {
+		t.Fatalf("err = %v, want ErrUpgradeRolledBack", err)
+	}
+	var tail []string
+	for _, call := range runner.calls[len(runner.calls)-4:] {
+		tail = append(tail, strings.Join(call, " "))
+	}
+	want := []string{"rm -f -v tenant-db-acme", "rename tenant-db-acme-previous tenant-db-acme", "start tenant-db-acme"}
+	if !slices.Equal(tail[:3], want) {
+		t.Fatalf("restore calls = %q, want %q", tail, want)
+	}
+	if record, _, _ := store.Get("acme"); record.Image != "postgres:16.3-alpine" || record.ResourceID != "old-container" {
+		t.Fatalf("record changed after a failed upgrade: %+v", record)
+	}
+}
+
+func TestUpgradeRolloutTargetsOlderMinorVersions(t *testing.T) {
+	_, store, svc := upgradeFixture(t, func(string) bool { return true })
+	_ = store.Put(registry.Tenant{Name: "globex", Container: "tenant-db-globex", Image: "postgres:16.4-alpine", Volume: "tenant-data-globex", DesiredState: registry.StateRunning})
+	_ = store.Put(registry.Tenant{Name: "initech", Container: "tenant-db-initech", Image: "postgres:15.8-alpine", Volume: "tenant-data-initech", DesiredState: registry.StateRunning})
+	_ = store.Put(registry.Tenant{Name: "umbrella", Container: "tenant-db-umbrella", Image: "postgres:16.2-alpine", Volume: "tenant-data-umbrella", DesiredState: registry.StateStopped})
+	_ = store.Put(registry.Tenant{Name: "hooli", Container: "tenant-db-hooli", Image: "postgres:16.6-alpine", Volume: "tenant-data-hooli", DesiredState: registry.StateRunning})
+	_ = store.Put(registry.Tenant{Name: "stark", Container: "tenant-db-stark", Image: "postgres:16-alpine", Volume: "tenant-data-stark", DesiredState: registry.StateRunning})
+	_ = store.Put(registry.Tenant{Name: "wayne", Container: "tenant-db-wayne", Image: "postgres:16.2-bookworm", Volume: "tenant-data-wayne", DesiredState: registry.StateRunning})
+
+	op, err := svc.StartUpgradeRollout(context.Background(), UpgradeRolloutRequest{Image: "postgres:16.4-alpine", Options: rollout.Options{Canary: 1}})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	op = waitForOperation(t, svc, op.ID)
+	// stark floats on 16-alpine but already runs 16.4; wayne is another variant.
+	if op.Status != rollout.StatusSucceeded || op.Total != 3 || op.Succeeded != 1 || op.Skipped != 2 {
+		t.Fatalf("operation = %+v", op)
+	}
+	if record, _, _ := store.Get("acme"); record.Image != "postgres:16.4-alpine" {
+		t.Fatalf("acme image = %q", record.Image)
+	}
+	if record, _, _ := store.Get("hooli"); record.Image != "postgres:16.6-alpine" {
+		t.Fatalf("tenant on a newer minor was downgraded to %q", record.Image)
+	}
+
+	for _, image := range []string{"postgres:latest", "postgres:16-alpine"} {
+		if _, err := svc.StartUpgradeRollout(context.Background(), UpgradeRolloutRequest{Image: image}); err == nil {
+			t.Fatalf("%s: expected a validation error for an unpinned tag", image)
+		}
+	}
+}
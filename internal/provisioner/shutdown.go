@@ -0,0 +1,76 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+var ErrShuttingDown = errors.New("provisioner is shutting down")
+
+type lifecycle struct {
+	mu       sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// beginOperation registers an in-flight lifecycle operation. The returned
+// context is additionally cancelled when Shutdown gives up draining.
+func (s *Service) beginOperation(ctx context.Context) (context.Context, func(), error) {
+	s.lifecycle.mu.Lock()
+	if s.lifecycle.closing {
+		s.lifecycle.mu.Unlock()
+		return nil, nil, ErrShuttingDown
+	}
+	s.lifecycle.inflight.Add(1)
+	s.lifecycle.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.lifecycle.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		s.lifecycle.inflight.Done()
+	}, nil
+}
+
+// Shutdown stops accepting lifecycle operations and waits for in-flight ones
+// until ctx is done. Operations still running at that point are cancelled and
+// roll back what they created; Shutdown waits for those rollbacks too and
+// reports that the drain timed out.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.lifecycle.mu.Lock()
+	s.lifecycle.closing = true
+	s.lifecycle.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.lifecycle.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	slog.Warn("drain timeout reached, cancelling in-flight operations")
+	s.lifecycle.cancel()
+	<-drained
+	return ctx.Err()
+}
+
+func (s *Service) ShuttingDown() bool {
+	s.lifecycle.mu.Lock()
+	defer s.lifecycle.mu.Unlock()
+	return s.lifecycle.closing
+}
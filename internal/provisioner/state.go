@@ -0,0 +1,196 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/logging"
+	"go-service/internal/registry"
+	"go-service/internal/tracing"
+)
+
+const (
+	ActionStop    = "stop"
+	ActionStart   = "start"
+	ActionRestart = "restart"
+	ActionSuspend = "suspend"
+	ActionWake    = "wake"
+)
+
+type LifecycleResult struct {
+	Status      string `json:"status"`
+	Tenant      string `json:"tenant"`
+	ResourceID  string `json:"resource_id"`
+	Host        string `json:"host,omitempty"`
+	Port        string `json:"port,omitempty"`
+	PortChanged bool   `json:"port_changed,omitempty"`
+}
+
+// StopTenant stops the tenant container without removing it or its data, and
+// records it as stopped so the reconciler leaves it alone.
+func (s *Service) StopTenant(ctx context.Context, tenantName string) (LifecycleResult, error) {
+	return s.changeState(ctx, ActionStop, tenantName)
+}
+
+// StartTenant starts a stopped tenant and waits until it accepts connections.
+// The published port may differ from the one before the stop; the result
+// reports it.
+func (s *Service) StartTenant(ctx context.Context, tenantName string) (LifecycleResult, error) {
+	return s.changeState(ctx, ActionStart, tenantName)
+}
+
+func (s *Service) RestartTenant(ctx context.Context, tenantName string) (LifecycleResult, error) {
+	return s.changeState(ctx, ActionRestart, tenantName)
+}
+
+func (s *Service) changeState(ctx context.Context, action, tenantName string) (LifecycleResult, error) {
+	start := time.Now()
+	tenant := normalizeTenantName(tenantName)
+	ctx, span := s.tracer.Start(ctx, "Service.ChangeState", trace.WithAttributes(
+		attribute.String("tenant.name", tenant),
+		attribute.String("action", action),
+	))
+	ctx = logging.With(ctx, slog.String("tenant", tenant), slog.String("action", action))
+	result, err := s.changeStateTracked(ctx, action, tenant)
+	s.observe(action, start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(
+			ctx, "tenant "+result.Status,
+			slog.String("resource_id", result.ResourceID),
+			slog.String("port", result.Port),
+			slog.Duration("duration", time.Since(start)),
+		)
+	}
+	return result, err
+}
+
+func (s *Service) changeStateTracked(ctx context.Context, action, tenant string) (LifecycleResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return LifecycleResult{}, err
+	}
+	defer done()
+	return s.applyState(ctx, action, tenant)
+}
+
+func (s *Service) applyState(ctx context.Context, action, tenant string) (LifecycleResult, error) {
+	if tenant == "" {
+		return LifecycleResult{}, ErrInvalidTenant
+	}
+
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return LifecycleResult{}, err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return LifecycleResult{}, err
+	}
+	defer release()
+
+	containerName := "tenant-db-" + tenant
+	containerID, err := s.lookupContainerID(ctx, containerName)
+	if err != nil {
+		return LifecycleResult{}, err
+	}
+	if containerID == "" {
+		return LifecycleResult{}, ErrTenantNotFound
+	}
+	record, exists, err := s.registry.Get(tenant)
+	if err != nil {
+		return LifecycleResult{}, fmt.Errorf("load tenant: %w", err)
+	}
+	if action == ActionSuspend {
+		// The idle check ran without the lock; an operator stop since then
+		// must not turn into a suspension that WakeTenant would undo.
+		if !exists {
+			return LifecycleResult{}, ErrTenantNotFound
+		}
+		if record.DesiredState == registry.StateStopped {
+			return LifecycleResult{}, ErrTenantStopped
+		}
+	}
+	if action == ActionWake {
+		// WakeTenant checked the record without the lock; an operator stop
+		// since then clears Suspended and must not be undone here.
+		if !exists {
+			return LifecycleResult{}, ErrTenantNotFound
+		}
+		if record.DesiredState != registry.StateStopped {
+			host, port := s.recordedEndpoint(record)
+			return LifecycleResult{Status: "running", Tenant: tenant, ResourceID: containerID, Host: host, Port: port}, nil
+		}
+		if !record.Suspended {
+			return LifecycleResult{}, ErrTenantStopped
+		}
+	}
+
+	result := LifecycleResult{Tenant: tenant, ResourceID: containerID}
+	desired := registry.StateRunning
+	switch action {
+	case ActionStop, ActionSuspend:
+		desired = registry.StateStopped
+		result.Status = "stopped"
+		if action == ActionSuspend {
+			result.Status = "suspended"
+		}
+		_, err = s.runner.Run(ctx, "stop", "--time", strconv.Itoa(int(s.cfg.TenantStopTimeout.Seconds())), containerID)
+	case ActionStart, ActionWake:
+		result.Status = "started"
+		if action == ActionWake {
+			result.Status = "woken"
+		}
+		_, err = s.runner.Run(ctx, "start", containerID)
+	case ActionRestart:
+		result.Status = "restarted"
+		_, err = s.runner.Run(ctx, "restart", "--time", strconv.Itoa(int(s.cfg.TenantStopTimeout.Seconds())), containerID)
+	default:
+		return LifecycleResult{}, fmt.Errorf("unknown lifecycle action %q", action)
+	}
+	if err != nil {
+		return LifecycleResult{}, fmt.Errorf("docker %s: %w", action, err)
+	}
+
+	port := record.Port
+	if desired == registry.StateRunning {
+		if err := s.waitForReady(ctx, containerID, s.cfg.TenantDBNamePrefix+tenant, s.readyTimeout(false)); err != nil {
+			return LifecycleResult{}, err
+		}
+		host, current, err := s.endpoint(ctx, containerName, containerID)
+		if err != nil {
+			return LifecycleResult{}, err
+		}
+		result.Host = host
+		result.Port = current
+		if s.publishesPorts() {
+			result.PortChanged = record.Port != "" && record.Port != current
+			port = current
+		}
+	}
+
+	err = s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			t.ResourceID = containerID
+			t.Container = containerName
+		}
+		t.DesiredState = desired
+		t.Suspended = action == ActionSuspend
+		t.Port = port
+		return nil
+	})
+	if err != nil {
+		return LifecycleResult{}, fmt.Errorf("record state: %w", err)
+	}
+	s.idle.forget(tenant)
+	s.wakes.forget(tenant)
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidRestartPolicy = errors.New("restart_policy must be no, always, unless-stopped or on-failure[:max-retries]")
+	ErrTenantNotFound       = errors.New("tenant not found")
+)
+
+type TenantStatus struct {
+	Tenant        string        `json:"tenant"`
+	TenantID      string        `json:"tenant_id,omitempty"`
+	ResourceID    string        `json:"resource_id"`
+	State         string        `json:"state"`
+	RestartPolicy string        `json:"restart_policy"`
+	RestartCount  int           `json:"restart_count"`
+	StartedAt     time.Time     `json:"started_at"`
+	CrashLooping  bool          `json:"crash_looping"`
+	Storage       *StorageUsage `json:"storage,omitempty"`
+}
+
+type containerInspect struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Status     string    `json:"Status"`
+		Restarting bool      `json:"Restarting"`
+		StartedAt  time.Time `json:"StartedAt"`
+	} `json:"State"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	HostConfig struct {
+		RestartPolicy struct {
+			Name              string `json:"Name"`
+			MaximumRetryCount int    `json:"MaximumRetryCount"`
+		} `json:"RestartPolicy"`
+	} `json:"HostConfig"`
+}
+
+func (c containerInspect) restartPolicy() string {
+	name := c.HostConfig.RestartPolicy.Name
+	if name == "" {
+		return "no"
+	}
+	if name == "on-failure" && c.HostConfig.RestartPolicy.MaximumRetryCount > 0 {
+		return fmt.Sprintf("on-failure:%d", c.HostConfig.RestartPolicy.MaximumRetryCount)
+	}
+	return name
+}
+
+func (s *Service) TenantStatus(ctx context.Context, tenantName string) (TenantStatus, error) {
+	safeTenantName := normalizeTenantName(tenantName)
+	if safeTenantName == "" {
+		return TenantStatus{}, ErrInvalidTenant
+	}
+	inspected, err := s.inspectContainers(ctx, "tenant-db-"+safeTenantName)
+	if err != nil {
+		if isNotFound(err) {
+			return TenantStatus{}, ErrTenantNotFound
+		}
+		return TenantStatus{}, err
+	}
+	if len(inspected) == 0 {
+		return TenantStatus{}, ErrTenantNotFound
+	}
+	return s.statusOf(inspected[0]), nil
+}
+
+// TenantStatuses inspects every managed container in a single docker call.
+func (s *Service) TenantStatuses(ctx context.Context) ([]TenantStatus, error) {
+	containers, err := s.ListManagedContainers(ctx)
+	if err != nil || len(containers) == 0 {
+		return nil, err
+	}
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	inspected, err := s.inspectContainers(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]TenantStatus, 0, len(inspected))
+	for _, c := range inspected {
+		statuses = append(statuses, s.statusOf(c))
+	}
+	return statuses, nil
+}
+
+func (s *Service) inspectContainers(ctx context.Context, refs ...string) ([]containerInspect, error) {
+	args := append([]string{"inspect", "--type", "container"}, refs...)
+	out, err := s.runner.Run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var inspected []containerInspect
+	if err := json.Unmarshal([]byte(out), &inspected); err != nil {
+		return nil, fmt.Errorf("decode docker inspect: %w", err)
+	}
+	return inspected, nil
+}
+
+func (s *Service) statusOf(c containerInspect) TenantStatus {
+	tenant := c.Config.Labels["tenant_name"]
+	if tenant == "" {
+		tenant = strings.TrimPrefix(strings.TrimPrefix(c.Name, "/"), "tenant-db-")
+	}
+	var storage *StorageUsage
+	if usage, ok := s.StorageUsageOf(tenant); ok {
+		storage = &usage
+	}
+	return TenantStatus{
+		Storage:       storage,
+		Tenant:        tenant,
+		TenantID:      c.Config.Labels["tenant_id"],
+		ResourceID:    c.ID,
+		State:         c.State.Status,
+		RestartPolicy: c.restartPolicy(),
+		RestartCount:  c.RestartCount,
+		StartedAt:     c.State.StartedAt,
+		CrashLooping:  s.crashLoops.observe(c, time.Now(), s.cfg.CrashLoopWindow, s.cfg.CrashLoopRestarts),
+	}
+}
+
+type restartSample struct {
+	at    time.Time
+	count int
+}
+
+// crashTracker remembers restart counts seen per container so a tenant is
+// flagged when docker restarted it threshold times within window, even if
+// each inspect happens to catch it running. Containers not inspected within
+// window, such as removed ones, are forgotten.
+type crashTracker struct {
+	mu      sync.Mutex
+	samples map[string][]restartSample
+}
+
+func (t *crashTracker) observe(c containerInspect, now time.Time, window time.Duration, threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.samples == nil {
+		t.samples = make(map[string][]restartSample)
+	}
+
+	for id, samples := range t.samples {
+		if id != c.ID && now.Sub(samples[len(samples)-1].at) > window {
+			delete(t.samples, id)
+		}
+	}
+
+	kept := []restartSample{}
+	for _, sample := range t.samples[c.ID] {
+		if now.Sub(sample.at) <= window {
+			kept = append(kept, sample)
+		}
+	}
+	kept = append(kept, restartSample{at: now, count: c.RestartCount})
+	t.samples[c.ID] = kept
+
+	if kept[len(kept)-1].count-kept[0].count >= threshold {
+		return true
+	}
+	recentlyStarted := !c.State.StartedAt.IsZero() && now.Sub(c.State.StartedAt) <= window
+	return c.RestartCount >= threshold && (c.State.Restarting || recentlyStarted)
+}
@@ -0,0 +1,283 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-service/internal/logging"
+	"go-service/internal/registry"
+)
+
+const (
+	StorageQuotaNone       = "none"
+	StorageQuotaStorageOpt = "storage-opt"
+	StorageQuotaVolume     = "volume"
+
+	StoragePolicyWarn     = "warn"
+	StoragePolicyReadOnly = "read-only"
+
+	pgDataDir = "/var/lib/postgresql/data"
+	// The postgres image declares pgDataDir as a volume, so with storage-opt
+	// the data must live elsewhere for the writable-layer quota to cover it.
+	layerPGDataDir = "/var/lib/postgresql/pgdata"
+)
+
+type StorageUsage struct {
+	Tenant    string    `json:"tenant"`
+	UsedBytes int64     `json:"used_bytes"`
+	QuotaMB   *int64    `json:"quota_mb,omitempty"`
+	Exceeded  bool      `json:"exceeded"`
+	ReadOnly  bool      `json:"read_only"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type storageUsages struct {
+	mu       sync.Mutex
+	byTenant map[string]StorageUsage
+}
+
+var ErrVolumeExists = errors.New("tenant data volume already exists; remove it before provisioning the tenant again")
+
+func volumeName(tenant string) string {
+	return "tenant-data-" + tenant
+}
+
+// volumeExists reports whether volume is already there. docker volume create
+// succeeds on an existing volume, which would hand a new tenant the old
+// tenant's initialized data directory.
+func (s *Service) volumeExists(ctx context.Context, volume string) (bool, error) {
+	out, err := s.runner.Run(ctx, "volume", "ls", "--quiet", "--filter", "name="+volume)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == volume {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) createVolume(ctx context.Context, volume, tenant string, quotaMB *int64) error {
+	args := []string{
+		"volume", "create",
+		"--label", managedByLabel,
+		"--label", "tenant_name=" + tenant,
+	}
+	if s.cfg.VolumeDriver != "" {
+		args = append(args, "--driver", s.cfg.VolumeDriver)
+	}
+	if s.cfg.StorageQuotaMode == StorageQuotaVolume && quotaMB != nil && *quotaMB > 0 {
+		args = append(args, "--opt", fmt.Sprintf("%s=%dM", s.cfg.VolumeSizeOpt, *quotaMB))
+	}
+	args = append(args, volume)
+	_, err := s.runner.Run(ctx, args...)
+	return err
+}
+
+func (s *Service) removeVolume(ctx context.Context, volume string) error {
+	_, err := s.runner.Run(ctx, "volume", "rm", "-f", volume)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// storageArgs returns the docker run flags that place the tenant's data and
+// enforce its quota.
+func (s *Service) storageArgs(volume string, quotaMB *int64) []string {
+	if s.cfg.StorageQuotaMode == StorageQuotaStorageOpt {
+		var args []string
+		if quotaMB != nil && *quotaMB > 0 {
+			args = append(args, "--storage-opt", fmt.Sprintf("size=%dM", *quotaMB))
+		}
+		return append(args, "-e", "PGDATA="+layerPGDataDir)
+	}
+	return []string{"-v", volume + ":" + pgDataDir}
+}
+
+// CheckStorage measures every running tenant with pg_database_size and
+// applies the quota policy: tenants over quota are logged, and with the
+// read-only policy their database defaults to read-only transactions until
+// usage is back under quota.
+func (s *Service) CheckStorage(ctx context.Context) ([]StorageUsage, error) {
+	records, err := s.registry.List()
+	if err != nil {
+		return nil, fmt.Errorf("load tenants: %w", err)
+	}
+	usages := make([]StorageUsage, 0, len(records))
+	for _, record := range records {
+		if record.DesiredState == registry.StateStopped {
+			continue
+		}
+		usage, ok, err := s.checkStorageLocked(ctx, record.Name)
+		if err != nil {
+			return usages, err
+		}
+		if ok {
+			usages = append(usages, usage)
+		}
+	}
+	return usages, nil
+}
+
+// checkStorageLocked measures tenant under its lock, re-reading the record
+// so a tenant stopped or deprovisioned since the listing is skipped.
+func (s *Service) checkStorageLocked(ctx context.Context, tenant string) (StorageUsage, bool, error) {
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return StorageUsage{}, false, err
+	}
+	defer unlock()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return StorageUsage{}, false, fmt.Errorf("load tenant: %w", err)
+	}
+	if !ok || record.DesiredState == registry.StateStopped {
+		return StorageUsage{}, false, nil
+	}
+	usage := s.checkTenantStorage(ctx, record)
+	s.storage.mu.Lock()
+	if s.storage.byTenant == nil {
+		s.storage.byTenant = make(map[string]StorageUsage)
+	}
+	s.storage.byTenant[record.Name] = usage
+	s.storage.mu.Unlock()
+	return usage, true, nil
+}
+
+func (s *Service) checkTenantStorage(ctx context.Context, record registry.Tenant) StorageUsage {
+	usage := StorageUsage{
+		Tenant:    record.Name,
+		QuotaMB:   record.StorageQuotaMB,
+		ReadOnly:  record.StorageReadOnly,
+		CheckedAt: time.Now().UTC(),
+	}
+	ctx = logging.With(ctx, slog.String("tenant", record.Name))
+
+	container := record.Container
+	if container == "" {
+		container = record.ResourceID
+	}
+	dbName := s.cfg.TenantDBNamePrefix + record.Name
+	out, err := s.psql(ctx, container, dbName, "SELECT pg_database_size(current_database())")
+	if err != nil {
+		usage.Error = err.Error()
+		slog.WarnContext(ctx, "storage check failed", slog.String("error", err.Error()))
+		return usage
+	}
+	usage.UsedBytes, err = strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		usage.Error = fmt.Sprintf("parse database size %q", strings.TrimSpace(out))
+		return usage
+	}
+
+	if record.StorageQuotaMB == nil || *record.StorageQuotaMB <= 0 {
+		return usage
+	}
+	quotaBytes := *record.StorageQuotaMB * 1024 * 1024
+	usage.Exceeded = usage.UsedBytes > quotaBytes
+	if usage.Exceeded {
+		slog.WarnContext(
+			ctx, "tenant over storage quota",
+			slog.Int64("used_bytes", usage.UsedBytes),
+			slog.Int64("quota_mb", *record.StorageQuotaMB),
+		)
+	}
+
+	wantReadOnly := usage.Exceeded && s.cfg.StorageQuotaPolicy == StoragePolicyReadOnly
+	if wantReadOnly == record.StorageReadOnly {
+		return usage
+	}
+	if err := s.setReadOnly(ctx, record, container, dbName, wantReadOnly); err != nil {
+		usage.Error = err.Error()
+		slog.ErrorContext(ctx, "failed to change tenant read-only mode", slog.String("error", err.Error()))
+		return usage
+	}
+	usage.ReadOnly = wantReadOnly
+	return usage
+}
+
+// setReadOnly is advisory: the tenant role is a superuser and can turn
+// default_transaction_read_only off again, per session or for the database.
+// Only the volume and storage-opt quota modes put a hard cap on the data.
+func (s *Service) setReadOnly(ctx context.Context, record registry.Tenant, container, dbName string, readOnly bool) error {
+	value := "off"
+	if readOnly {
+		value = "on"
+	}
+	statement := fmt.Sprintf("ALTER DATABASE %s SET default_transaction_read_only = %s", quoteIdent(dbName), value)
+	if _, err := s.psql(ctx, container, dbName, statement); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "tenant read-only mode changed", slog.Bool("read_only", readOnly))
+	err := s.registry.Update(record.Name, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			return registry.ErrNotFound
+		}
+		t.StorageReadOnly = readOnly
+		return nil
+	})
+	if errors.Is(err, registry.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// StorageUsageOf returns the last storage measurement for tenant.
+func (s *Service) StorageUsageOf(tenant string) (StorageUsage, bool) {
+	s.storage.mu.Lock()
+	defer s.storage.mu.Unlock()
+	usage, ok := s.storage.byTenant[tenant]
+	return usage, ok
+}
+
+// StorageUsages returns the last measurement of every tenant without running
+// any docker command.
+func (s *Service) StorageUsages() []StorageUsage {
+	s.storage.mu.Lock()
+	defer s.storage.mu.Unlock()
+	usages := make([]StorageUsage, 0, len(s.storage.byTenant))
+	for _, usage := range s.storage.byTenant {
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+func (s *Service) forgetStorageUsage(tenant string) {
+	s.storage.mu.Lock()
+	defer s.storage.mu.Unlock()
+	delete(s.storage.byTenant, tenant)
+}
+
+func (s *Service) psql(ctx context.Context, container, dbName, statement string) (string, error) {
+	return s.runner.Run(
+		ctx,
+		"exec", container,
+		"psql", "-h", "127.0.0.1", "-U", s.cfg.TenantDBUser, "-d", dbName,
+		"-v", "ON_ERROR_STOP=1", "-tAc", statement,
+	)
+}
+
+// psqlScript runs script in a single transaction, streamed over stdin so
+// large migrations do not hit the argument size limit.
+func (s *Service) psqlScript(ctx context.Context, container, dbName, script string) (string, error) {
+	return s.runner.RunInput(
+		ctx, script,
+		"exec", "-i", container,
+		"psql", "-h", "127.0.0.1", "-U", s.cfg.TenantDBUser, "-d", dbName,
+		"-v", "ON_ERROR_STOP=1", "-1", "-f", "-",
+	)
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
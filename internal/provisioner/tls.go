@@ -0,0 +1,262 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go-service/internal/certs"
+	"go-service/internal/logging"
+	"go-service/internal/registry"
+)
+
+const (
+	// tlsMountDir is where the tenant's certificate directory is mounted.
+	tlsMountDir = "/etc/postgresql/tls"
+	// tlsServerDir holds the postgres-owned copy Postgres actually reads; it
+	// refuses a key owned by another user or readable by others.
+	tlsServerDir = "/var/lib/postgresql/tls"
+
+	installCertScript = "install -d -o postgres -g postgres -m 0700 " + tlsServerDir +
+		" && install -o postgres -g postgres -m 0644 " + tlsMountDir + "/server.crt " + tlsServerDir + "/server.crt" +
+		" && install -o postgres -g postgres -m 0600 " + tlsMountDir + "/server.key " + tlsServerDir + "/server.key"
+)
+
+func WithCertificates(ca *certs.Authority) Option {
+	return func(s *Service) {
+		s.ca = ca
+	}
+}
+
+// CABundle returns the PEM certificate of the internal CA, or false when
+// tenant TLS is not enabled.
+func (s *Service) CABundle() ([]byte, bool) {
+	if s.ca == nil {
+		return nil, false
+	}
+	return s.ca.BundlePEM(), true
+}
+
+func (s *Service) certDir(tenant string) string {
+	return filepath.Join(s.cfg.TenantTLSDir, "tenants", tenant)
+}
+
+// issueCertificate writes a new server certificate for tenant, valid for the
+// container name and the configured host, to the tenant's directory.
+func (s *Service) issueCertificate(tenant string) (time.Time, error) {
+	dir := s.certDir(tenant)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return time.Time{}, fmt.Errorf("create certificate dir: %w", err)
+	}
+	return s.writeCertificate(tenant, dir)
+}
+
+func (s *Service) writeCertificate(tenant, dir string) (time.Time, error) {
+	containerName := "tenant-db-" + tenant
+	issued, err := s.ca.Issue(containerName, []string{containerName, s.cfg.TenantDBHost}, s.cfg.TenantCertValidity)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "server.key"), issued.KeyPEM, 0o600); err != nil {
+		return time.Time{}, fmt.Errorf("write key: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "server.crt"), issued.CertPEM, 0o644); err != nil {
+		return time.Time{}, fmt.Errorf("write certificate: %w", err)
+	}
+	return issued.NotAfter, nil
+}
+
+// certStage is a certificate issued for a provision that has not succeeded
+// yet. It is written to a temporary directory so that a failed provision, or
+// one that loses a name conflict, leaves the tenant's directory untouched.
+type certStage struct {
+	dir      string
+	staged   string
+	previous string
+	done     bool
+}
+
+func (s *Service) stageCertificate(tenant string) (*certStage, time.Time, error) {
+	dir := s.certDir(tenant)
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return nil, time.Time{}, fmt.Errorf("create certificate dir: %w", err)
+	}
+	staged, err := os.MkdirTemp(filepath.Dir(dir), tenant+".*.tmp")
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("create certificate dir: %w", err)
+	}
+	if err := os.Chmod(staged, 0o755); err != nil {
+		os.RemoveAll(staged)
+		return nil, time.Time{}, fmt.Errorf("create certificate dir: %w", err)
+	}
+	notAfter, err := s.writeCertificate(tenant, staged)
+	if err != nil {
+		os.RemoveAll(staged)
+		return nil, time.Time{}, err
+	}
+	return &certStage{dir: dir, staged: staged}, notAfter, nil
+}
+
+// install moves the staged certificate to the path docker run mounts. A
+// directory already there is set aside, not removed, until commit; a running
+// container that mounts it keeps the same directory through the rename.
+func (c *certStage) install() error {
+	if _, err := os.Stat(c.dir); err == nil {
+		c.previous = c.staged + ".prev"
+		if err := os.Rename(c.dir, c.previous); err != nil {
+			c.previous = ""
+			return fmt.Errorf("install certificate: %w", err)
+		}
+	}
+	if err := os.Rename(c.staged, c.dir); err != nil {
+		return fmt.Errorf("install certificate: %w", err)
+	}
+	c.staged = ""
+	return nil
+}
+
+// commit drops the directory install set aside once the provision succeeded.
+func (c *certStage) commit() {
+	c.done = true
+	if c.previous != "" {
+		os.RemoveAll(c.previous)
+	}
+}
+
+// discard undoes stageCertificate and install, putting back whatever was in
+// the tenant's directory before.
+func (c *certStage) discard() error {
+	if c.done {
+		return nil
+	}
+	if c.staged != "" {
+		return os.RemoveAll(c.staged)
+	}
+	if err := os.RemoveAll(c.dir); err != nil {
+		return err
+	}
+	if c.previous != "" {
+		return os.Rename(c.previous, c.dir)
+	}
+	return nil
+}
+
+// checkCertificate reports an error unless the tenant's certificate and key
+// are on disk.
+func (s *Service) checkCertificate(tenant string) error {
+	for _, name := range []string{"server.crt", "server.key"} {
+		if _, err := os.Stat(filepath.Join(s.certDir(tenant), name)); err != nil {
+			return fmt.Errorf("tenant certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) removeCertificates(tenant string) error {
+	if s.ca == nil {
+		return nil
+	}
+	return os.RemoveAll(s.certDir(tenant))
+}
+
+// tlsRunArgs returns the docker run flags that mount the tenant certificate
+// and the entrypoint that installs it before starting Postgres with SSL. The
+// Postgres arguments are passed to the entrypoint after the image.
+func (s *Service) tlsRunArgs(tenant string) []string {
+	return []string{
+		"-v", s.certDir(tenant) + ":" + tlsMountDir + ":ro",
+		"--entrypoint", "sh",
+	}
+}
+
+func tlsCommand(postgresArgs []string) []string {
+	command := []string{
+		"-c", installCertScript + ` && exec docker-entrypoint.sh postgres "$@"`, "sh",
+		"-c", "ssl=on",
+		"-c", "ssl_cert_file=" + tlsServerDir + "/server.crt",
+		"-c", "ssl_key_file=" + tlsServerDir + "/server.key",
+	}
+	return append(command, postgresArgs...)
+}
+
+// RenewCertificates reissues tenant certificates that expire within the
+// configured renewal window. Running tenants pick up the new certificate with
+// a configuration reload; stopped ones install it when they start.
+func (s *Service) RenewCertificates(ctx context.Context) ([]string, error) {
+	if s.ca == nil {
+		return nil, nil
+	}
+	records, err := s.registry.List()
+	if err != nil {
+		return nil, fmt.Errorf("load tenants: %w", err)
+	}
+	var renewed []string
+	for _, record := range records {
+		if record.CertExpiresAt.IsZero() || time.Until(record.CertExpiresAt) > s.cfg.TenantCertRenewBefore {
+			continue
+		}
+		tctx := logging.With(ctx, slog.String("tenant", record.Name))
+		if err := s.renewCertificate(tctx, record.Name); err != nil {
+			slog.ErrorContext(tctx, "certificate renewal failed", slog.String("error", err.Error()))
+			continue
+		}
+		renewed = append(renewed, record.Name)
+	}
+	return renewed, nil
+}
+
+func (s *Service) renewCertificate(ctx context.Context, tenant string) error {
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return fmt.Errorf("load tenant: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	notAfter, err := s.issueCertificate(tenant)
+	if err != nil {
+		return err
+	}
+	if record.DesiredState != registry.StateStopped {
+		container := record.Container
+		if container == "" {
+			container = record.ResourceID
+		}
+		if _, err := s.runner.Run(ctx, "exec", "-u", "root", container, "sh", "-c", installCertScript); err != nil {
+			return fmt.Errorf("install certificate: %w", err)
+		}
+		if _, err := s.psql(ctx, container, s.cfg.TenantDBNamePrefix+tenant, "SELECT pg_reload_conf()"); err != nil {
+			return fmt.Errorf("reload configuration: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "tenant certificate renewed", slog.Time("expires_at", notAfter))
+	err = s.registry.Update(tenant, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			return registry.ErrNotFound
+		}
+		t.CertExpiresAt = notAfter
+		return nil
+	})
+	if errors.Is(err, registry.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
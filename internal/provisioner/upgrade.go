@@ -0,0 +1,473 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-service/internal/logging"
+	"go-service/internal/registry"
+	"go-service/internal/rollout"
+	"go-service/internal/tracing"
+)
+
+const PullAlways = "always"
+
+var (
+	ErrUpgradeUnsupported = errors.New("tenant data does not live on a volume and cannot be moved to a new container")
+	ErrUpgradeRolledBack  = errors.New("upgrade failed, previous container restored")
+	ErrUpgradeNotNewer    = errors.New("tenant already runs this version or a later one")
+)
+
+type UpgradeResult struct {
+	Status        string `json:"status"`
+	Tenant        string `json:"tenant"`
+	ResourceID    string `json:"resource_id"`
+	Image         string `json:"image"`
+	ImageDigest   string `json:"image_digest,omitempty"`
+	PreviousImage string `json:"previous_image"`
+	ServerVersion string `json:"server_version"`
+}
+
+type UpgradeRolloutRequest struct {
+	Image         string   `json:"image"`
+	CanaryTenants []string `json:"canary_tenants,omitempty"`
+	rollout.Options
+}
+
+// ensureImage makes image available locally and returns its digest. With the
+// default pull policy an image already present is not pulled again.
+func (s *Service) ensureImage(ctx context.Context, image string) (string, error) {
+	if s.cfg.TenantDBPullPolicy != PullAlways {
+		digest, err := s.imageDigest(ctx, image)
+		if err == nil {
+			return digest, nil
+		}
+		if !isNotFound(err) {
+			return "", err
+		}
+	}
+	if err := s.pullImage(ctx, image); err != nil {
+		return "", err
+	}
+	return s.imageDigest(ctx, image)
+}
+
+// imageDigest prefers the registry digest, which pins the image across
+// hosts, and falls back to the local image ID for images never pushed.
+func (s *Service) imageDigest(ctx context.Context, image string) (string, error) {
+	out, err := s.runner.Run(ctx, "image", "inspect", "--format", `{{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}`, image)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// splitImage returns the repository and tag of an image reference.
+func splitImage(image string) (string, string) {
+	image, _, _ = strings.Cut(image, "@")
+	slash := strings.LastIndex(image, "/")
+	if colon := strings.LastIndex(image, ":"); colon > slash {
+		return image[:colon], image[colon+1:]
+	}
+	return image, "latest"
+}
+
+// tagVersion returns the leading numbers of a tag: [16 4] for 16.4-alpine.
+func tagVersion(tag string) ([]int, bool) {
+	var version []int
+	for _, part := range strings.Split(tag[:versionEnd(tag)], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		version = append(version, n)
+	}
+	return version, true
+}
+
+// tagVariant returns what follows the version in a tag: -alpine for
+// 16.4-alpine.
+func tagVariant(tag string) string {
+	return tag[versionEnd(tag):]
+}
+
+func versionEnd(tag string) int {
+	end := strings.IndexFunc(tag, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end == -1 {
+		return len(tag)
+	}
+	return end
+}
+
+// pinnedVersion reports whether a version names a minor release. A tag such
+// as 16-alpine floats: the release it runs depends on when it was pulled.
+func pinnedVersion(version []int) bool {
+	return len(version) >= 2
+}
+
+// newerVersion reports whether a is a later version than b; missing
+// components count as zero, so 16 and 16.0 are the same version.
+func newerVersion(a, b []int) bool {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// minorUpgrade reports whether to is a later minor release of from.
+func minorUpgrade(from, to []int) bool {
+	return from[0] == to[0] && newerVersion(to, from)
+}
+
+// checkMinorUpgrade only allows later images of the same repository, variant
+// and Postgres major version: a major upgrade needs pg_upgrade, not a new
+// container, older images may not read the data directory and another libc
+// can change collation order under existing indexes. The target must be
+// pinned to a minor release.
+func checkMinorUpgrade(verr *ValidationError, from, to string) {
+	fromRepo, fromTag := splitImage(from)
+	toRepo, toTag := splitImage(to)
+	if fromRepo != toRepo {
+		verr.add("image", "must be from repository %s", fromRepo)
+		return
+	}
+	fromVersion, ok := tagVersion(fromTag)
+	if !ok {
+		verr.add("image", "cannot tell the version of the current image %s", from)
+		return
+	}
+	toVersion, ok := tagVersion(toTag)
+	switch {
+	case !ok || toVersion[0] != fromVersion[0]:
+		verr.add("image", "must keep major version %d", fromVersion[0])
+	case tagVariant(toTag) != tagVariant(fromTag):
+		verr.add("image", "must keep the image variant %q", tagVariant(fromTag))
+	case !pinnedVersion(toVersion):
+		verr.add("image", "must pin a minor version such as %d.4%s", toVersion[0], tagVariant(toTag))
+	case !minorUpgrade(fromVersion, toVersion):
+		verr.add("image", "must be newer than the current version %s", fromTag)
+	}
+}
+
+// UpgradeTenant moves a tenant to a new minor image by recreating its
+// container on the same data volume. If the new container does not become
+// healthy the previous one is restored.
+func (s *Service) UpgradeTenant(ctx context.Context, tenantName, image string) (UpgradeResult, error) {
+	start := time.Now()
+	tenant := normalizeTenantName(tenantName)
+	ctx, span := s.tracer.Start(ctx, "Service.UpgradeTenant", trace.WithAttributes(
+		attribute.String("tenant.name", tenant),
+		attribute.String("image", image),
+	))
+	ctx = logging.With(ctx, slog.String("tenant", tenant), slog.String("image", image))
+	result, err := s.upgradeTracked(ctx, tenant, strings.TrimSpace(image))
+	s.observe("upgrade", start, err)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(
+			ctx, "tenant upgraded",
+			slog.String("resource_id", result.ResourceID),
+			slog.String("image_digest", result.ImageDigest),
+			slog.Duration("duration", time.Since(start)),
+		)
+	}
+	return result, err
+}
+
+func (s *Service) upgradeTracked(ctx context.Context, tenant, image string) (UpgradeResult, error) {
+	ctx, done, err := s.beginOperation(ctx)
+	if err != nil {
+		return UpgradeResult{}, err
+	}
+	defer done()
+	return s.upgradeTenant(ctx, tenant, image)
+}
+
+func (s *Service) upgradeTenant(ctx context.Context, tenant, image string) (UpgradeResult, error) {
+	if tenant == "" {
+		return UpgradeResult{}, ErrInvalidTenant
+	}
+
+	unlock, err := s.lockTenant(ctx, tenant)
+	if err != nil {
+		return UpgradeResult{}, err
+	}
+	defer unlock()
+
+	release, err := s.acquireSlot(ctx)
+	if err != nil {
+		return UpgradeResult{}, err
+	}
+	defer release()
+
+	record, ok, err := s.registry.Get(tenant)
+	if err != nil {
+		return UpgradeResult{}, fmt.Errorf("load tenant: %w", err)
+	}
+	if !ok {
+		return UpgradeResult{}, ErrTenantNotFound
+	}
+	verr := &ValidationError{}
+	if image == "" {
+		verr.add("image", "is required")
+	} else {
+		checkMinorUpgrade(verr, record.Image, image)
+	}
+	if err := verr.orNil(); err != nil {
+		return UpgradeResult{}, err
+	}
+	if record.Volume == "" {
+		return UpgradeResult{}, ErrUpgradeUnsupported
+	}
+	if record.DesiredState == registry.StateStopped {
+		return UpgradeResult{}, ErrTenantStopped
+	}
+	if _, fromTag := splitImage(record.Image); !pinnedTag(fromTag) {
+		if err := s.checkRunningVersion(ctx, record, image); err != nil {
+			return UpgradeResult{}, err
+		}
+	}
+	return s.recreate(ctx, record, image)
+}
+
+func pinnedTag(tag string) bool {
+	version, ok := tagVersion(tag)
+	return ok && pinnedVersion(version)
+}
+
+// checkRunningVersion compares image with the release the tenant actually
+// runs, for tenants on a floating tag whose version the tag does not tell.
+func (s *Service) checkRunningVersion(ctx context.Context, record registry.Tenant, image string) error {
+	container := record.Container
+	if container == "" {
+		container = "tenant-db-" + record.Name
+	}
+	out, err := s.psql(ctx, container, s.cfg.TenantDBNamePrefix+record.Name, "SHOW server_version")
+	if err != nil {
+		return fmt.Errorf("read server version: %w", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return fmt.Errorf("read server version: empty output")
+	}
+	running, ok := tagVersion(fields[0])
+	if !ok {
+		return fmt.Errorf("read server version: cannot parse %q", fields[0])
+	}
+	_, tag := splitImage(image)
+	if target, _ := tagVersion(tag); !newerVersion(target, running) {
+		return fmt.Errorf("%w: running %s", ErrUpgradeNotNewer, fields[0])
+	}
+	return nil
+}
+
+// recreate replaces the tenant container with one running image. The old
+// container is stopped and renamed, not removed, until the new one passes
+// its health checks.
+func (s *Service) recreate(ctx context.Context, record registry.Tenant, image string) (UpgradeResult, error) {
+	var digest string
+	err := s.step(ctx, "pull_image", func(ctx context.Context) error {
+		var err error
+		digest, err = s.ensureImage(ctx, image)
+		return err
+	})
+	if err != nil {
+		return UpgradeResult{}, err
+	}
+
+	containerName := "tenant-db-" + record.Name
+	previous := containerName + "-previous"
+	dbName := s.cfg.TenantDBNamePrefix + record.Name
+	hostPort := 0
+	if s.publishesPorts() && record.Port != "" {
+		hostPort, _ = strconv.Atoi(record.Port)
+	}
+	args, _ := s.runArgs(containerConfig{
+		tenant:         record.Name,
+		tenantID:       record.TenantID,
+		network:        record.Network,
+		hostPort:       hostPort,
+		restartPolicy:  record.RestartPolicy,
+		plan:           record.Plan,
+		volume:         record.Volume,
+		storageQuotaMB: record.StorageQuotaMB,
+		limits:         Limits(record.Limits),
+		image:          image,
+		settings:       record.Settings,
+	})
+
+	// The new container installs the certificate as it starts; without it
+	// the upgrade would fail only after the old container is down.
+	if s.ca != nil {
+		if err := s.checkCertificate(record.Name); err != nil {
+			return UpgradeResult{}, err
+		}
+	}
+	if _, err := s.runner.Run(ctx, "stop", "--time", strconv.Itoa(int(s.cfg.TenantStopTimeout.Seconds())), containerName); err != nil {
+		return UpgradeResult{}, fmt.Errorf("stop container: %w", err)
+	}
+	if _, err := s.runner.Run(ctx, "rename", containerName, previous); err != nil {
+		s.restore(ctx, "", previous, containerName, dbName, false)
+		return UpgradeResult{}, fmt.Errorf("rename container: %w", err)
+	}
+
+	var containerID, serverVersion, port string
+	err = s.step(ctx, "recreate", func(ctx context.Context) error {
+		out, err := s.runner.Run(ctx, args...)
+		if err != nil {
+			return err
+		}
+		containerID = strings.TrimSpace(out)
+		if err := s.waitForReady(ctx, containerID, dbName, s.readyTimeout(true)); err != nil {
+			return err
+		}
+		out, err = s.psql(ctx, containerID, dbName, "SHOW server_version")
+		if err != nil {
+			return fmt.Errorf("health check: %w", err)
+		}
+		serverVersion = strings.TrimSpace(out)
+		_, port, err = s.endpoint(ctx, containerName, containerID)
+		return err
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "upgraded container unhealthy, restoring previous one", slog.String("error", err.Error()))
+		if rerr := s.restore(ctx, containerName, previous, containerName, dbName, true); rerr != nil {
+			return UpgradeResult{}, fmt.Errorf("upgrade failed: %v; restore failed: %w", err, rerr)
+		}
+		return UpgradeResult{}, fmt.Errorf("%w: %v", ErrUpgradeRolledBack, err)
+	}
+
+	if err := s.removeContainer(context.WithoutCancel(ctx), previous); err != nil {
+		slog.ErrorContext(ctx, "failed to remove previous container", slog.String("container", previous), slog.String("error", err.Error()))
+	}
+	s.idle.forget(record.Name)
+	err = s.registry.Update(record.Name, func(t *registry.Tenant, exists bool) error {
+		if !exists {
+			return ErrTenantNotFound
+		}
+		t.ResourceID = containerID
+		t.Container = containerName
+		t.Image = image
+		t.ImageDigest = digest
+		t.Suspended = false
+		if s.publishesPorts() {
+			t.Port = port
+		}
+		return nil
+	})
+	if err != nil {
+		return UpgradeResult{}, fmt.Errorf("record upgrade: %w", err)
+	}
+	return UpgradeResult{
+		Status:        "upgraded",
+		Tenant:        record.Name,
+		ResourceID:    containerID,
+		Image:         image,
+		ImageDigest:   digest,
+		PreviousImage: record.Image,
+		ServerVersion: serverVersion,
+	}, nil
+}
+
+// restore puts the previous container back under its name and starts it. It
+// runs detached from cancellation, like rollback.
+func (s *Service) restore(ctx context.Context, failed, previous, containerName, dbName string, renamed bool) error {
+	ctx = context.WithoutCancel(ctx)
+	if failed != "" {
+		if err := s.removeContainer(ctx, failed); err != nil {
+			return err
+		}
+	}
+	if renamed {
+		if _, err := s.runner.Run(ctx, "rename", previous, containerName); err != nil {
+			return err
+		}
+	}
+	if _, err := s.runner.Run(ctx, "start", containerName); err != nil {
+		return err
+	}
+	return s.waitForReady(ctx, containerName, dbName, s.readyTimeout(true))
+}
+
+// StartUpgradeRollout upgrades, in the background, every tenant running an
+// older image of the same repository and major version as req.Image. Each
+// tenant that fails is restored to its previous container and stops the
+// rollout.
+func (s *Service) StartUpgradeRollout(ctx context.Context, req UpgradeRolloutRequest) (rollout.Operation, error) {
+	ctx, span := s.tracer.Start(ctx, "Service.StartUpgradeRollout", trace.WithAttributes(
+		attribute.String("image", req.Image),
+	))
+	ctx = logging.With(ctx, slog.String("image", req.Image))
+	op, err := s.startUpgradeRollout(ctx, req)
+	tracing.End(span, err)
+	if err == nil {
+		slog.InfoContext(ctx, "upgrade rollout started", slog.String("operation_id", op.ID), slog.Int("tenants", op.Total))
+	}
+	return op, err
+}
+
+func (s *Service) startUpgradeRollout(ctx context.Context, req UpgradeRolloutRequest) (rollout.Operation, error) {
+	verr := &ValidationError{}
+	image := strings.TrimSpace(req.Image)
+	repo, tag := splitImage(image)
+	version, ok := tagVersion(tag)
+	if image == "" {
+		verr.add("image", "is required")
+	} else if !ok || !pinnedVersion(version) {
+		verr.add("image", "must have a versioned tag such as 16.4-alpine")
+	}
+
+	records, err := s.registry.List()
+	if err != nil {
+		return rollout.Operation{}, fmt.Errorf("load tenants: %w", err)
+	}
+	var tenants []string
+	for _, record := range records {
+		recordRepo, recordTag := splitImage(record.Image)
+		recordVersion, recordOK := tagVersion(recordTag)
+		if ok && recordOK && recordRepo == repo && tagVariant(recordTag) == tagVariant(tag) && minorUpgrade(recordVersion, version) {
+			tenants = append(tenants, record.Name)
+		}
+	}
+	slices.Sort(tenants)
+	tenants, opts, err := rolloutOrder(verr, tenants, req.CanaryTenants, req.Options)
+	if err != nil {
+		return rollout.Operation{}, err
+	}
+
+	start := time.Now()
+	step := func(ctx context.Context, tenant string) (string, error) {
+		result, err := s.UpgradeTenant(ctx, tenant, image)
+		switch {
+		case errors.Is(err, ErrTenantStopped):
+			return "tenant is stopped", rollout.ErrSkipped
+		case errors.Is(err, ErrUpgradeNotNewer):
+			return "already on a newer version", rollout.ErrSkipped
+		case err != nil:
+			return "", err
+		}
+		return "upgraded to " + result.ServerVersion, nil
+	}
+	finish := func(op rollout.Operation) {
+		s.finishRollout(ctx, op, start)
+	}
+	return s.rollouts.Start(ctx, "upgrade", tenants, opts, step, finish), nil
+}
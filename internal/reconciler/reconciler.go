@@ -0,0 +1,68 @@
+package reconciler
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go-service/internal/provisioner"
+)
+
+// Reconciler runs Service.Reconcile on an interval and keeps the last result
+// for the report endpoint. Runs never overlap: a manual trigger during a
+// scheduled run waits for it and then runs again.
+type Reconciler struct {
+	service  *provisioner.Service
+	interval time.Duration
+	policy   string
+
+	run  sync.Mutex
+	mu   sync.Mutex
+	last *provisioner.ReconcileResult
+}
+
+func New(service *provisioner.Service, interval time.Duration, policy string) *Reconciler {
+	return &Reconciler{service: service, interval: interval, policy: policy}
+}
+
+// Start runs the reconcile loop until ctx is done. A non-positive interval
+// disables the loop; Trigger still works.
+func (r *Reconciler) Start(ctx context.Context) {
+	if r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result := r.Trigger(ctx)
+			if result.Error != "" {
+				slog.ErrorContext(ctx, "reconcile failed", slog.String("error", result.Error))
+			}
+		}
+	}
+}
+
+func (r *Reconciler) Trigger(ctx context.Context) provisioner.ReconcileResult {
+	r.run.Lock()
+	defer r.run.Unlock()
+
+	result := r.service.Reconcile(ctx, r.policy)
+	r.mu.Lock()
+	r.last = &result
+	r.mu.Unlock()
+	return result
+}
+
+func (r *Reconciler) Last() (provisioner.ReconcileResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return provisioner.ReconcileResult{}, false
+	}
+	return *r.last, true
+}
@@ -0,0 +1,39 @@
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"go-service/internal/config"
+	"go-service/internal/provisioner"
+)
+
+type stubRunner struct{}
+
+func (stubRunner) Run(_ context.Context, args ...string) (string, error) {
+	if args[0] == "ps" {
+		return "abc\ttenant-db-acme\texited\t2020-01-01 00:00:00 +0000 UTC\tmanaged_by=iam-provisioner,tenant_name=acme", nil
+	}
+	return "", nil
+}
+
+func (r stubRunner) RunInput(ctx context.Context, _ string, args ...string) (string, error) {
+	return r.Run(ctx, args...)
+}
+
+func TestTriggerStoresLastResult(t *testing.T) {
+	svc := provisioner.NewService(stubRunner{}, config.Config{})
+	r := New(svc, 0, provisioner.ReconcileReport)
+
+	if _, ok := r.Last(); ok {
+		t.Fatal("expected no result before first run")
+	}
+	result := r.Trigger(context.Background())
+	if len(result.Findings) != 1 || result.Findings[0].Kind != provisioner.FindingOrphan {
+		t.Fatalf("unexpected findings: %+v", result.Findings)
+	}
+	last, ok := r.Last()
+	if !ok || last.StartedAt != result.StartedAt {
+		t.Fatalf("Last() = %+v, %v", last, ok)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package registry
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(*os.File) error {
+	return errors.New("file locks are only supported on unix")
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound can be returned from an Update callback to leave a missing
+// record absent instead of creating it.
+var ErrNotFound = errors.New("tenant not in registry")
+
+const (
+	StateRunning = "running"
+	StateStopped = "stopped"
+)
+
+type Tenant struct {
+	Name             string            `json:"name"`
+	TenantID         string            `json:"tenant_id,omitempty"`
+	ResourceID       string            `json:"resource_id"`
+	Container        string            `json:"container"`
+	Network          string            `json:"network"`
+	DedicatedNetwork bool              `json:"dedicated_network,omitempty"`
+	Image            string            `json:"image"`
+	ImageDigest      string            `json:"image_digest,omitempty"`
+	Plan             string            `json:"plan,omitempty"`
+	RestartPolicy    string            `json:"restart_policy,omitempty"`
+	Limits           Limits            `json:"limits"`
+	Volume           string            `json:"volume,omitempty"`
+	Port             string            `json:"port,omitempty"`
+	StorageQuotaMB   *int64            `json:"storage_quota_mb,omitempty"`
+	StorageReadOnly  bool              `json:"storage_read_only,omitempty"`
+	DesiredState     string            `json:"desired_state"`
+	Suspended        bool              `json:"suspended,omitempty"`
+	CertExpiresAt    time.Time         `json:"cert_expires_at,omitzero"`
+	AppContainers    []string          `json:"app_containers,omitempty"`
+	Settings         map[string]string `json:"settings,omitempty"`
+	Extensions       []string          `json:"extensions,omitempty"`
+	MigrationBundle  string            `json:"migration_bundle,omitempty"`
+	MigrationVersion string            `json:"migration_version,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
+}
+
+type Limits struct {
+	MemoryMB     *int64   `json:"memory_mb,omitempty"`
+	CPUCores     *float64 `json:"cpu_cores,omitempty"`
+	MemorySwapMB *int64   `json:"memory_swap_mb,omitempty"`
+	PidsLimit    *int64   `json:"pids_limit,omitempty"`
+	BlkioWeight  *int64   `json:"blkio_weight,omitempty"`
+}
+
+// Store is the provisioner's record of which tenants should exist. With an
+// empty path it only lives in memory; otherwise every change re-reads the JSON
+// file and replaces it atomically while holding a flock on a sidecar lock
+// file, so replicas sharing the file do not overwrite each other's records.
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	tenants map[string]Tenant
+}
+
+func NewMemoryStore() *Store {
+	return &Store{tenants: make(map[string]Tenant)}
+}
+
+// Open loads the registry at path. created reports whether the file did not
+// exist yet, which callers use to seed it from running containers.
+func Open(path string) (store *Store, created bool, err error) {
+	s := &Store{path: path, tenants: make(map[string]Tenant)}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, false, fmt.Errorf("create registry dir: %w", err)
+	}
+	err = s.withFileLock(func() error {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			created = true
+			return s.saveLocked()
+		}
+		return s.loadLocked()
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return s, created, nil
+}
+
+func (s *Store) Get(name string) (Tenant, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadLocked(); err != nil {
+		return Tenant{}, false, err
+	}
+	t, ok := s.tenants[name]
+	return t, ok, nil
+}
+
+func (s *Store) List() ([]Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadLocked(); err != nil {
+		return nil, err
+	}
+	out := make([]Tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (s *Store) FindByResourceID(resourceID string) (Tenant, bool, error) {
+	tenants, err := s.List()
+	if err != nil {
+		return Tenant{}, false, err
+	}
+	for _, t := range tenants {
+		if t.ResourceID == resourceID {
+			return t, true, nil
+		}
+	}
+	return Tenant{}, false, nil
+}
+
+func (s *Store) Put(t Tenant) error {
+	return s.Update(t.Name, func(existing *Tenant, _ bool) error {
+		*existing = t
+		return nil
+	})
+}
+
+// Update applies fn to the tenant's record under the store lock and persists
+// the result. exists is false when the record is new.
+func (s *Store) Update(name string, fn func(t *Tenant, exists bool) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withFileLock(func() error {
+		if err := s.loadLocked(); err != nil {
+			return err
+		}
+		t, exists := s.tenants[name]
+		if err := fn(&t, exists); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if t.CreatedAt.IsZero() {
+			t.CreatedAt = now
+		}
+		t.UpdatedAt = now
+		t.Name = name
+		s.tenants[name] = t
+		return s.saveLocked()
+	})
+}
+
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withFileLock(func() error {
+		if err := s.loadLocked(); err != nil {
+			return err
+		}
+		if _, ok := s.tenants[name]; !ok {
+			return nil
+		}
+		delete(s.tenants, name)
+		return s.saveLocked()
+	})
+}
+
+// withFileLock runs fn holding an exclusive flock on path+".lock", which
+// serializes read-modify-write cycles across processes. Reads skip it because
+// the file is only ever replaced by rename.
+func (s *Store) withFileLock(fn func() error) error {
+	if s.path == "" {
+		return fn()
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("open registry lock: %w", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("lock registry: %w", err)
+	}
+	defer unlockFile(f)
+	return fn()
+}
+
+func (s *Store) loadLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read registry: %w", err)
+	}
+	tenants := make(map[string]Tenant)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &tenants); err != nil {
+			return fmt.Errorf("decode registry: %w", err)
+		}
+	}
+	s.tenants = tenants
+	return nil
+}
+
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(s.tenants, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("write registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write registry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("replace registry: %w", err)
+	}
+	return nil
+}
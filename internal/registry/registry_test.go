@@ -0,0 +1,114 @@
+package registry
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileStorePersistsAcrossOpens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	store, created, err := Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !created {
+		t.Fatal("expected created=true for a new registry")
+	}
+	if err := store.Put(Tenant{Name: "acme", ResourceID: "container-1", DesiredState: StateRunning}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	reopened, created, err := Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created {
+		t.Fatal("expected created=false for an existing registry")
+	}
+	got, ok, err := reopened.Get("acme")
+	if err != nil || !ok {
+		t.Fatalf("get: ok=%v err=%v", ok, err)
+	}
+	if got.ResourceID != "container-1" || got.CreatedAt.IsZero() {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+
+	byID, ok, _ := reopened.FindByResourceID("container-1")
+	if !ok || byID.Name != "acme" {
+		t.Fatalf("FindByResourceID = %+v, %v", byID, ok)
+	}
+}
+
+func TestStoresSeeEachOthersWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	a, _, _ := Open(path)
+	b, _, _ := Open(path)
+
+	_ = a.Put(Tenant{Name: "acme"})
+	_ = b.Put(Tenant{Name: "globex"})
+
+	tenants, err := a.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tenants) != 2 || tenants[0].Name != "acme" || tenants[1].Name != "globex" {
+		t.Fatalf("tenants = %+v, want acme and globex", tenants)
+	}
+
+	_ = b.Delete("acme")
+	if _, ok, _ := a.Get("acme"); ok {
+		t.Fatal("expected acme to be deleted")
+	}
+}
+
+func TestConcurrentStoresDoNotLoseWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	a, _, _ := Open(path)
+	b, _, _ := Open(path)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		for _, store := range []*Store{a, b} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := store.Put(Tenant{Name: fmt.Sprintf("tenant%d_%p", i, store)}); err != nil {
+					t.Errorf("put: %v", err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	tenants, err := a.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tenants) != 40 {
+		t.Fatalf("got %d tenants, want 40", len(tenants))
+	}
+	matches, _ := filepath.Glob(path + ".*.tmp")
+	if len(matches) != 0 {
+		t.Fatalf("leftover temp files: %v", matches)
+	}
+}
+
+func TestUpdateKeepsCreatedAt(t *testing.T) {
+	store := NewMemoryStore()
+	_ = store.Put(Tenant{Name: "acme"})
+	first, _, _ := store.Get("acme")
+
+	_ = store.Update("acme", func(t *Tenant, exists bool) error {
+		if !exists {
+			return nil
+		}
+		t.DesiredState = StateStopped
+		return nil
+	})
+	got, _, _ := store.Get("acme")
+	if got.DesiredState != StateStopped || !got.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatalf("unexpected record after update: %+v", got)
+	}
+}
@@ -0,0 +1,263 @@
+package rollout
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Operation statuses.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Tenant statuses within an operation.
+const (
+	TenantPending   = "pending"
+	TenantSucceeded = "succeeded"
+	TenantFailed    = "failed"
+	TenantSkipped   = "skipped"
+	TenantNotRun    = "not_run"
+)
+
+// maxFinished is how many finished operations are kept for the API.
+const maxFinished = 100
+
+// ErrSkipped tells the manager a tenant was left alone on purpose; it does not
+// count as a failure.
+var ErrSkipped = errors.New("skipped")
+
+// Options control how a rollout spreads over tenants. The first Canary
+// tenants run on their own; the rest follow in batches of BatchSize with at
+// most Parallelism tenants at a time. A phase with a failure stops the rollout.
+type Options struct {
+	Canary      int `json:"canary"`
+	BatchSize   int `json:"batch_size"`
+	Parallelism int `json:"parallelism"`
+}
+
+func (o Options) withDefaults() Options {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 10
+	}
+	if o.Parallelism <= 0 {
+		o.Parallelism = 1
+	}
+	if o.Canary < 0 {
+		o.Canary = 0
+	}
+	return o
+}
+
+// Step runs the rollout for one tenant and returns a short detail for the
+// report.
+type Step func(ctx context.Context, tenant string) (string, error)
+
+type TenantResult struct {
+	Tenant string `json:"tenant"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Operation struct {
+	ID         string         `json:"id"`
+	Kind       string         `json:"kind"`
+	Status     string         `json:"status"`
+	Phase      string         `json:"phase"`
+	Options    Options        `json:"options"`
+	Total      int            `json:"total"`
+	Succeeded  int            `json:"succeeded"`
+	Failed     int            `json:"failed"`
+	Skipped    int            `json:"skipped"`
+	Tenants    []TenantResult `json:"tenants"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at,omitzero"`
+}
+
+// Manager runs rollouts in the background and keeps their progress in memory.
+type Manager struct {
+	mu    sync.Mutex
+	ops   map[string]*Operation
+	order []string
+}
+
+func NewManager() *Manager {
+	return &Manager{ops: make(map[string]*Operation)}
+}
+
+// Start begins a rollout of step over tenants, in the given order, and
+// returns right away. done, if not nil, is called with the final operation.
+func (m *Manager) Start(ctx context.Context, kind string, tenants []string, opts Options, step Step, done func(Operation)) Operation {
+	opts = opts.withDefaults()
+	op := &Operation{
+		ID:        newID(),
+		Kind:      kind,
+		Status:    StatusRunning,
+		Phase:     "pending",
+		Options:   opts,
+		Total:     len(tenants),
+		Tenants:   make([]TenantResult, len(tenants)),
+		StartedAt: time.Now().UTC(),
+	}
+	for i, tenant := range tenants {
+		op.Tenants[i] = TenantResult{Tenant: tenant, Status: TenantPending}
+	}
+
+	m.mu.Lock()
+	m.ops[op.ID] = op
+	m.order = append(m.order, op.ID)
+	m.pruneLocked()
+	snapshot := op.clone()
+	m.mu.Unlock()
+
+	go func() {
+		m.run(context.WithoutCancel(ctx), op, step)
+		if done != nil {
+			final, _ := m.Get(op.ID)
+			done(final)
+		}
+	}()
+	return snapshot
+}
+
+func (m *Manager) run(ctx context.Context, op *Operation, step Step) {
+	opts := op.Options
+	canary := min(opts.Canary, op.Total)
+	phases := [][2]int{}
+	if canary > 0 {
+		phases = append(phases, [2]int{0, canary})
+	}
+	for start := canary; start < op.Total; start += opts.BatchSize {
+		phases = append(phases, [2]int{start, min(start+opts.BatchSize, op.Total)})
+	}
+
+	for i, phase := range phases {
+		name := fmt.Sprintf("batch %d/%d", i+1, len(phases))
+		if canary > 0 {
+			name = fmt.Sprintf("batch %d/%d", i, len(phases)-1)
+			if i == 0 {
+				name = "canary"
+			}
+		}
+		m.update(op, func() { op.Phase = name })
+		if failed := m.runPhase(ctx, op, phase[0], phase[1], step); failed {
+			m.update(op, func() {
+				for j := phase[1]; j < op.Total; j++ {
+					op.Tenants[j].Status = TenantNotRun
+				}
+				op.Status = StatusFailed
+				op.Error = "stopped after a failure in " + name
+				op.FinishedAt = time.Now().UTC()
+			})
+			return
+		}
+	}
+	m.update(op, func() {
+		op.Phase = "done"
+		op.Status = StatusSucceeded
+		op.FinishedAt = time.Now().UTC()
+	})
+}
+
+// runPhase runs step for tenants[from:to] with bounded parallelism and
+// reports whether any of them failed.
+func (m *Manager) runPhase(ctx context.Context, op *Operation, from, to int, step Step) bool {
+	sem := make(chan struct{}, op.Options.Parallelism)
+	var wg sync.WaitGroup
+	failed := false
+	for i := from; i < to; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			detail, err := step(ctx, op.Tenants[i].Tenant)
+			m.update(op, func() {
+				result := &op.Tenants[i]
+				result.Detail = detail
+				switch {
+				case errors.Is(err, ErrSkipped):
+					result.Status = TenantSkipped
+					op.Skipped++
+				case err != nil:
+					result.Status = TenantFailed
+					result.Error = err.Error()
+					op.Failed++
+					failed = true
+				default:
+					result.Status = TenantSucceeded
+					op.Succeeded++
+				}
+			})
+		}(i)
+	}
+	wg.Wait()
+	return failed
+}
+
+func (m *Manager) update(op *Operation, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn()
+}
+
+func (m *Manager) Get(id string) (Operation, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.ops[id]
+	if !ok {
+		return Operation{}, false
+	}
+	return op.clone(), true
+}
+
+// List returns the known operations, newest first.
+func (m *Manager) List() []Operation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := make([]Operation, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		ops = append(ops, m.ops[m.order[i]].clone())
+	}
+	return ops
+}
+
+// pruneLocked drops the oldest finished operations beyond maxFinished.
+func (m *Manager) pruneLocked() {
+	finished := 0
+	for _, id := range m.order {
+		if m.ops[id].Status != StatusRunning {
+			finished++
+		}
+	}
+	kept := m.order[:0]
+	for _, id := range m.order {
+		if finished > maxFinished && m.ops[id].Status != StatusRunning {
+			delete(m.ops, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+func (op *Operation) clone() Operation {
+	c := *op
+	c.Tenants = append([]TenantResult(nil), op.Tenants...)
+	return c
+}
+
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,91 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startAndWait(t *testing.T, m *Manager, tenants []string, opts Options, step Step) Operation {
+	t.Helper()
+	done := make(chan Operation, 1)
+	started := m.Start(context.Background(), "test", tenants, opts, step, func(op Operation) { done <- op })
+	if started.Status != StatusRunning || started.Total != len(tenants) {
+		t.Fatalf("started = %+v", started)
+	}
+	select {
+	case op := <-done:
+		return op
+	case <-time.After(5 * time.Second):
+		t.Fatal("rollout did not finish")
+		return Operation{}
+	}
+}
+
+func TestRolloutRunsCanaryThenBatches(t *testing.T) {
+	m := NewManager()
+	var mu sync.Mutex
+	var order []string
+	var running, peak atomic.Int32
+	step := func(_ context.Context, tenant string) (string, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		order = append(order, tenant)
+		mu.Unlock()
+		if tenant == "e" {
+			return "", ErrSkipped
+		}
+		return "ok", nil
+	}
+
+	op := startAndWait(t, m, []string{"a", "b", "c", "d", "e", "f"}, Options{Canary: 1, BatchSize: 3, Parallelism: 2}, step)
+	if op.Status != StatusSucceeded || op.Succeeded != 5 || op.Skipped != 1 || op.Phase != "done" {
+		t.Fatalf("operation = %+v", op)
+	}
+	if order[0] != "a" {
+		t.Fatalf("canary did not run first: %v", order)
+	}
+	if peak.Load() > 2 {
+		t.Fatalf("peak parallelism = %d, want at most 2", peak.Load())
+	}
+	if got, ok := m.Get(op.ID); !ok || got.Status != StatusSucceeded {
+		t.Fatalf("Get = %+v, %v", got, ok)
+	}
+}
+
+func TestRolloutStopsAfterFailedPhase(t *testing.T) {
+	m := NewManager()
+	var calls atomic.Int32
+	step := func(_ context.Context, tenant string) (string, error) {
+		calls.Add(1)
+		if tenant == "b" {
+			return "", errors.New("boom")
+		}
+		return "", nil
+	}
+
+	op := startAndWait(t, m, []string{"a", "b", "c", "d", "e"}, Options{Canary: 2, BatchSize: 2}, step)
+	if op.Status != StatusFailed || op.Failed != 1 || op.Phase != "canary" {
+		t.Fatalf("operation = %+v", op)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls = %d, want only the canary", calls.Load())
+	}
+	if op.Tenants[1].Error != "boom" || op.Tenants[4].Status != TenantNotRun {
+		t.Fatalf("tenants = %+v", op.Tenants)
+	}
+	if list := m.List(); len(list) != 1 || list[0].ID != op.ID {
+		t.Fatalf("list = %+v", list)
+	}
+}
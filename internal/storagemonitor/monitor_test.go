@@ -0,0 +1,56 @@
+package storagemonitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-service/internal/config"
+	"go-service/internal/provisioner"
+	"go-service/internal/registry"
+)
+
+type stubRunner struct{}
+
+func (stubRunner) Run(_ context.Context, args ...string) (string, error) {
+	if args[0] == "exec" {
+		return "4096\n", nil
+	}
+	return "", nil
+}
+
+func (r stubRunner) RunInput(ctx context.Context, _ string, args ...string) (string, error) {
+	return r.Run(ctx, args...)
+}
+
+func TestStartMeasuresTenantsUntilCancelled(t *testing.T) {
+	store := registry.NewMemoryStore()
+	if err := store.Put(registry.Tenant{Name: "acme", Container: "tenant-db-acme", DesiredState: registry.StateRunning}); err != nil {
+		t.Fatal(err)
+	}
+	svc := provisioner.NewService(stubRunner{}, config.Config{}, provisioner.WithRegistry(store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		New(svc, 5*time.Millisecond).Start(ctx)
+		close(done)
+	}()
+
+	deadline := time.After(time.Second)
+	for {
+		if usage, ok := svc.StorageUsageOf("acme"); ok {
+			if usage.UsedBytes != 4096 {
+				t.Fatalf("used bytes = %d, want 4096", usage.UsedBytes)
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("storage was never measured")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,77 @@
+package tenantlock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var unsafeKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// FileLocker serializes lifecycle operations across every provisioner replica
+// sharing dir. It layers an advisory file lock on top of the in-process lock
+// so local callers queue without polling the file system.
+type FileLocker struct {
+	dir          string
+	pollInterval time.Duration
+	local        *MemoryLocker
+}
+
+func NewFileLocker(dir string) (*FileLocker, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create lock dir: %w", err)
+	}
+	return &FileLocker{
+		dir:          dir,
+		pollInterval: 50 * time.Millisecond,
+		local:        NewMemoryLocker(),
+	}, nil
+}
+
+func (l *FileLocker) Lock(ctx context.Context, key string) (func(), error) {
+	unlockLocal, err := l.local.Lock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(l.dir, unsafeKeyChars.ReplaceAllString(key, "_")+".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		unlockLocal()
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+
+	ticker := time.NewTicker(l.pollInterval)
+	defer ticker.Stop()
+	for {
+		acquired, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			unlockLocal()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if acquired {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			_ = f.Close()
+			unlockLocal()
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			_ = unlockFile(f)
+			_ = f.Close()
+			unlockLocal()
+		})
+	}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package tenantlock
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(*os.File) (bool, error) {
+	return false, errors.New("file locks are only supported on unix")
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package tenantlock
+
+import (
+	"context"
+	"sync"
+)
+
+type Locker interface {
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+}
+
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: make(map[string]*keyLock)}
+}
+
+func (l *MemoryLocker) Lock(ctx context.Context, key string) (func(), error) {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{sem: make(chan struct{}, 1)}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	select {
+	case kl.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.release(key, kl)
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-kl.sem
+			l.release(key, kl)
+		})
+	}, nil
+}
+
+func (l *MemoryLocker) release(key string, kl *keyLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kl.refs--
+	if kl.refs == 0 {
+		delete(l.locks, key)
+	}
+}
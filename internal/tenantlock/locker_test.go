@@ -0,0 +1,70 @@
+package tenantlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryLockerSerializesSameKey(t *testing.T) {
+	l := NewMemoryLocker()
+	unlock, err := l.Lock(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Lock(ctx, "acme"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded while key is held", err)
+	}
+
+	other, err := l.Lock(context.Background(), "globex")
+	if err != nil {
+		t.Fatalf("different key should not block: %v", err)
+	}
+	other()
+
+	unlock()
+	again, err := l.Lock(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("unexpected error after unlock: %v", err)
+	}
+	again()
+
+	if len(l.locks) != 0 {
+		t.Fatalf("locks map should be empty after release, got %d entries", len(l.locks))
+	}
+}
+
+func TestFileLockerExcludesOtherLockers(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewFileLocker(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := NewFileLocker(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.pollInterval = 5 * time.Millisecond
+
+	unlock, err := a.Lock(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := b.Lock(ctx, "acme"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded while another locker holds the key", err)
+	}
+
+	unlock()
+	unlockB, err := b.Lock(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("unexpected error after release: %v", err)
+	}
+	unlockB()
+}
@@ -0,0 +1,37 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupFileExporterWritesSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Setup(context.Background(), Config{Exporter: "file", FilePath: path, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, span := Tracer("test").Start(context.Background(), "provision.run")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read trace file: %v", err)
+	}
+	if !strings.Contains(string(raw), "provision.run") || !strings.Contains(string(raw), ServiceName) {
+		t.Fatalf("trace file missing span: %s", raw)
+	}
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,104 @@
+package workqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ErrQueueFull struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("docker operation queue is full, retry after %s", e.RetryAfter)
+}
+
+type Stats struct {
+	InFlight      int `json:"in_flight"`
+	Queued        int `json:"queued"`
+	MaxConcurrent int `json:"max_concurrent"`
+	MaxQueued     int `json:"max_queued"`
+}
+
+// Queue bounds how many docker operations run at once. Callers beyond
+// maxConcurrent wait in a FIFO-ish queue of at most maxQueued entries; once
+// that is full Acquire fails fast with ErrQueueFull.
+type Queue struct {
+	slots      chan struct{}
+	maxQueued  int
+	retryAfter time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+func New(maxConcurrent, maxQueued int, retryAfter time.Duration) *Queue {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	if maxQueued < 0 {
+		maxQueued = 0
+	}
+	return &Queue{
+		slots:      make(chan struct{}, maxConcurrent),
+		maxQueued:  maxQueued,
+		retryAfter: retryAfter,
+	}
+}
+
+func (q *Queue) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case q.slots <- struct{}{}:
+		return q.releaseFunc(), nil
+	default:
+	}
+
+	q.mu.Lock()
+	if q.queued >= q.maxQueued {
+		q.mu.Unlock()
+		return nil, &ErrQueueFull{RetryAfter: q.retryAfter}
+	}
+	q.queued++
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		q.queued--
+		q.mu.Unlock()
+	}()
+
+	select {
+	case q.slots <- struct{}{}:
+		return q.releaseFunc(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *Queue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-q.slots })
+	}
+}
+
+func (q *Queue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued
+}
+
+func (q *Queue) InFlight() int {
+	return len(q.slots)
+}
+
+func (q *Queue) Stats() Stats {
+	return Stats{
+		InFlight:      q.InFlight(),
+		Queued:        q.Depth(),
+		MaxConcurrent: cap(q.slots),
+		MaxQueued:     q.maxQueued,
+	}
+}
@@ -0,0 +1,70 @@
+package workqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireRejectsWhenQueueFull(t *testing.T) {
+	q := New(1, 1, 5*time.Second)
+
+	release, err := q.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waiterDone := make(chan error, 1)
+	go func() {
+		r, err := q.Acquire(context.Background())
+		if err == nil {
+			r()
+		}
+		waiterDone <- err
+	}()
+	waitFor(t, func() bool { return q.Depth() == 1 })
+
+	_, err = q.Acquire(context.Background())
+	var full *ErrQueueFull
+	if !errors.As(err, &full) {
+		t.Fatalf("err = %v, want ErrQueueFull", err)
+	}
+	if full.RetryAfter != 5*time.Second {
+		t.Fatalf("retry after = %s, want 5s", full.RetryAfter)
+	}
+
+	release()
+	if err := <-waiterDone; err != nil {
+		t.Fatalf("queued waiter failed: %v", err)
+	}
+	if stats := q.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("stats = %+v, want empty queue", stats)
+	}
+}
+
+func TestAcquireHonoursContextWhileQueued(t *testing.T) {
+	q := New(1, 4, time.Second)
+	release, _ := q.Acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if q.Depth() != 0 {
+		t.Fatalf("depth = %d, want 0 after cancelled waiter", q.Depth())
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,17 +1,40 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/joho/godotenv"
 
+	"go-service/internal/certmonitor"
+	"go-service/internal/certs"
 	"go-service/internal/config"
 	"go-service/internal/docker"
 	"go-service/internal/httpapi"
+	"go-service/internal/idempotency"
+	"go-service/internal/idlemonitor"
+	"go-service/internal/logging"
+	"go-service/internal/metrics"
+	"go-service/internal/migrations"
+	"go-service/internal/pgproxy"
+	"go-service/internal/plans"
 	"go-service/internal/provisioner"
+	"go-service/internal/reconciler"
+	"go-service/internal/registry"
+	"go-service/internal/storagemonitor"
+	"go-service/internal/tenantlock"
+	"go-service/internal/tracing"
+	"go-service/internal/workqueue"
 )
 
 func main() {
@@ -19,12 +42,137 @@ func main() {
 
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("invalid config: %v", err)
+		fatal("invalid config", err)
 	}
 
-	runner := docker.NewRuntime(cfg.DockerBin, cfg.DockerCommandTimeout)
-	service := provisioner.NewService(runner, cfg)
-	handler := httpapi.NewHandler(service)
+	logger, err := logging.New(os.Stdout, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fatal("invalid logging config", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.TracingExporter,
+		FilePath:    cfg.TracingFile,
+		SampleRatio: cfg.TracingSampleRatio,
+	})
+	if err != nil {
+		fatal("failed to init tracing", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush traces", slog.String("error", err.Error()))
+		}
+	}()
+
+	promMetrics := metrics.New()
+	runner := promMetrics.InstrumentRunner(docker.NewRuntime(cfg.DockerBin, cfg.DockerCommandTimeout))
+
+	var locker tenantlock.Locker = tenantlock.NewMemoryLocker()
+	if cfg.TenantLockBackend == "file" {
+		locker, err = tenantlock.NewFileLocker(cfg.TenantLockDir)
+		if err != nil {
+			fatal("failed to init tenant locks", err)
+		}
+	}
+
+	queue := workqueue.New(cfg.DockerMaxConcurrent, cfg.DockerMaxQueued, cfg.DockerQueueRetry)
+	promMetrics.RegisterQueue(queue.Depth, queue.InFlight)
+
+	tenantRegistry := registry.NewMemoryStore()
+	registryCreated := false
+	if cfg.RegistryPath != "" {
+		tenantRegistry, registryCreated, err = registry.Open(cfg.RegistryPath)
+		if err != nil {
+			fatal("failed to open tenant registry", err)
+		}
+	}
+
+	serviceOpts := []provisioner.Option{
+		provisioner.WithLocker(locker),
+		provisioner.WithQueue(queue),
+		provisioner.WithObserver(promMetrics),
+		provisioner.WithRegistry(tenantRegistry),
+	}
+	if cfg.PlansFile != "" {
+		catalog, err := plans.Load(cfg.PlansFile)
+		if err != nil {
+			fatal("failed to load plans catalog", err)
+		}
+		serviceOpts = append(serviceOpts, provisioner.WithPlans(catalog))
+	}
+
+	if len(cfg.MigrationBundles) > 0 {
+		bundles, err := migrations.Load(cfg.MigrationBundles)
+		if err != nil {
+			fatal("failed to load migration bundles", err)
+		}
+		serviceOpts = append(serviceOpts, provisioner.WithMigrations(bundles))
+	}
+
+	if cfg.TenantTLSDir != "" {
+		ca, err := certs.LoadOrCreate(cfg.TenantTLSDir)
+		if err != nil {
+			fatal("failed to load tenant CA", err)
+		}
+		serviceOpts = append(serviceOpts, provisioner.WithCertificates(ca))
+	}
+	service := provisioner.NewService(runner, cfg, serviceOpts...)
+	if err := service.CheckPlans(); err != nil {
+		fatal("invalid plans catalog", err)
+	}
+	if registryCreated || cfg.RegistryPath == "" {
+		seeded, err := service.SeedRegistry(context.Background())
+		if err != nil {
+			slog.Warn("failed to seed tenant registry", slog.String("error", err.Error()))
+		} else {
+			slog.Info("seeded tenant registry from managed containers", slog.Int("tenants", seeded))
+		}
+	}
+	promMetrics.RegisterContainerStates(service.ContainerStates, cfg.DockerCommandTimeout)
+	promMetrics.RegisterTenantRestarts(func(ctx context.Context) ([]metrics.TenantRestarts, error) {
+		statuses, err := service.TenantStatuses(ctx)
+		if err != nil {
+			return nil, err
+		}
+		restarts := make([]metrics.TenantRestarts, 0, len(statuses))
+		for _, st := range statuses {
+			restarts = append(restarts, metrics.TenantRestarts{
+				Tenant:       st.Tenant,
+				RestartCount: st.RestartCount,
+				CrashLooping: st.CrashLooping,
+			})
+		}
+		return restarts, nil
+	}, cfg.DockerCommandTimeout)
+
+	promMetrics.RegisterTenantStorage(func() []metrics.TenantStorage {
+		usages := service.StorageUsages()
+		storage := make([]metrics.TenantStorage, 0, len(usages))
+		for _, usage := range usages {
+			var quotaBytes int64
+			if usage.QuotaMB != nil {
+				quotaBytes = *usage.QuotaMB * 1024 * 1024
+			}
+			storage = append(storage, metrics.TenantStorage{
+				Tenant:     usage.Tenant,
+				UsedBytes:  usage.UsedBytes,
+				QuotaBytes: quotaBytes,
+			})
+		}
+		return storage
+	})
+
+	reconcileLoop := reconciler.New(service, cfg.ReconcileInterval, cfg.ReconcilePolicy)
+	storageMonitor := storagemonitor.New(service, cfg.StorageMonitorEvery)
+	idleMonitor := idlemonitor.New(service, cfg.IdleCheckInterval)
+	certMonitor := certmonitor.New(service, cfg.CertCheckInterval)
+
+	handler := httpapi.NewHandler(
+		service,
+		httpapi.WithIdempotencyStore(idempotency.NewStore(cfg.IdempotencyTTL)),
+		httpapi.WithReconciler(reconcileLoop),
+	)
 
 	app := fiber.New(fiber.Config{
 		BodyLimit:    cfg.HTTPBodyLimitBytes,
@@ -35,11 +183,18 @@ func main() {
 	app.Use(requestid.New(requestid.Config{
 		Header: "X-Request-ID",
 	}))
+	app.Use(httpapi.Tracing())
+	app.Use(httpapi.RequestContext())
+	app.Use(promMetrics.Middleware())
 	app.Use(limiter.New(limiter.Config{
 		Max:        cfg.RateLimitMax,
 		Expiration: cfg.RateLimitWindow,
 		Next: func(c *fiber.Ctx) bool {
-			return c.Path() == "/healthz"
+			switch c.Path() {
+			case "/healthz", "/readyz", "/metrics":
+				return true
+			}
+			return false
 		},
 		LimitReached: func(c *fiber.Ctx) error {
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
@@ -47,10 +202,77 @@ func main() {
 			})
 		},
 	}))
+	app.Get("/metrics", adaptor.HTTPHandler(promMetrics.Handler()))
 	handler.Register(app)
 
-	log.Printf("provisioner listening on :%s", cfg.Port)
-	if err := app.Listen(":" + cfg.Port); err != nil {
-		log.Fatalf("failed to start server: %v", err)
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	go reconcileLoop.Start(signalCtx)
+	go storageMonitor.Start(signalCtx)
+	go idleMonitor.Start(signalCtx)
+	go certMonitor.Start(signalCtx)
+
+	if cfg.PGProxyAddr != "" {
+		var proxyOpts []pgproxy.Option
+		if cfg.PGProxyTLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.PGProxyTLSCertFile, cfg.PGProxyTLSKeyFile)
+			if err != nil {
+				fatal("failed to load proxy certificate", err)
+			}
+			proxyOpts = append(proxyOpts, pgproxy.WithTLS(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			}))
+		}
+		proxy := pgproxy.New(pgproxy.ResolverFunc(func(ctx context.Context, route pgproxy.Route) (string, error) {
+			return service.ProxyTarget(ctx, route.Database, route.ServerName)
+		}), proxyOpts...)
+		proxyListener, err := net.Listen("tcp", cfg.PGProxyAddr)
+		if err != nil {
+			fatal("failed to start postgres proxy", err)
+		}
+		go func() {
+			slog.Info("postgres proxy listening", slog.String("addr", cfg.PGProxyAddr))
+			if err := proxy.Serve(signalCtx, proxyListener); err != nil {
+				slog.Error("postgres proxy stopped", slog.String("error", err.Error()))
+			}
+		}()
 	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		slog.Info("provisioner listening", slog.String("addr", ":"+cfg.Port))
+		listenErr <- app.Listen(":" + cfg.Port)
+	}()
+
+	select {
+	case err := <-listenErr:
+		if err != nil {
+			slog.Error("failed to start server", slog.String("error", err.Error()))
+		}
+		return
+	case <-signalCtx.Done():
+	}
+
+	slog.Info("shutdown requested, draining in-flight operations", slog.Duration("timeout", cfg.ShutdownDrainTimeout))
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.ShutdownDrainTimeout)
+	defer cancelDrain()
+	if err := service.Shutdown(drainCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("drain timed out, unfinished operations were cancelled and rolled back")
+		} else {
+			slog.Error("drain failed", slog.String("error", err.Error()))
+		}
+	}
+
+	if err := app.ShutdownWithTimeout(cfg.HTTPWriteTimeout); err != nil {
+		slog.Error("http shutdown failed", slog.String("error", err.Error()))
+	}
+	slog.Info("provisioner stopped")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, slog.String("error", err.Error()))
+	os.Exit(1)
 }